@@ -1,25 +1,27 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"sunnyproxy/internal/auth"
+	"sunnyproxy/internal/ca"
+	"sunnyproxy/internal/capture"
+	"sunnyproxy/internal/domainfilter"
 	"sunnyproxy/internal/ipfilter"
 	"sunnyproxy/internal/logger"
+	"sunnyproxy/internal/netutil"
 	"sunnyproxy/internal/proxy"
+	"sunnyproxy/internal/ratelimit"
 	"sunnyproxy/internal/rules"
 	"sunnyproxy/internal/web"
 	"sunnyproxy/pkg/config"
@@ -27,13 +29,22 @@ import (
 
 func main() {
 	configPath := flag.String("config", "configs/config.yaml", "配置文件路径")
+	hashPassword := flag.Bool("hash-password", false, "从标准输入读取密码，输出用于 proxy_auth 的 bcrypt 哈希")
 	flag.Parse()
 
+	if *hashPassword {
+		if err := printPasswordHash(); err != nil {
+			log.Fatalf("生成密码哈希失败: %v", err)
+		}
+		return
+	}
+
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Printf("加载配置文件失败，使用默认配置: %v\n", err)
 		cfg = config.Default()
 	}
+	fileServer := cfg.Server
 
 	// 支持 Render/Railway 等平台的 PORT 环境变量
 	// Railway 模式：单端口同时提供 Web 和代理服务
@@ -50,35 +61,141 @@ func main() {
 
 	broadcaster := logger.GetBroadcaster()
 	broadcaster.SetConsoleOutput(cfg.Logging.Console)
+	if err := broadcaster.SetWebSocketConfig(cfg.Logging.WebSocket); err != nil {
+		log.Fatalf("实时日志配置无效: %v", err)
+	}
 
 	engine, err := rules.NewEngine(cfg.Rules.File)
 	if err != nil {
 		log.Printf("初始化规则引擎失败: %v\n", err)
 		engine, _ = rules.NewEngine("rules.json")
 	}
+	engine.SetOnAutoDisable(broadcaster.LogRuleDisabled)
+
+	domainFilter, err := domainfilter.New(cfg.DomainFilter)
+	if err != nil {
+		log.Printf("域名过滤配置无效，使用默认白名单: %v\n", err)
+		domainFilter, _ = domainfilter.New(config.Default().DomainFilter)
+	}
+
+	// 代理认证配置无效时拒绝启动，避免代理端口在无认证的情况下对外开放
+	proxyAuth, err := auth.New(cfg.Security.ProxyAuth)
+	if err != nil {
+		log.Fatalf("代理认证配置无效: %v", err)
+	}
+	if proxyAuth.IsEnabled() {
+		log.Printf("[Auth] 代理认证已启用，用户数: %d", len(cfg.Security.ProxyAuth.Users))
+	}
+
+	limiter, err := ratelimit.New(cfg.RateLimit)
+	if err != nil {
+		log.Fatalf("限流配置无效: %v", err)
+	}
+
+	flowStore, err := capture.New(cfg.Capture)
+	if err != nil {
+		log.Fatalf("流量捕获配置无效: %v", err)
+	}
+	// 每条流量完成时推送一条 response 日志，带状态码、客户端 IP 和命中的规则
+	flowStore.SetOnFinish(func(f *capture.Flow) {
+		status := 0
+		if f.Response != nil {
+			status = f.Response.StatusCode
+		}
+		broadcaster.LogResponse(f.Request.Method, f.Request.URL, f.ClientIP, status, f.Rules, f.Error)
+	})
+
+	breakpoints, err := proxy.NewBreakpoints(cfg.Breakpoints)
+	if err != nil {
+		log.Fatalf("断点配置无效: %v", err)
+	}
 
 	wrapper := proxy.NewWrapper()
+	wrapper.SetEngine(engine)
+	wrapper.SetProxyAuth(proxyAuth)
+	wrapper.SetRateLimiter(limiter)
+	wrapper.SetCapture(flowStore)
+	wrapper.SetBreakpoints(breakpoints)
 	wrapper.SetPort(cfg.Server.ProxyPort)
+	wrapper.SetDomainFilter(domainFilter)
+	if err := wrapper.GetMitmScope().Update(cfg.Mitm); err != nil {
+		log.Printf("MITM 范围配置无效，仅解密默认域名: %v\n", err)
+	}
+	wrapper.SetCertOptions(cfg.Mitm)
+	if err := wrapper.SetUpstreamTLS(cfg.UpstreamTLS); err != nil {
+		log.Fatalf("上游证书校验配置无效: %v", err)
+	}
 
-	caCert, caKey, err := loadOrGenerateCA()
-	if err != nil {
-		log.Printf("生成 CA 证书失败: %v\n", err)
+	caManager := ca.NewManager(cfg.CA)
+	if err := caManager.LoadOrGenerate(); err != nil {
+		log.Printf("加载 CA 证书失败: %v\n", err)
 	} else {
-		if err := wrapper.SetCA(caCert, caKey); err != nil {
+		current := caManager.Current()
+		if err := wrapper.SetCA(current.CertPEM, current.KeyPEM); err != nil {
 			log.Printf("设置 CA 证书失败: %v\n", err)
 		}
 	}
+	caManager.SetOnChange(wrapper.SetCA)
 
 	wrapper.EnableMITM()
 
 	handler := proxy.NewHandler(engine)
 	handler.SetupHandlers(wrapper.GetProxy())
+	wrapper.EnableBreakpoints()
+	wrapper.EnableCapture()
+
+	filter, err := ipfilter.New(cfg.IPFilter)
+	if err != nil {
+		log.Fatalf("IP 过滤配置无效: %v", err)
+	}
+	// 认证失败、访问被拒绝的域名和触发限流都计入自动封禁
+	filter.SetOnBan(func(ip, offence string, bans int, d time.Duration) {
+		broadcaster.LogIPFilter(ip, fmt.Sprintf("自动封禁 %v（%s，第 %d 次）", d, offence, bans))
+	})
+	wrapper.SetOnViolation(func(ip, offence string) {
+		filter.Report(ip, offence)
+	})
+	limiter.SetOnReject(func(ip, user, reason string) {
+		broadcaster.LogRateLimited(ip, user, reason)
+		filter.Report(ip, ipfilter.OffenceRateLimited)
+	})
+	if filter.IsEnabled() {
+		log.Printf("[IPFilter] IP过滤已启用，允许国家: %v，拒绝国家: %v，fail_open: %v",
+			cfg.IPFilter.AllowedCountries, cfg.IPFilter.DeniedCountries, cfg.IPFilter.FailOpen)
+	}
 
-	// 初始化IP过滤器（只允许中国IP）
-	filter := ipfilter.GetFilter()
-	log.Printf("IP过滤已启用，仅允许中国IP访问")
+	// PROXY protocol 配置无效时拒绝启动，避免把负载均衡器的地址当作客户端地址
+	proxyProto, err := netutil.NewProxyProtocol(cfg.Server.ProxyProtocol)
+	if err != nil {
+		log.Fatalf("PROXY protocol 配置无效: %v", err)
+	}
+	if proxyProto != nil {
+		log.Printf("PROXY protocol 已启用，受信任的上游: %v", cfg.Server.ProxyProtocol.TrustedCIDRs)
+	}
 
 	webServer := web.NewServer(cfg, engine, wrapper)
+	webServer.SetCAManager(caManager)
+	webServer.SetIPFilter(filter)
+	webServer.SetProxyProtocol(proxyProto)
+
+	reload := &reloader{
+		configPath:   *configPath,
+		current:      cfg,
+		fileServer:   fileServer,
+		engine:       engine,
+		webServer:    webServer,
+		ipFilter:     filter,
+		domainFilter: domainFilter,
+		wrapper:      wrapper,
+		proxyAuth:    proxyAuth,
+		limiter:      limiter,
+		flowStore:    flowStore,
+		breakpoints:  breakpoints,
+		broadcaster:  broadcaster,
+	}
+	if err := reload.apply(cfg); err != nil {
+		log.Printf("应用配置失败: %v\n", err)
+	}
 
 	if singlePortMode {
 		// 单端口模式：组合 Web 和代理
@@ -103,7 +220,12 @@ func main() {
 		go func() {
 			addr := fmt.Sprintf("%s:%d", cfg.Server.BindIP, cfg.Server.WebPort)
 			log.Printf("启动单端口服务（Web+代理），地址: %s\n", addr)
-			if err := http.ListenAndServe(addr, combinedHandler); err != nil {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Fatalf("服务启动失败: %v\n", err)
+			}
+			// 单端口模式下 Web 连接也计入限流
+			if err := http.Serve(limiter.Listener(proxyProto.Listener(listener)), combinedHandler); err != nil {
 				log.Fatalf("服务启动失败: %v\n", err)
 			}
 		}()
@@ -123,8 +245,9 @@ func main() {
 			if err != nil {
 				log.Fatalf("代理服务启动失败: %v\n", err)
 			}
-			filteredListener := &filteredListener{Listener: listener, filter: filter}
-			if err := http.Serve(filteredListener, wrapper.GetProxy()); err != nil {
+			// 先解析 PROXY 头，IP 过滤才能看到真实客户端地址
+			filteredListener := &filteredListener{Listener: proxyProto.Listener(listener), filter: filter}
+			if err := http.Serve(limiter.Listener(filteredListener), wrapper.GetProxy()); err != nil {
 				log.Fatalf("代理服务启动失败: %v\n", err)
 			}
 		}()
@@ -137,6 +260,21 @@ func main() {
 	log.Printf("证书下载: http://%s:%d/ssl", cfg.Server.BindIP, cfg.Server.WebPort)
 	log.Println("========================================")
 
+	// 每分钟检查一次过期规则和待生效的 CA
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n := engine.DisableExpiredRules(); n > 0 {
+				log.Printf("[Rules] 自动禁用了 %d 条过期规则", n)
+			}
+			if _, err := caManager.CheckPending(); err != nil {
+				log.Printf("[CA] 切换到新的 CA 失败: %v", err)
+				broadcaster.LogError("ca", err.Error())
+			}
+		}
+	}()
+
 	// 启动定时清理任务
 	go func() {
 		ticker := time.NewTicker(30 * time.Minute)
@@ -147,78 +285,39 @@ func main() {
 			if removed > 0 {
 				log.Printf("[Cleanup] 清理了 %d 个过期 Token", removed)
 			}
+			limiter.Cleanup()
+			if removed := filter.PurgeExpired(); removed > 0 {
+				log.Printf("[Cleanup] 清理了 %d 个过期的 IP 黑白名单记录", removed)
+			}
 			// 强制 GC
 			// runtime.GC()
 		}
 	}()
 
+	// 监听配置文件和规则文件变化，自动热加载
+	stopConfigWatch := config.WatchFile(*configPath, 2*time.Second, reload.ReloadConfig)
+	stopRulesWatch := config.WatchFile(engine.StoragePath(), 2*time.Second, reload.ReloadRules)
+	defer stopConfigWatch()
+	defer stopRulesWatch()
+
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Println("收到 SIGHUP，重新加载配置和规则")
+		reload.ReloadAll()
+	}
 
 	log.Println("正在关闭服务...")
 	wrapper.Stop()
+	engine.Close()
+	filter.Close()
+	flowStore.Close()
 	log.Println("服务已关闭")
 }
 
-func loadOrGenerateCA() ([]byte, []byte, error) {
-	certFile := "ca.crt"
-	keyFile := "ca.key"
-
-	if _, err := os.Stat(certFile); err == nil {
-		if _, err := os.Stat(keyFile); err == nil {
-			cert, err := os.ReadFile(certFile)
-			if err != nil {
-				return nil, nil, err
-			}
-			key, err := os.ReadFile(keyFile)
-			if err != nil {
-				return nil, nil, err
-			}
-			return cert, key, nil
-		}
-	}
-
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization:       []string{"SunnyProxy"},
-			OrganizationalUnit: []string{"SunnyProxy CA"},
-			CommonName:         "SunnyProxy Root CA",
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		MaxPathLen:            2,
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-
-	os.WriteFile(certFile, certPEM, 0644)
-	os.WriteFile(keyFile, keyPEM, 0600)
-
-	return certPEM, keyPEM, nil
-}
-
 // filteredListener 是一个带IP过滤的TCP监听器
 type filteredListener struct {
 	net.Listener
@@ -241,3 +340,23 @@ func (l *filteredListener) Accept() (net.Conn, error) {
 		conn.Close()
 	}
 }
+
+// printPasswordHash 从标准输入读取一行密码，输出 bcrypt 哈希
+func printPasswordHash() error {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return fmt.Errorf("密码不能为空")
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Println(hash)
+	return nil
+}
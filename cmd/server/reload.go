@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+
+	"sunnyproxy/internal/auth"
+	"sunnyproxy/internal/capture"
+	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/internal/ipfilter"
+	"sunnyproxy/internal/logger"
+	"sunnyproxy/internal/proxy"
+	"sunnyproxy/internal/ratelimit"
+	"sunnyproxy/internal/rules"
+	"sunnyproxy/internal/web"
+	"sunnyproxy/pkg/config"
+)
+
+// reloader 在配置文件或规则文件变化时重新加载
+// 加载失败时保留上一次的有效状态，已建立的代理连接不受影响
+type reloader struct {
+	mu           sync.Mutex
+	configPath   string
+	current      *config.Config
+	fileServer   config.ServerConfig // 配置文件中的 server 段（未被 PORT 环境变量覆盖）
+	engine       *rules.Engine
+	webServer    *web.Server
+	ipFilter     *ipfilter.Filter
+	domainFilter *domainfilter.DomainFilter
+	wrapper      *proxy.Wrapper
+	proxyAuth    *auth.ProxyAuth
+	limiter      *ratelimit.Limiter
+	flowStore    *capture.Store
+	breakpoints  *proxy.Breakpoints
+	broadcaster  *logger.Broadcaster
+}
+
+// ReloadAll 重新加载配置和规则（SIGHUP 触发）
+func (r *reloader) ReloadAll() {
+	r.ReloadConfig()
+	r.ReloadRules()
+}
+
+// ReloadConfig 重新读取配置文件并应用可热更新的部分
+func (r *reloader) ReloadConfig() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := config.Load(r.configPath)
+	if err != nil {
+		r.reportError(r.configPath, fmt.Errorf("重新加载配置失败，继续使用当前配置: %v", err))
+		return
+	}
+
+	if !reflect.DeepEqual(cfg.Server, r.fileServer) {
+		log.Printf("[Reload] server 段的修改需要重启后生效")
+	}
+	if cfg.Rules.File != r.current.Rules.File {
+		log.Printf("[Reload] rules.file 的修改需要重启后生效")
+	}
+
+	// 监听参数保持不变
+	cfg.Server = r.current.Server
+	cfg.Rules = r.current.Rules
+
+	if err := r.apply(cfg); err != nil {
+		r.reportError(r.configPath, fmt.Errorf("应用配置失败，继续使用当前配置: %v", err))
+		return
+	}
+	r.current = cfg
+	config.Set(cfg)
+	log.Printf("[Reload] 配置已重新加载: %s", r.configPath)
+}
+
+// ReloadRules 重新读取规则文件，内容未变化时忽略
+func (r *reloader) ReloadRules() {
+	changed, err := r.engine.Reload()
+	if err != nil {
+		r.reportError(r.engine.StoragePath(), fmt.Errorf("重新加载规则失败，继续使用当前规则: %v", err))
+		return
+	}
+	if changed {
+		log.Printf("[Reload] 规则已重新加载，共 %d 条", len(r.engine.GetRules()))
+	}
+}
+
+// apply 将配置中可热更新的部分应用到各个组件
+// 先检查配置并为每个组件构建新状态，全部成功后再一起切换，任何一步失败时所有组件保持不变
+func (r *reloader) apply(cfg *config.Config) error {
+	steps := []struct {
+		name    string
+		prepare func() (func(), error)
+	}{
+		{"代理认证", func() (func(), error) { return r.proxyAuth.Prepare(cfg.Security.ProxyAuth) }},
+		{"域名过滤", func() (func(), error) { return r.domainFilter.Prepare(cfg.DomainFilter) }},
+		{"限流", func() (func(), error) { return r.limiter.Prepare(cfg.RateLimit) }},
+		{"IP 过滤", func() (func(), error) { return r.ipFilter.Prepare(cfg.IPFilter) }},
+		{"断点", func() (func(), error) { return r.breakpoints.Prepare(cfg.Breakpoints) }},
+		{"实时日志", func() (func(), error) { return r.broadcaster.PrepareWebSocketConfig(cfg.Logging.WebSocket) }},
+		{"MITM 范围", func() (func(), error) { return r.wrapper.GetMitmScope().Prepare(cfg.Mitm) }},
+		{"上游证书校验", func() (func(), error) { return r.wrapper.PrepareUpstreamTLS(cfg.UpstreamTLS) }},
+		{"Web 认证", func() (func(), error) { return r.webServer.PrepareConfig(cfg) }},
+		// 可能打开新的存储目录，放在最后，前面失败时不会打开
+		{"流量捕获", func() (func(), error) { return r.flowStore.Prepare(cfg.Capture) }},
+	}
+
+	commits := make([]func(), 0, len(steps))
+	for _, step := range steps {
+		commit, err := step.prepare()
+		if err != nil {
+			return fmt.Errorf("%s: %v", step.name, err)
+		}
+		commits = append(commits, commit)
+	}
+
+	for _, commit := range commits {
+		commit()
+	}
+	r.wrapper.SetCertOptions(cfg.Mitm)
+	r.broadcaster.SetConsoleOutput(cfg.Logging.Console)
+	return nil
+}
+
+func (r *reloader) reportError(path string, err error) {
+	log.Printf("[Reload] %v", err)
+	r.broadcaster.LogError(path, err.Error())
+}
@@ -8,11 +8,16 @@ require (
 	github.com/elazarl/goproxy v1.7.2
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
+	github.com/oschwald/geoip2-golang v1.13.0
+	golang.org/x/crypto v0.36.0
 	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
-	github.com/elazarl/goproxy/ext v0.0.0-20260212222702-ffdf0b284e35 // indirect
+	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
+	github.com/stretchr/testify v1.11.1 // indirect
 	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 )
@@ -1,44 +1,131 @@
 package auth
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/elazarl/goproxy"
+	"golang.org/x/crypto/bcrypt"
+	"sunnyproxy/pkg/config"
 )
 
+var (
+	// ErrNoCredentials 请求未携带 Proxy-Authorization，客户端通常会在收到 407 后重试
+	ErrNoCredentials = errors.New("未提供认证信息")
+	// ErrBadCredentials 用户名或密码错误
+	ErrBadCredentials = errors.New("用户名或密码错误")
+)
+
+const (
+	// 认证成功的结果缓存一段时间，避免每个 HTTP 请求都做一次 bcrypt
+	cacheTTL     = 5 * time.Minute
+	cacheMaxSize = 1000
+	// 最近失败记录保留条数
+	maxRecentFailures = 50
+)
+
+// Failure 一次失败的登录
+type Failure struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	Username string    `json:"username"`
+	Target   string    `json:"target"`
+}
+
+// Stats 代理认证统计
+type Stats struct {
+	Enabled        bool      `json:"enabled"`
+	Users          int       `json:"users"`
+	Successes      uint64    `json:"successes"`
+	Failures       uint64    `json:"failures"`
+	Challenges     uint64    `json:"challenges"` // 未携带认证信息而返回 407 的次数
+	RecentFailures []Failure `json:"recent_failures"`
+}
+
+type cacheEntry struct {
+	user    string
+	expires time.Time
+}
+
+// ProxyAuth 代理端口的 Basic 认证，用户和 bcrypt 密码哈希来自配置
 type ProxyAuth struct {
-	enabled  bool
-	username string
-	password string
-	mu       sync.RWMutex
+	mu      sync.RWMutex
+	enabled bool
+	realm   string
+	users   map[string][]byte
+	cache   map[[32]byte]cacheEntry
+
+	successes  atomic.Uint64
+	failures   atomic.Uint64
+	challenges atomic.Uint64
+	recentMu   sync.Mutex
+	recent     []Failure
 }
 
 var (
-	authInstance *ProxyAuth
-	authOnce     sync.Once
+	dummyHash     []byte
+	dummyHashOnce sync.Once
 )
 
-func GetAuth() *ProxyAuth {
-	authOnce.Do(func() {
-		authInstance = &ProxyAuth{
-			enabled: false,
-		}
-	})
-	return authInstance
+// New 根据配置创建代理认证
+func New(cfg config.ProxyAuthConfig) (*ProxyAuth, error) {
+	a := &ProxyAuth{}
+	if err := a.Update(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
-// SetCredentials 设置认证凭据
-func (a *ProxyAuth) SetCredentials(username, password string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.username = username
-	a.password = password
-	a.enabled = true
-	log.Printf("[Auth] 代理认证已启用，用户名: %s", username)
+// Update 重新应用配置，配置无效时保持原有状态不变
+func (a *ProxyAuth) Update(cfg config.ProxyAuthConfig) error {
+	commit, err := a.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (a *ProxyAuth) Prepare(cfg config.ProxyAuthConfig) (func(), error) {
+	users := make(map[string][]byte, len(cfg.Users))
+	for _, u := range cfg.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("proxy_auth: 用户名不能为空")
+		}
+		if _, exists := users[u.Username]; exists {
+			return nil, fmt.Errorf("proxy_auth: 用户 %s 重复", u.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("proxy_auth: 用户 %s 的 password_hash 不是有效的 bcrypt 哈希", u.Username)
+		}
+		users[u.Username] = []byte(u.PasswordHash)
+	}
+	if cfg.Enabled && len(users) == 0 {
+		return nil, fmt.Errorf("proxy_auth: 已启用但没有配置用户")
+	}
+
+	realm := cfg.Realm
+	if realm == "" {
+		realm = "SunnyProxy"
+	}
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.enabled = cfg.Enabled
+		a.realm = realm
+		a.users = users
+		a.cache = make(map[[32]byte]cacheEntry)
+	}, nil
 }
 
 // SetEnabled 启用/禁用认证
@@ -55,11 +142,106 @@ func (a *ProxyAuth) IsEnabled() bool {
 	return a.enabled
 }
 
-// Validate 验证用户名密码
+// Validate 验证用户名密码，用户不存在时也做一次 bcrypt 比较，避免通过耗时判断用户是否存在
 func (a *ProxyAuth) Validate(username, password string) bool {
+	a.mu.RLock()
+	hash, ok := a.users[username]
+	a.mu.RUnlock()
+
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("sunnyproxy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// Authenticate 校验 Proxy-Authorization 头，成功时返回用户名
+// 失败会计入统计；未携带认证信息只计为一次质询，不算登录失败
+func (a *ProxyAuth) Authenticate(authHeader, clientIP, target string) (string, error) {
+	if authHeader == "" {
+		a.challenges.Add(1)
+		return "", ErrNoCredentials
+	}
+
+	key := sha256.Sum256([]byte(authHeader))
+	if user, ok := a.cached(key); ok {
+		a.successes.Add(1)
+		return user, nil
+	}
+
+	username, password, ok := ParseBasicAuth(authHeader)
+	if !ok || !a.Validate(username, password) {
+		a.recordFailure(clientIP, username, target)
+		return username, ErrBadCredentials
+	}
+
+	a.mu.Lock()
+	if len(a.cache) >= cacheMaxSize {
+		a.cache = make(map[[32]byte]cacheEntry)
+	}
+	a.cache[key] = cacheEntry{user: username, expires: time.Now().Add(cacheTTL)}
+	a.mu.Unlock()
+
+	a.successes.Add(1)
+	return username, nil
+}
+
+func (a *ProxyAuth) cached(key [32]byte) (string, bool) {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
-	return username == a.username && password == a.password
+	entry, ok := a.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.user, true
+}
+
+func (a *ProxyAuth) recordFailure(clientIP, username, target string) {
+	a.failures.Add(1)
+
+	a.recentMu.Lock()
+	defer a.recentMu.Unlock()
+	a.recent = append(a.recent, Failure{
+		Time:     time.Now(),
+		ClientIP: clientIP,
+		Username: username,
+		Target:   target,
+	})
+	if len(a.recent) > maxRecentFailures {
+		a.recent = a.recent[len(a.recent)-maxRecentFailures:]
+	}
+}
+
+// GetStats 获取认证统计
+func (a *ProxyAuth) GetStats() Stats {
+	a.mu.RLock()
+	enabled, users := a.enabled, len(a.users)
+	a.mu.RUnlock()
+
+	a.recentMu.Lock()
+	recent := append([]Failure(nil), a.recent...)
+	a.recentMu.Unlock()
+
+	return Stats{
+		Enabled:        enabled,
+		Users:          users,
+		Successes:      a.successes.Load(),
+		Failures:       a.failures.Load(),
+		Challenges:     a.challenges.Load(),
+		RecentFailures: recent,
+	}
+}
+
+// HashPassword 生成用于配置文件的 bcrypt 密码哈希
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
 }
 
 // ParseBasicAuth 解析 Proxy-Authorization header
@@ -88,59 +270,24 @@ func ParseBasicAuth(authHeader string) (username, password string, ok bool) {
 }
 
 // RequireAuth 返回 407 要求认证的响应
-func RequireAuth() *http.Response {
+func (a *ProxyAuth) RequireAuth(req *http.Request) *http.Response {
+	a.mu.RLock()
+	realm := a.realm
+	a.mu.RUnlock()
+
+	body := []byte("407 Proxy Authentication Required")
 	resp := &http.Response{
-		StatusCode: 407,
-		Status:     "407 Proxy Authentication Required",
-		Proto:      "HTTP/1.1",
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     make(http.Header),
-	}
-	resp.Header.Set("Proxy-Authenticate", `Basic realm="SunnyProxy"`)
-	resp.Header.Set("Content-Length", "0")
+		StatusCode:    http.StatusProxyAuthRequired,
+		Status:        "407 Proxy Authentication Required",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	resp.Header.Set("Content-Type", "text/plain")
 	return resp
 }
-
-// SetupAuth 在代理上设置认证中间件
-func (a *ProxyAuth) SetupAuth(proxy *goproxy.ProxyHttpServer) {
-	// 处理 CONNECT 请求的认证
-	originalHandler := proxy.OnRequest()
-
-	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		if !a.IsEnabled() {
-			return req, nil
-		}
-
-		authHeader := req.Header.Get("Proxy-Authorization")
-		username, password, ok := ParseBasicAuth(authHeader)
-
-		if !ok || !a.Validate(username, password) {
-			log.Printf("[Auth] 认证失败: %s (用户: %s)", req.RemoteAddr, username)
-			return req, RequireAuth()
-		}
-
-		// 认证成功，移除认证头（不转发给目标服务器）
-		req.Header.Del("Proxy-Authorization")
-		return req, nil
-	})
-
-	// 处理 CONNECT 请求（HTTPS）
-	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if !a.IsEnabled() {
-			return goproxy.OkConnect, host
-		}
-
-		authHeader := ctx.Req.Header.Get("Proxy-Authorization")
-		username, password, ok := ParseBasicAuth(authHeader)
-
-		if !ok || !a.Validate(username, password) {
-			log.Printf("[Auth] CONNECT认证失败: %s -> %s", ctx.Req.RemoteAddr, host)
-			return goproxy.RejectConnect, host
-		}
-
-		return goproxy.OkConnect, host
-	})
-
-	_ = originalHandler // 避免编译警告
-}
@@ -0,0 +1,141 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// CA 密钥类型
+const (
+	KeyTypeRSA   = "rsa"
+	KeyTypeECDSA = "ecdsa"
+)
+
+// Authority 是一个 CA 证书及其私钥
+type Authority struct {
+	CertPEM []byte
+	KeyPEM  []byte
+	Cert    *x509.Certificate
+}
+
+// Info CA 证书摘要，用于 API 展示
+type Info struct {
+	Subject           string    `json:"subject"`
+	SerialNumber      string    `json:"serial_number"`
+	KeyType           string    `json:"key_type"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+}
+
+// Parse 解析 PEM 格式的 CA 证书和私钥，并校验二者匹配且证书可用于签发
+func Parse(certPEM, keyPEM []byte) (*Authority, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("证书与私钥不匹配: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("证书不是 CA 证书（缺少 BasicConstraints CA:TRUE）")
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("CA 证书已于 %s 过期", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	// 只保留第一个证书，避免把证书链一起下发给手机
+	return &Authority{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		KeyPEM:  keyPEM,
+		Cert:    cert,
+	}, nil
+}
+
+// Generate 生成新的自签名 CA
+func Generate(keyType string, validity time.Duration) (*Authority, error) {
+	var key crypto.Signer
+	var keyPEM []byte
+	switch keyType {
+	case KeyTypeECDSA:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case KeyTypeRSA, "":
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	default:
+		return nil, fmt.Errorf("不支持的密钥类型: %s", keyType)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization:       []string{"SunnyProxy"},
+			OrganizationalUnit: []string{"SunnyProxy CA"},
+			CommonName:         fmt.Sprintf("SunnyProxy Root CA %s", now.Format("2006-01-02")),
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            2,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return Parse(certPEM, keyPEM)
+}
+
+// Info 返回证书摘要
+func (a *Authority) Info() Info {
+	sum := sha256.Sum256(a.Cert.Raw)
+	keyType := KeyTypeRSA
+	if _, ok := a.Cert.PublicKey.(*ecdsa.PublicKey); ok {
+		keyType = KeyTypeECDSA
+	}
+	return Info{
+		Subject:           a.Cert.Subject.String(),
+		SerialNumber:      a.Cert.SerialNumber.Text(16),
+		KeyType:           keyType,
+		NotBefore:         a.Cert.NotBefore,
+		NotAfter:          a.Cert.NotAfter,
+		FingerprintSHA256: hex.EncodeToString(sum[:]),
+	}
+}
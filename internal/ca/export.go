@@ -0,0 +1,108 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"text/template"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// 证书下载格式
+const (
+	FormatPEM          = "pem"
+	FormatDER          = "der"
+	FormatPKCS12       = "p12"
+	FormatMobileConfig = "mobileconfig"
+)
+
+// DER 返回 DER 编码的 CA 证书
+func (a *Authority) DER() []byte {
+	return a.Cert.Raw
+}
+
+// PKCS12 返回仅包含 CA 证书（不含私钥）的 PKCS#12 信任库
+// 使用旧版加密算法，兼容 Android 和较老的 Windows
+func (a *Authority) PKCS12(password string) ([]byte, error) {
+	return pkcs12.Legacy.EncodeTrustStore([]*x509.Certificate{a.Cert}, password)
+}
+
+var mobileConfigTemplate = template.Must(template.New("mobileconfig").Funcs(template.FuncMap{
+	"xml": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>SunnyProxy.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDescription</key>
+			<string>SunnyProxy 根证书</string>
+			<key>PayloadDisplayName</key>
+			<string>{{.Name | xml}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.sunnyproxy.ca.{{.ID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDescription</key>
+	<string>安装后需在 设置 → 通用 → 关于本机 → 证书信任设置 中启用完全信任</string>
+	<key>PayloadDisplayName</key>
+	<string>SunnyProxy CA</string>
+	<key>PayloadIdentifier</key>
+	<string>com.sunnyproxy.profile.{{.ID}}</string>
+	<key>PayloadOrganization</key>
+	<string>SunnyProxy</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// MobileConfig 返回 iOS 描述文件，Safari 打开后可一键安装 CA 证书
+// UUID 由证书指纹派生，重复安装同一证书会覆盖旧的描述文件
+func (a *Authority) MobileConfig() ([]byte, error) {
+	sum := sha256.Sum256(a.Cert.Raw)
+	var buf bytes.Buffer
+	err := mobileConfigTemplate.Execute(&buf, map[string]string{
+		"Cert":        base64.StdEncoding.EncodeToString(a.Cert.Raw),
+		"Name":        a.Cert.Subject.CommonName,
+		"ID":          hex.EncodeToString(sum[:8]),
+		"CertUUID":    uuidFromBytes(sum[:16]),
+		"ProfileUUID": uuidFromBytes(sum[16:32]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func uuidFromBytes(b []byte) string {
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
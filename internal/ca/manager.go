@@ -0,0 +1,321 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+	"sunnyproxy/pkg/config"
+)
+
+// ChangeFunc 在生效的 CA 变化时回调（导入、轮换到期）
+type ChangeFunc func(certPEM, keyPEM []byte) error
+
+// pendingState 是等待生效的新 CA，持久化后重启不会丢失
+type pendingState struct {
+	CertPEM    string    `json:"cert_pem"`
+	KeyPEM     string    `json:"key_pem"`
+	ActivateAt time.Time `json:"activate_at"`
+}
+
+// Manager 管理 MITM 使用的 CA：加载、生成、导入和轮换
+//
+// 轮换时新 CA 会先进入等待期，期间 MITM 仍使用旧 CA 签发证书，
+// 新 CA 可通过 /ssl?next=1 提前下载安装，等待期结束后自动切换
+type Manager struct {
+	mu         sync.RWMutex
+	cfg        config.CAConfig
+	current    *Authority
+	pending    *Authority
+	activateAt time.Time
+	onChange   ChangeFunc
+}
+
+func NewManager(cfg config.CAConfig) *Manager {
+	return &Manager{cfg: cfg}
+}
+
+// SetOnChange 设置 CA 变化时的回调
+func (m *Manager) SetOnChange(fn ChangeFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = fn
+}
+
+// LoadOrGenerate 从磁盘加载 CA，不存在时生成新的 CA 并写入磁盘
+func (m *Manager) LoadOrGenerate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	certPEM, certErr := os.ReadFile(m.cfg.CertFile)
+	keyPEM, keyErr := os.ReadFile(m.cfg.KeyFile)
+
+	switch {
+	case certErr == nil && keyErr == nil:
+		a, err := Parse(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("加载 %s 失败: %v", m.cfg.CertFile, err)
+		}
+		m.current = a
+		log.Printf("[CA] 已加载 CA 证书: %s", m.cfg.CertFile)
+
+	case os.IsNotExist(certErr) && os.IsNotExist(keyErr):
+		a, err := Generate(m.cfg.KeyType, m.validity())
+		if err != nil {
+			return fmt.Errorf("生成 CA 失败: %v", err)
+		}
+		if err := m.writeFiles(a); err != nil {
+			return err
+		}
+		m.current = a
+		log.Printf("[CA] 已生成新的 CA 证书: %s", m.cfg.CertFile)
+
+	case certErr != nil:
+		return fmt.Errorf("读取 %s 失败: %v", m.cfg.CertFile, certErr)
+	default:
+		return fmt.Errorf("读取 %s 失败: %v", m.cfg.KeyFile, keyErr)
+	}
+
+	if err := m.loadPending(); err != nil {
+		log.Printf("[CA] 读取待生效的 CA 失败，已忽略: %v", err)
+	}
+	return nil
+}
+
+// Current 返回当前生效的 CA
+func (m *Manager) Current() *Authority {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current
+}
+
+// Pending 返回等待生效的 CA 及生效时间，没有时返回 nil
+func (m *Manager) Pending() (*Authority, time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pending, m.activateAt
+}
+
+// Rotate 生成新的 CA，grace 后生效；grace 为负数时使用配置中的默认等待期
+func (m *Manager) Rotate(grace time.Duration) error {
+	if grace < 0 {
+		grace = m.cfg.GracePeriod
+	}
+
+	a, err := Generate(m.cfg.KeyType, m.validity())
+	if err != nil {
+		return fmt.Errorf("生成 CA 失败: %v", err)
+	}
+
+	if grace == 0 {
+		return m.activate(a)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	activateAt := time.Now().Add(grace)
+	if err := m.savePending(a, activateAt); err != nil {
+		return err
+	}
+	m.pending = a
+	m.activateAt = activateAt
+	log.Printf("[CA] 已生成新的 CA，将于 %s 生效", activateAt.Format(time.RFC3339))
+	return nil
+}
+
+// CancelPending 取消等待生效的 CA
+func (m *Manager) CancelPending() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = nil
+	m.activateAt = time.Time{}
+	if err := os.Remove(m.pendingPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CheckPending 等待期结束时切换到新的 CA，返回是否发生切换
+func (m *Manager) CheckPending() (bool, error) {
+	m.mu.RLock()
+	pending, activateAt := m.pending, m.activateAt
+	m.mu.RUnlock()
+
+	if pending == nil || time.Now().Before(activateAt) {
+		return false, nil
+	}
+	if err := m.activate(pending); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Import 导入 PEM 格式的 CA 证书和私钥，立即生效
+func (m *Manager) Import(certPEM, keyPEM []byte) error {
+	a, err := Parse(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	return m.activate(a)
+}
+
+// ImportPKCS12 导入 PKCS#12 格式的 CA，立即生效
+func (m *Manager) ImportPKCS12(data []byte, password string) error {
+	key, cert, _, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return fmt.Errorf("解析 PKCS#12 失败: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("不支持的私钥类型: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return m.Import(certPEM, keyPEM)
+}
+
+// activate 切换到新的 CA 并写入磁盘，旧 CA 备份为 .old 文件
+// 先通知代理切换，代理切换失败时磁盘和管理器保持旧 CA；写入磁盘失败时代理切回旧 CA
+func (m *Manager) activate(a *Authority) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.onChange != nil {
+		if err := m.onChange(a.CertPEM, a.KeyPEM); err != nil {
+			return fmt.Errorf("切换 CA 失败: %v", err)
+		}
+	}
+	if err := m.saveActive(a); err != nil {
+		if m.onChange != nil && m.current != nil {
+			if rbErr := m.onChange(m.current.CertPEM, m.current.KeyPEM); rbErr != nil {
+				log.Printf("[CA] 恢复旧的 CA 失败: %v", rbErr)
+			}
+		}
+		return err
+	}
+
+	m.current = a
+	if m.pending == a {
+		m.pending = nil
+		m.activateAt = time.Time{}
+		os.Remove(m.pendingPath())
+	}
+	log.Printf("[CA] 已切换到新的 CA: %s", a.Cert.Subject.CommonName)
+	return nil
+}
+
+// saveActive 备份旧 CA 后写入新的 CA 文件
+func (m *Manager) saveActive(a *Authority) error {
+	if m.current != nil {
+		if err := backupFile(m.cfg.CertFile); err != nil {
+			return err
+		}
+		if err := backupFile(m.cfg.KeyFile); err != nil {
+			return err
+		}
+	}
+	if err := m.writeFiles(a); err != nil {
+		if m.current != nil {
+			// 证书和私钥必须成对，写入一半时恢复旧文件
+			m.writeFiles(m.current)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) validity() time.Duration {
+	days := m.cfg.ValidityDays
+	if days <= 0 {
+		days = 3650
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (m *Manager) pendingPath() string {
+	return m.cfg.CertFile + ".pending.json"
+}
+
+func (m *Manager) loadPending() error {
+	data, err := os.ReadFile(m.pendingPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var state pendingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	a, err := Parse([]byte(state.CertPEM), []byte(state.KeyPEM))
+	if err != nil {
+		return err
+	}
+	m.pending = a
+	m.activateAt = state.ActivateAt
+	log.Printf("[CA] 新的 CA 将于 %s 生效", state.ActivateAt.Format(time.RFC3339))
+	return nil
+}
+
+func (m *Manager) savePending(a *Authority, activateAt time.Time) error {
+	data, err := json.MarshalIndent(pendingState{
+		CertPEM:    string(a.CertPEM),
+		KeyPEM:     string(a.KeyPEM),
+		ActivateAt: activateAt,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(m.pendingPath()); err != nil {
+		return err
+	}
+	return os.WriteFile(m.pendingPath(), data, 0600)
+}
+
+func (m *Manager) writeFiles(a *Authority) error {
+	if err := ensureDir(m.cfg.CertFile); err != nil {
+		return err
+	}
+	if err := ensureDir(m.cfg.KeyFile); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.cfg.CertFile, a.CertPEM, 0644); err != nil {
+		return fmt.Errorf("写入 %s 失败: %v", m.cfg.CertFile, err)
+	}
+	if err := os.WriteFile(m.cfg.KeyFile, a.KeyPEM, 0600); err != nil {
+		return fmt.Errorf("写入 %s 失败: %v", m.cfg.KeyFile, err)
+	}
+	return nil
+}
+
+func ensureDir(path string) error {
+	dir := filepath.Dir(path)
+	if dir != "" && dir != "." {
+		return os.MkdirAll(dir, 0755)
+	}
+	return nil
+}
+
+func backupFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.WriteFile(path+".old", data, 0600); err != nil {
+		return fmt.Errorf("备份 %s 失败: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,515 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// 默认忽略的易变字段，用于头部、查询参数和 JSON 键名，比较时忽略大小写、"-" 和 "_"
+var volatileFields = []string{
+	"Date", "Age", "Expires",
+	"X-Request-Id", "Request-Id", "Trace-Id", "X-Trace-Id", "Span-Id", "X-Span-Id",
+	"Traceparent", "Tracestate", "B3", "X-B3-TraceId", "X-B3-SpanId", "X-B3-ParentSpanId", "X-B3-Sampled",
+	"X-Amzn-Trace-Id", "Correlation-Id", "X-Correlation-Id", "Cf-Ray",
+	"Timestamp", "Nonce",
+}
+
+// 文本按行比较时最多计算的变化行数，超出时整段视为替换
+// 计算量为 O((N+M)·D)，回溯需要的内存为 O(D²)
+const maxDiffEdits = 500
+
+// 字段的变化类型
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// FlowDiff 两条流量的差异，a 为旧流量，b 为新流量
+type FlowDiff struct {
+	A         Summary       `json:"a"`
+	B         Summary       `json:"b"`
+	Identical bool          `json:"identical"` // 忽略易变字段后没有差异
+	Method    *ValueChange  `json:"method,omitempty"`
+	URL       *ValueChange  `json:"url,omitempty"` // 不含查询参数
+	Query     []FieldChange `json:"query,omitempty"`
+	Status    *ValueChange  `json:"status,omitempty"`
+	Request   MessageDiff   `json:"request"`
+	Response  MessageDiff   `json:"response"`
+	Ignored   []string      `json:"ignored"` // 本次比较忽略的字段
+}
+
+// ValueChange 单个值的变化
+type ValueChange struct {
+	A interface{} `json:"a"`
+	B interface{} `json:"b"`
+}
+
+// FieldChange 头部或查询参数的变化
+type FieldChange struct {
+	Name string   `json:"name"`
+	Op   string   `json:"op"`
+	A    []string `json:"a,omitempty"`
+	B    []string `json:"b,omitempty"`
+}
+
+// MessageDiff 请求或响应的差异
+type MessageDiff struct {
+	Headers []FieldChange `json:"headers,omitempty"`
+	Body    *BodyDiff     `json:"body,omitempty"` // 消息体相同时为空
+}
+
+// BodyDiff 消息体的差异，kind 为 json、text 或 binary
+type BodyDiff struct {
+	Kind      string       `json:"kind"`
+	Changes   []JSONChange `json:"changes,omitempty"` // kind 为 json
+	Lines     []LineChange `json:"lines,omitempty"`   // kind 为 text
+	SizeA     int64        `json:"size_a"`
+	SizeB     int64        `json:"size_b"`
+	SHA256A   string       `json:"sha256_a,omitempty"` // kind 为 binary
+	SHA256B   string       `json:"sha256_b,omitempty"`
+	Truncated bool         `json:"truncated,omitempty"` // 任一消息体被截断，只比较了保存的部分
+}
+
+// JSONChange JSON 中一个字段的变化，path 形如 $.data.items[0].price
+type JSONChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	A    interface{} `json:"a,omitempty"`
+	B    interface{} `json:"b,omitempty"`
+}
+
+// LineChange 文本中一行的变化，op 为 "-"（只在 a 中）或 "+"（只在 b 中），行号从 1 开始
+type LineChange struct {
+	Op   string `json:"op"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+// differ 保存一次比较要忽略的字段
+type differ struct {
+	ignore map[string]bool
+}
+
+func normalizeField(name string) string {
+	name = strings.ToLower(name)
+	name = strings.ReplaceAll(name, "-", "")
+	return strings.ReplaceAll(name, "_", "")
+}
+
+func (d *differ) ignored(name string) bool {
+	return d.ignore[normalizeField(name)]
+}
+
+// Diff 比较两条流量，extra 为额外忽略的字段名
+func Diff(a, b *Flow, extra []string) *FlowDiff {
+	d := &differ{ignore: make(map[string]bool)}
+	ignored := append(append([]string(nil), volatileFields...), extra...)
+	for _, name := range ignored {
+		d.ignore[normalizeField(name)] = true
+	}
+
+	diff := &FlowDiff{A: a.Summary(), B: b.Summary(), Ignored: ignored}
+	if a.Request.Method != b.Request.Method {
+		diff.Method = &ValueChange{A: a.Request.Method, B: b.Request.Method}
+	}
+	baseA, queryA := splitURL(a.Request.URL)
+	baseB, queryB := splitURL(b.Request.URL)
+	if baseA != baseB {
+		diff.URL = &ValueChange{A: baseA, B: baseB}
+	}
+	diff.Query = d.fields(queryA, queryB, false)
+
+	diff.Request = MessageDiff{
+		Headers: d.fields(a.Request.Headers, b.Request.Headers, true),
+		Body:    d.body(&a.Request.Body, &b.Request.Body, a.Request.Headers, b.Request.Headers),
+	}
+
+	var respA, respB Response
+	if a.Response != nil {
+		respA = *a.Response
+	}
+	if b.Response != nil {
+		respB = *b.Response
+	}
+	if respA.StatusCode != respB.StatusCode {
+		diff.Status = &ValueChange{A: respA.StatusCode, B: respB.StatusCode}
+	}
+	diff.Response = MessageDiff{
+		Headers: d.fields(respA.Headers, respB.Headers, true),
+		Body:    d.body(&respA.Body, &respB.Body, respA.Headers, respB.Headers),
+	}
+
+	diff.Identical = diff.Method == nil && diff.URL == nil && len(diff.Query) == 0 && diff.Status == nil &&
+		len(diff.Request.Headers) == 0 && diff.Request.Body == nil &&
+		len(diff.Response.Headers) == 0 && diff.Response.Body == nil
+	return diff
+}
+
+// splitURL 拆分出不含查询参数的 URL 和查询参数
+func splitURL(raw string) (string, map[string][]string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw, nil
+	}
+	query := u.Query()
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return u.String(), query
+}
+
+// fields 比较头部或查询参数，headers 为 true 时名称按头部规范化
+func (d *differ) fields(a, b map[string][]string, headers bool) []FieldChange {
+	key := func(name string) string {
+		if headers {
+			return http.CanonicalHeaderKey(name)
+		}
+		return name
+	}
+	va := make(map[string][]string, len(a))
+	for name, v := range a {
+		va[key(name)] = append(va[key(name)], v...)
+	}
+	vb := make(map[string][]string, len(b))
+	for name, v := range b {
+		vb[key(name)] = append(vb[key(name)], v...)
+	}
+
+	names := make(map[string]bool)
+	for name := range va {
+		names[name] = true
+	}
+	for name := range vb {
+		names[name] = true
+	}
+
+	var changes []FieldChange
+	for name := range names {
+		if d.ignored(name) {
+			continue
+		}
+		x, inA := va[name]
+		y, inB := vb[name]
+		switch {
+		case !inA:
+			changes = append(changes, FieldChange{Name: name, Op: DiffAdded, B: y})
+		case !inB:
+			changes = append(changes, FieldChange{Name: name, Op: DiffRemoved, A: x})
+		case !reflect.DeepEqual(x, y):
+			changes = append(changes, FieldChange{Name: name, Op: DiffChanged, A: x, B: y})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// body 比较消息体，相同时返回 nil
+// 两边都能解析为 JSON 时按字段比较，都是文本时按行比较，否则只比较摘要
+func (d *differ) body(a, b *Body, headersA, headersB http.Header) *BodyDiff {
+	dataA, textA := decodeBody(a, headersA)
+	dataB, textB := decodeBody(b, headersB)
+	if bytes.Equal(dataA, dataB) {
+		return nil
+	}
+	diff := &BodyDiff{SizeA: a.Size, SizeB: b.Size, Truncated: a.Truncated || b.Truncated}
+
+	if isJSONBody(dataA, headersA) && isJSONBody(dataB, headersB) {
+		va, errA := decodeJSON(dataA)
+		vb, errB := decodeJSON(dataB)
+		if errA == nil && errB == nil {
+			diff.Kind = "json"
+			diff.Changes = d.json("$", va, vb, nil)
+			if len(diff.Changes) == 0 {
+				// 只有格式或易变字段不同
+				return nil
+			}
+			return diff
+		}
+	}
+	if textA && textB {
+		diff.Kind = "text"
+		diff.Lines = diffLines(splitLines(dataA), splitLines(dataB))
+		return diff
+	}
+
+	diff.Kind = "binary"
+	sumA := sha256.Sum256(dataA)
+	sumB := sha256.Sum256(dataB)
+	diff.SHA256A = hex.EncodeToString(sumA[:])
+	diff.SHA256B = hex.EncodeToString(sumB[:])
+	return diff
+}
+
+// decodeBody 返回消息体的内容，完整保存的 gzip 和 deflate 内容会先解压
+// 第二个返回值表示内容是否为文本
+func decodeBody(b *Body, headers http.Header) ([]byte, bool) {
+	data, err := b.Bytes()
+	if err != nil {
+		return []byte(b.Body), true
+	}
+	text := b.Encoding == ""
+	if b.Truncated || len(data) == 0 {
+		return data, text
+	}
+
+	var r io.ReadCloser
+	switch strings.ToLower(headers.Get("Content-Encoding")) {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, text
+	}
+	if err != nil {
+		return data, text
+	}
+	defer r.Close()
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return data, text
+	}
+	return plain, utf8.Valid(plain)
+}
+
+func isJSONBody(data []byte, headers http.Header) bool {
+	if strings.Contains(strings.ToLower(headers.Get("Content-Type")), "json") {
+		return true
+	}
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("JSON 之后还有多余的内容")
+	}
+	return v, nil
+}
+
+// json 递归比较两个 JSON 值，对象按键名、数组按下标比较
+func (d *differ) json(path string, a, b interface{}, changes []JSONChange) []JSONChange {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(x)+len(y))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		for k := range y {
+			if _, ok := x[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if d.ignored(k) {
+				continue
+			}
+			p := jsonPath(path, k)
+			va, inA := x[k]
+			vb, inB := y[k]
+			switch {
+			case !inA:
+				changes = append(changes, JSONChange{Path: p, Op: DiffAdded, B: vb})
+			case !inB:
+				changes = append(changes, JSONChange{Path: p, Op: DiffRemoved, A: va})
+			default:
+				changes = d.json(p, va, vb, changes)
+			}
+		}
+		return changes
+
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(x) || i < len(y); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(x):
+				changes = append(changes, JSONChange{Path: p, Op: DiffAdded, B: y[i]})
+			case i >= len(y):
+				changes = append(changes, JSONChange{Path: p, Op: DiffRemoved, A: x[i]})
+			default:
+				changes = d.json(p, x[i], y[i], changes)
+			}
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		changes = append(changes, JSONChange{Path: path, Op: DiffChanged, A: a, B: b})
+	}
+	return changes
+}
+
+// jsonPath 拼接 JSON 路径，不是标识符的键名用 ["..."] 表示
+func jsonPath(parent, key string) string {
+	simple := key != ""
+	for _, c := range key {
+		if !(c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			simple = false
+			break
+		}
+	}
+	if simple {
+		return parent + "." + key
+	}
+	quoted, _ := json.Marshal(key)
+	return parent + "[" + string(quoted) + "]"
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	s := strings.ReplaceAll(string(data), "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines 按 Myers 差分算法比较两段文本，只返回有变化的行
+func diffLines(a, b []string) []LineChange {
+	// 去掉相同的开头和结尾，减少计算量
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	x := a[prefix : len(a)-suffix]
+	y := b[prefix : len(b)-suffix]
+
+	var changes []LineChange
+	removed := func(i int) {
+		changes = append(changes, LineChange{Op: "-", Line: prefix + i + 1, Text: x[i]})
+	}
+	added := func(j int) {
+		changes = append(changes, LineChange{Op: "+", Line: prefix + j + 1, Text: y[j]})
+	}
+
+	edits, ok := shortestEdit(x, y, maxDiffEdits)
+	if !ok {
+		for i := range x {
+			removed(i)
+		}
+		for j := range y {
+			added(j)
+		}
+		return changes
+	}
+	for _, e := range edits {
+		if e.remove {
+			removed(e.index)
+		} else {
+			added(e.index)
+		}
+	}
+	return changes
+}
+
+// lineEdit 删除 x 中的一行或插入 y 中的一行
+type lineEdit struct {
+	remove bool
+	index  int // remove 时为 x 的下标，否则为 y 的下标
+}
+
+// shortestEdit 计算把 x 变为 y 的最短编辑序列（Myers O(ND) 算法），按位置排序
+// 编辑数超过 maxEdits 时返回 false
+func shortestEdit(x, y []string, maxEdits int) ([]lineEdit, bool) {
+	n, m := len(x), len(y)
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+
+	// v[offset+k] 为对角线 k（k = i - j）上走得最远的 i
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] 保存第 d 步结束后对角线 -d..d 上的 v，用于回溯
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var i int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				i = v[offset+k+1] // 从对角线 k+1 向下，插入 y 的一行
+			} else {
+				i = v[offset+k-1] + 1 // 从对角线 k-1 向右，删除 x 的一行
+			}
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			v[offset+k] = i
+			if i >= n && j >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				return backtrackEdits(trace, n, m), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	return nil, false
+}
+
+// backtrackEdits 从终点沿 trace 回溯出编辑序列
+func backtrackEdits(trace [][]int, n, m int) []lineEdit {
+	edits := make([]lineEdit, 0, len(trace)-1)
+	i, j := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1] // 下标为 k+d-1
+		at := func(k int) int { return prev[k+d-1] }
+
+		k := i - j
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevI := at(prevK)
+		prevJ := prevI - prevK
+		// 跳过相同的行，回到这一步编辑之后的位置
+		for i > prevI && j > prevJ {
+			i--
+			j--
+		}
+		if prevK == k+1 {
+			edits = append(edits, lineEdit{index: prevJ})
+		} else {
+			edits = append(edits, lineEdit{remove: true, index: prevI})
+		}
+		i, j = prevI, prevJ
+	}
+	for l, r := 0, len(edits)-1; l < r; l, r = l+1, r-1 {
+		edits[l], edits[r] = edits[r], edits[l]
+	}
+	return edits
+}
@@ -0,0 +1,319 @@
+package capture
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	lines := func(s string) []string { return splitLines([]byte(s)) }
+
+	tests := []struct {
+		name string
+		a, b string
+		want []LineChange
+	}{
+		{name: "identical", a: "a\nb\nc", b: "a\nb\nc"},
+		{name: "both empty"},
+		{name: "crlf ignored", a: "a\r\nb\r\n", b: "a\nb"},
+		{
+			name: "from empty",
+			b:    "a\nb",
+			want: []LineChange{{"+", 1, "a"}, {"+", 2, "b"}},
+		},
+		{
+			name: "to empty",
+			a:    "a\nb",
+			want: []LineChange{{"-", 1, "a"}, {"-", 2, "b"}},
+		},
+		{
+			name: "changed line",
+			a:    "a\nb\nc",
+			b:    "a\nx\nc",
+			want: []LineChange{{"-", 2, "b"}, {"+", 2, "x"}},
+		},
+		{
+			name: "inserted line",
+			a:    "a\nc",
+			b:    "a\nb\nc",
+			want: []LineChange{{"+", 2, "b"}},
+		},
+		{
+			name: "removed line",
+			a:    "a\nb\nc",
+			b:    "a\nc",
+			want: []LineChange{{"-", 2, "b"}},
+		},
+		{
+			// "-" 的行号对应 a，"+" 的行号对应 b
+			name: "line numbers per side",
+			a:    "x\ny\na\nb\nc",
+			b:    "a\nb\nz\nc",
+			want: []LineChange{{"-", 1, "x"}, {"-", 2, "y"}, {"+", 3, "z"}},
+		},
+		{
+			name: "repeated lines",
+			a:    "a\nb\na\nb",
+			b:    "b\na\nb\na",
+			want: []LineChange{{"-", 1, "a"}, {"+", 4, "a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffLines(lines(tt.a), lines(tt.b))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffLines = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDiffLinesMinimal 随机比较，结果应能把 a 变成 b，且变化行数与最长公共子序列一致
+func TestDiffLinesMinimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func() []string {
+		s := make([]string, r.Intn(15))
+		for i := range s {
+			s[i] = string(rune('a' + r.Intn(4)))
+		}
+		return s
+	}
+
+	for n := 0; n < 2000; n++ {
+		a, b := random(), random()
+		changes := diffLines(a, b)
+
+		removed := make(map[int]bool)
+		added := make(map[int]bool)
+		for _, c := range changes {
+			side := a
+			if c.Op == "+" {
+				side = b
+			}
+			if c.Line < 1 || c.Line > len(side) || side[c.Line-1] != c.Text {
+				t.Fatalf("a=%v b=%v: invalid change %v", a, b, c)
+			}
+			if c.Op == "-" {
+				removed[c.Line-1] = true
+			} else {
+				added[c.Line-1] = true
+			}
+		}
+		var keptA, keptB []string
+		for i, s := range a {
+			if !removed[i] {
+				keptA = append(keptA, s)
+			}
+		}
+		for i, s := range b {
+			if !added[i] {
+				keptB = append(keptB, s)
+			}
+		}
+		if !reflect.DeepEqual(keptA, keptB) {
+			t.Fatalf("a=%v b=%v: unchanged lines differ: %v vs %v", a, b, keptA, keptB)
+		}
+		if want := len(a) + len(b) - 2*lcsLength(a, b); len(changes) != want {
+			t.Fatalf("a=%v b=%v: %d changes, want %d", a, b, len(changes), want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestDiffLinesEditLimit(t *testing.T) {
+	numbered := func(prefix string, n int) []string {
+		s := make([]string, n)
+		for i := range s {
+			s[i] = fmt.Sprintf("%s%d", prefix, i)
+		}
+		return s
+	}
+
+	// 大文件中的少量修改仍按行比较
+	a := numbered("line", 100000)
+	b := append([]string(nil), a...)
+	b[500] = "changed"
+	b = append(b[:70000], b[70001:]...)
+	want := []LineChange{{"-", 501, "line500"}, {"+", 501, "changed"}, {"-", 70001, "line70000"}}
+	if got := diffLines(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffLines = %v, want %v", got, want)
+	}
+
+	// 变化超过上限时整段视为替换
+	a = numbered("a", maxDiffEdits)
+	b = numbered("b", maxDiffEdits)
+	got := diffLines(a, b)
+	if len(got) != 2*maxDiffEdits {
+		t.Fatalf("got %d changes, want %d", len(got), 2*maxDiffEdits)
+	}
+	for i, c := range got {
+		if i < maxDiffEdits && (c.Op != "-" || c.Line != i+1) || i >= maxDiffEdits && (c.Op != "+" || c.Line != i-maxDiffEdits+1) {
+			t.Fatalf("change %d = %v, want all removed then all added", i, c)
+		}
+	}
+}
+
+func TestDiffJSONBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   string
+		ignore []string
+		want   []JSONChange // nil 表示消息体没有差异
+	}{
+		{name: "formatting only", a: `{"a":1,"b":[1,2]}`, b: "{\n  \"b\": [1, 2],\n  \"a\": 1\n}"},
+		{
+			name: "changed value",
+			a:    `{"data":{"price":1}}`,
+			b:    `{"data":{"price":2}}`,
+			want: []JSONChange{{Path: "$.data.price", Op: DiffChanged, A: "1", B: "2"}},
+		},
+		{
+			name: "added and removed keys",
+			a:    `{"a":1,"b":true}`,
+			b:    `{"b":true,"c":null}`,
+			want: []JSONChange{
+				{Path: "$.a", Op: DiffRemoved, A: "1"},
+				{Path: "$.c", Op: DiffAdded},
+			},
+		},
+		{
+			name: "array elements",
+			a:    `{"items":[1,2]}`,
+			b:    `{"items":[1,3,4]}`,
+			want: []JSONChange{
+				{Path: "$.items[1]", Op: DiffChanged, A: "2", B: "3"},
+				{Path: "$.items[2]", Op: DiffAdded, B: "4"},
+			},
+		},
+		{
+			name: "type change",
+			a:    `{"v":{"x":1}}`,
+			b:    `{"v":[1]}`,
+			want: []JSONChange{{Path: "$.v", Op: DiffChanged, A: map[string]interface{}{"x": "1"}, B: []interface{}{"1"}}},
+		},
+		{
+			name: "quoted key",
+			a:    `{"user-id":"1"}`,
+			b:    `{"user-id":"2"}`,
+			want: []JSONChange{{Path: `$["user-id"]`, Op: DiffChanged, A: "1", B: "2"}},
+		},
+		{
+			name: "large numbers kept exact",
+			a:    `{"id":12345678901234567890}`,
+			b:    `{"id":12345678901234567891}`,
+			want: []JSONChange{{Path: "$.id", Op: DiffChanged, A: "12345678901234567890", B: "12345678901234567891"}},
+		},
+		{name: "volatile keys ignored", a: `{"timestamp":1,"nonce":"x","ok":true}`, b: `{"timestamp":2,"nonce":"y","ok":true}`},
+		{name: "extra ignore normalized", a: `{"req_sign":"a"}`, b: `{"req_sign":"b"}`, ignore: []string{"Req-Sign"}},
+		{name: "top level array", a: `[1]`, b: `[1]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := Diff(jsonFlow(tt.a), jsonFlow(tt.b), tt.ignore)
+			body := diff.Response.Body
+			if tt.want == nil {
+				if body != nil {
+					t.Fatalf("expected no body diff, got %+v", body)
+				}
+				if !diff.Identical {
+					t.Errorf("expected identical flows")
+				}
+				return
+			}
+			if body == nil || body.Kind != "json" {
+				t.Fatalf("expected json body diff, got %+v", body)
+			}
+			if !reflect.DeepEqual(normalizeNumbers(body.Changes), tt.want) {
+				t.Errorf("changes = %#v, want %#v", body.Changes, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffBodyKinds(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Body
+		want string
+	}{
+		{name: "text", a: Body{Body: "a\nb", Size: 3}, b: Body{Body: "a\nc", Size: 3}, want: "text"},
+		{name: "invalid json falls back to text", a: Body{Body: "{a", Size: 2}, b: Body{Body: "{b", Size: 2}, want: "text"},
+		{name: "binary", a: Body{Body: "AAE=", Encoding: "base64", Size: 2}, b: Body{Body: "AAI=", Encoding: "base64", Size: 2}, want: "binary"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &differ{}
+			diff := d.body(&tt.a, &tt.b, http.Header{}, http.Header{})
+			if diff == nil || diff.Kind != tt.want {
+				t.Fatalf("body diff = %+v, want kind %s", diff, tt.want)
+			}
+			if tt.want == "binary" && (diff.SHA256A == "" || diff.SHA256A == diff.SHA256B) {
+				t.Errorf("expected distinct sha256, got %s %s", diff.SHA256A, diff.SHA256B)
+			}
+		})
+	}
+}
+
+func jsonFlow(body string) *Flow {
+	return &Flow{
+		Request: Request{Method: "GET", URL: "https://example.com/api"},
+		Response: &Response{
+			StatusCode: 200,
+			Headers:    http.Header{"Content-Type": {"application/json"}},
+			Body:       Body{Body: body, Size: int64(len(body))},
+		},
+	}
+}
+
+// normalizeNumbers 把 json.Number 转成字符串，便于与期望值比较
+func normalizeNumbers(changes []JSONChange) []JSONChange {
+	var conv func(v interface{}) interface{}
+	conv = func(v interface{}) interface{} {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			m := make(map[string]interface{}, len(x))
+			for k, e := range x {
+				m[k] = conv(e)
+			}
+			return m
+		case []interface{}:
+			s := make([]interface{}, len(x))
+			for i, e := range x {
+				s[i] = conv(e)
+			}
+			return s
+		case fmt.Stringer:
+			return x.String()
+		}
+		return v
+	}
+	out := make([]JSONChange, len(changes))
+	for i, c := range changes {
+		out[i] = JSONChange{Path: c.Path, Op: c.Op, A: conv(c.A), B: conv(c.B)}
+	}
+	return out
+}
@@ -0,0 +1,475 @@
+package capture
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sunnyproxy/pkg/config"
+)
+
+const (
+	// 写入队列长度，磁盘跟不上时丢弃并计数，不阻塞代理
+	diskQueueSize = 1024
+	// 段文件最长写入时间，到期后即使没写满也切换，便于按时间清理
+	segmentMaxDuration = time.Hour
+	// 清理过期数据和压缩旧段的间隔
+	maintainInterval = 10 * time.Minute
+)
+
+// DiskStats 磁盘存储统计
+type DiskStats struct {
+	Dir      string     `json:"dir"`
+	Segments int        `json:"segments"`
+	Flows    int        `json:"flows"`
+	Size     int64      `json:"size"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+	Dropped  uint64     `json:"dropped"` // 写入队列已满而未保存的流量
+	Errors   uint64     `json:"errors"`
+}
+
+// retention 保留策略
+type retention struct {
+	maxAge      time.Duration
+	maxSize     int64
+	segmentSize int64
+}
+
+func parseRetention(cfg config.FlowStorageConfig) (retention, error) {
+	if cfg.MaxAge < 0 || cfg.MaxSize < 0 {
+		return retention{}, fmt.Errorf("max_age/max_size 不能为负数")
+	}
+	if cfg.SegmentSize <= 0 {
+		return retention{}, fmt.Errorf("segment_size 必须大于 0")
+	}
+	if cfg.MaxSize > 0 && cfg.MaxSize < 2*cfg.SegmentSize {
+		return retention{}, fmt.Errorf("max_size 至少为 segment_size 的 2 倍")
+	}
+	return retention{maxAge: cfg.MaxAge, maxSize: cfg.MaxSize, segmentSize: cfg.SegmentSize}, nil
+}
+
+// diskStore 按段追加写入的流量存储，只依赖标准库
+// 索引（每条流量的概要）常驻内存，查询在索引上完成，只有获取完整内容时才读文件
+type diskStore struct {
+	dir string
+
+	mu       sync.RWMutex
+	policy   retention
+	segments []*segment // 按序号递增，最后一个是正在写入的段
+	index    map[string]*indexEntry
+	nextSeq  int
+
+	compactMu sync.Mutex // 同一时间只运行一次压缩
+
+	queueMu sync.RWMutex // 保护 closed，关闭后不再写入队列
+	closed  bool
+	queue   chan *Flow
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// openDisk 打开存储目录并加载已有的段
+func openDisk(cfg config.FlowStorageConfig) (*diskStore, error) {
+	policy, err := parseRetention(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("dir 不能为空")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	d := &diskStore{
+		dir:    cfg.Dir,
+		policy: policy,
+		index:  make(map[string]*indexEntry),
+		queue:  make(chan *Flow, diskQueueSize),
+		done:   make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		d.closeSegments()
+		return nil, err
+	}
+	active, err := createSegment(d.dir, d.nextSeq, false)
+	if err != nil {
+		d.closeSegments()
+		return nil, err
+	}
+	d.nextSeq++
+	d.segments = append(d.segments, active)
+
+	d.wg.Add(2)
+	go d.writeLoop()
+	go d.maintainLoop()
+	return d, nil
+}
+
+// load 加载目录中的段，压缩中途退出留下的重复记录以先加载的为准
+func (d *diskStore) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		seq, compact, ok := parseSegmentName(file.Name())
+		if !ok {
+			continue
+		}
+		s, err := openSegment(d.dir, seq, compact)
+		if err != nil {
+			return fmt.Errorf("打开 %s 失败: %v", file.Name(), err)
+		}
+		if len(s.entries) == 0 {
+			s.remove(d.dir)
+			continue
+		}
+		d.segments = append(d.segments, s)
+		if seq >= d.nextSeq {
+			d.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(d.segments, func(i, j int) bool { return d.segments[i].seq < d.segments[j].seq })
+
+	segments := d.segments[:0]
+	for _, s := range d.segments {
+		kept := s.entries[:0]
+		for _, e := range s.entries {
+			if _, dup := d.index[e.ID]; dup {
+				continue
+			}
+			d.index[e.ID] = e
+			kept = append(kept, e)
+		}
+		s.entries = kept
+		if len(kept) == 0 {
+			s.remove(d.dir)
+			continue
+		}
+		segments = append(segments, s)
+	}
+	d.segments = segments
+	return nil
+}
+
+func (d *diskStore) setRetention(cfg config.FlowStorageConfig) error {
+	policy, err := parseRetention(cfg)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.policy = policy
+	d.expire()
+	d.mu.Unlock()
+	return nil
+}
+
+// enqueue 把流量放入写入队列，队列已满时丢弃
+func (d *diskStore) enqueue(f *Flow) {
+	d.queueMu.RLock()
+	defer d.queueMu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.queue <- f:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+func (d *diskStore) writeLoop() {
+	defer d.wg.Done()
+	for f := range d.queue {
+		if err := d.append(f); err != nil {
+			if d.errors.Add(1) == 1 {
+				log.Printf("[Capture] 保存流量失败: %v", err)
+			}
+		}
+	}
+}
+
+func (d *diskStore) append(f *Flow) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	active := d.segments[len(d.segments)-1]
+	if active.size >= d.policy.segmentSize || time.Since(active.created) >= segmentMaxDuration {
+		next, err := createSegment(d.dir, d.nextSeq, false)
+		if err != nil {
+			return err
+		}
+		d.nextSeq++
+		active.seal()
+		d.segments = append(d.segments, next)
+		active = next
+		d.enforceSize()
+	}
+
+	e, err := active.append(f, false)
+	if err != nil {
+		return err
+	}
+	d.index[f.ID] = e
+	return nil
+}
+
+// enforceSize 总大小超过 max_size 时删除最旧的段，调用方需持有写锁
+func (d *diskStore) enforceSize() {
+	if d.policy.maxSize <= 0 {
+		return
+	}
+	var total int64
+	for _, s := range d.segments {
+		total += s.size
+	}
+	for total > d.policy.maxSize && len(d.segments) > 1 {
+		oldest := 0
+		for i, s := range d.segments[:len(d.segments)-1] {
+			if s.newest.Before(d.segments[oldest].newest) {
+				oldest = i
+			}
+		}
+		total -= d.segments[oldest].size
+		d.removeSegment(oldest)
+	}
+}
+
+// removeSegment 删除段及其索引，调用方需持有写锁
+func (d *diskStore) removeSegment(i int) {
+	s := d.segments[i]
+	for _, e := range s.entries {
+		if d.index[e.ID] == e {
+			delete(d.index, e.ID)
+		}
+	}
+	d.segments = append(d.segments[:i], d.segments[i+1:]...)
+	s.remove(d.dir)
+}
+
+// expire 删除全部流量都已过期的段，并检查总大小，调用方需持有写锁
+func (d *diskStore) expire() {
+	if d.policy.maxAge > 0 {
+		cutoff := time.Now().Add(-d.policy.maxAge)
+		for i := len(d.segments) - 2; i >= 0; i-- {
+			if d.segments[i].newest.Before(cutoff) {
+				d.removeSegment(i)
+			}
+		}
+	}
+	d.enforceSize()
+}
+
+func (d *diskStore) maintainLoop() {
+	defer d.wg.Done()
+	d.maintain()
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.maintain()
+		}
+	}
+}
+
+// maintain 删除过期的段，然后压缩已写完的段
+func (d *diskStore) maintain() {
+	d.mu.Lock()
+	d.expire()
+	d.mu.Unlock()
+
+	if err := d.compact(); err != nil {
+		log.Printf("[Capture] 压缩流量文件失败: %v", err)
+	}
+}
+
+// compact 把未压缩的只读段合并、压缩为新的段，同时去掉过期的流量
+// 已压缩但含有过期流量的段也会重写；新段写完后再替换旧段，中途退出时旧段仍然完整
+func (d *diskStore) compact() error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	d.mu.Lock()
+	policy := d.policy
+	var cutoff time.Time
+	if policy.maxAge > 0 {
+		cutoff = time.Now().Add(-policy.maxAge)
+	}
+	var sources []*segment
+	for _, s := range d.segments[:len(d.segments)-1] {
+		if !s.compact || (!cutoff.IsZero() && s.oldest().Before(cutoff)) {
+			sources = append(sources, s)
+		}
+	}
+	seq := d.nextSeq
+	d.nextSeq += len(sources)
+	d.mu.Unlock()
+
+	if len(sources) == 0 {
+		return nil
+	}
+
+	var outputs []*segment
+	var out *segment
+	fail := func(err error) error {
+		for _, s := range outputs {
+			s.remove(d.dir)
+		}
+		return err
+	}
+	for _, src := range sources {
+		d.mu.RLock()
+		entries := append([]*indexEntry(nil), src.entries...)
+		d.mu.RUnlock()
+
+		for _, e := range entries {
+			if !cutoff.IsZero() && e.StartedAt.Before(cutoff) {
+				continue
+			}
+			d.mu.RLock()
+			f, err := src.read(e)
+			d.mu.RUnlock()
+			if err != nil {
+				return fail(err)
+			}
+			if out == nil || out.size >= policy.segmentSize {
+				if out != nil {
+					out.seal()
+				}
+				if out, err = createSegment(d.dir, seq, true); err != nil {
+					return fail(err)
+				}
+				seq++
+				outputs = append(outputs, out)
+			}
+			if _, err := out.append(f, true); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if out != nil {
+		if err := out.seal(); err != nil {
+			return fail(err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// 压缩期间旧段可能已按大小被删除，此时放弃这次结果
+	for _, src := range sources {
+		if d.segmentIndex(src) < 0 {
+			return fail(nil)
+		}
+	}
+	for _, src := range sources {
+		d.removeSegment(d.segmentIndex(src))
+	}
+	for _, s := range outputs {
+		for _, e := range s.entries {
+			d.index[e.ID] = e
+		}
+	}
+	// 正在写入的段始终在最后
+	active := d.segments[len(d.segments)-1]
+	d.segments = append(d.segments[:len(d.segments)-1], outputs...)
+	d.segments = append(d.segments, active)
+	sort.Slice(d.segments[:len(d.segments)-1], func(i, j int) bool {
+		return d.segments[i].seq < d.segments[j].seq
+	})
+	return nil
+}
+
+func (d *diskStore) segmentIndex(s *segment) int {
+	for i, x := range d.segments {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// get 按 ID 读取完整的流量
+func (d *diskStore) get(id string) (*Flow, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	e, ok := d.index[id]
+	if !ok {
+		return nil, false
+	}
+	f, err := e.seg.read(e)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// match 在索引上查询满足条件的流量概要，未排序
+func (d *diskStore) match(q *Query) []Summary {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var matched []Summary
+	for _, s := range d.segments {
+		for _, e := range s.entries {
+			if q.Match(&e.Summary) {
+				matched = append(matched, e.Summary)
+			}
+		}
+	}
+	return matched
+}
+
+func (d *diskStore) stats() DiskStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	stats := DiskStats{
+		Dir:      d.dir,
+		Segments: len(d.segments),
+		Flows:    len(d.index),
+		Dropped:  d.dropped.Load(),
+		Errors:   d.errors.Load(),
+	}
+	for _, s := range d.segments {
+		stats.Size += s.size
+		if oldest := s.oldest(); !oldest.IsZero() && (stats.Oldest == nil || oldest.Before(*stats.Oldest)) {
+			stats.Oldest = &oldest
+		}
+	}
+	return stats
+}
+
+// close 写完队列中的流量后关闭文件
+func (d *diskStore) close() {
+	d.queueMu.Lock()
+	d.closed = true
+	close(d.queue)
+	d.queueMu.Unlock()
+	close(d.done)
+	d.wg.Wait()
+
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeSegments()
+}
+
+func (d *diskStore) closeSegments() {
+	for _, s := range d.segments {
+		if len(s.entries) == 0 {
+			s.remove(d.dir)
+		} else {
+			s.close()
+		}
+	}
+	d.segments = nil
+}
@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Flow 一次经过代理的请求及其响应
+type Flow struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration"` // 毫秒，从收到请求到响应发送完毕
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	Request   Request   `json:"request"`
+	Response  *Response `json:"response,omitempty"` // 上游请求失败时为空
+	TLS       *TLSInfo  `json:"tls,omitempty"`      // 与上游的 TLS 连接信息，仅解密后的 HTTPS 请求
+	Timings   Timings   `json:"timings"`
+	Rules     []string  `json:"rules,omitempty"` // 命中的规则
+	Error     string    `json:"error,omitempty"`
+	ReplayOf  string    `json:"replay_of,omitempty"` // 通过重放产生时为原流量的 ID
+}
+
+// Request 客户端发来的原始请求（规则修改之前）
+type Request struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Host    string      `json:"host"` // 不含端口的小写域名
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+	Body
+}
+
+// Response 返回给客户端的响应
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Proto      string      `json:"proto"`
+	Headers    http.Header `json:"headers"`
+	Body
+}
+
+// Body 保存的消息体，超过 max_body_size 的部分被截断
+type Body struct {
+	Body      string `json:"body,omitempty"`
+	Encoding  string `json:"encoding,omitempty"` // 内容不是合法 UTF-8 时为 "base64"
+	Size      int64  `json:"size"`               // 实际传输的字节数
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+func (b *Body) set(data []byte, size int64) {
+	b.Size = size
+	b.Truncated = int64(len(data)) < size
+	if utf8.Valid(data) {
+		b.Body = string(data)
+		b.Encoding = ""
+	} else {
+		b.Body = base64.StdEncoding.EncodeToString(data)
+		b.Encoding = "base64"
+	}
+}
+
+// Bytes 返回解码后的消息体
+func (b *Body) Bytes() ([]byte, error) {
+	if b.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(b.Body)
+	}
+	return []byte(b.Body), nil
+}
+
+// TLSInfo 代理与上游服务器之间的 TLS 连接
+type TLSInfo struct {
+	Version      string    `json:"version"`
+	CipherSuite  string    `json:"cipher_suite"`
+	ServerName   string    `json:"server_name"`
+	ALPN         string    `json:"alpn,omitempty"`
+	Resumed      bool      `json:"resumed,omitempty"`
+	PeerSubject  string    `json:"peer_subject,omitempty"`
+	PeerIssuer   string    `json:"peer_issuer,omitempty"`
+	PeerNotAfter time.Time `json:"peer_not_after,omitempty"`
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		ALPN:        state.NegotiatedProtocol,
+		Resumed:     state.DidResume,
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		info.PeerSubject = leaf.Subject.String()
+		info.PeerIssuer = leaf.Issuer.String()
+		info.PeerNotAfter = leaf.NotAfter
+	}
+	return info
+}
+
+// Timings 各阶段耗时（毫秒），与 HAR 的 timings 含义相同，-1 表示不适用（例如复用了连接）
+type Timings struct {
+	Blocked float64 `json:"blocked"` // 代理内部处理和等待可用连接
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"` // 包含 TLS 握手
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"` // 请求发送完到收到响应第一个字节
+	Receive float64 `json:"receive"`
+}
+
+// Summary 列表中显示的流量概要，不含头部和消息体
+type Summary struct {
+	ID           string    `json:"id"`
+	StartedAt    time.Time `json:"started_at"`
+	Duration     float64   `json:"duration"`
+	ClientIP     string    `json:"client_ip"`
+	User         string    `json:"user,omitempty"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	Host         string    `json:"host"`
+	StatusCode   int       `json:"status_code,omitempty"`
+	RequestSize  int64     `json:"request_size"`
+	ResponseSize int64     `json:"response_size"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Rules        []string  `json:"rules,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	ReplayOf     string    `json:"replay_of,omitempty"`
+}
+
+// Summary 返回流量概要
+func (f *Flow) Summary() Summary {
+	s := Summary{
+		ID:          f.ID,
+		StartedAt:   f.StartedAt,
+		Duration:    f.Duration,
+		ClientIP:    f.ClientIP,
+		User:        f.User,
+		Method:      f.Request.Method,
+		URL:         f.Request.URL,
+		Host:        f.Request.Host,
+		RequestSize: f.Request.Size,
+		Rules:       f.Rules,
+		Error:       f.Error,
+		ReplayOf:    f.ReplayOf,
+	}
+	if f.Response != nil {
+		s.StatusCode = f.Response.StatusCode
+		s.ResponseSize = f.Response.Size
+		s.ContentType = f.Response.Headers.Get("Content-Type")
+	}
+	return s
+}
+
+// millis 两个时间点之间的毫秒数，任一时间点缺失时返回 -1
+func millis(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+	d := to.Sub(from)
+	if d < 0 {
+		d = 0
+	}
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,383 @@
+package capture
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"sunnyproxy/internal/domainfilter"
+)
+
+// HAR 1.2 格式，参考 http://www.softwareishard.com/blog/har-12-spec/
+// 以下划线开头的字段是 HAR 允许的自定义字段，Chrome DevTools 和 Charles 会忽略它们
+
+// HAR HAR 文件的根对象
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+
+	ID       string   `json:"_id,omitempty"`
+	ClientIP string   `json:"_clientIP,omitempty"`
+	User     string   `json:"_user,omitempty"`
+	Rules    []string `json:"_rules,omitempty"`
+	Error    string   `json:"_error,omitempty"`
+	ReplayOf string   `json:"_replayOf,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData 请求体，HAR 1.2 的 postData 没有 encoding 字段，二进制内容用自定义的 _encoding 标记
+type HARPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+type HARContent struct {
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// ExportHAR 把流量转换为 HAR
+func ExportHAR(flows []*Flow) *HAR {
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "SunnyProxy", Version: "1.0"},
+		Entries: make([]HAREntry, 0, len(flows)),
+	}}
+	for _, f := range flows {
+		har.Log.Entries = append(har.Log.Entries, exportEntry(f))
+	}
+	return har
+}
+
+func exportEntry(f *Flow) HAREntry {
+	e := HAREntry{
+		StartedDateTime: f.StartedAt,
+		Time:            f.Duration,
+		Timings: HARTimings{
+			Blocked: f.Timings.Blocked,
+			DNS:     f.Timings.DNS,
+			Connect: f.Timings.Connect,
+			Send:    f.Timings.Send,
+			Wait:    f.Timings.Wait,
+			Receive: f.Timings.Receive,
+			SSL:     f.Timings.SSL,
+		},
+		ID:       f.ID,
+		ClientIP: f.ClientIP,
+		User:     f.User,
+		Rules:    f.Rules,
+		Error:    f.Error,
+		ReplayOf: f.ReplayOf,
+	}
+
+	req := &f.Request
+	e.Request = HARRequest{
+		Method:      req.Method,
+		URL:         req.URL,
+		HTTPVersion: req.Proto,
+		Cookies:     exportCookies((&http.Request{Header: req.Headers}).Cookies()),
+		Headers:     exportHeaders(req.Headers),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    req.Size,
+	}
+	if u, err := url.Parse(req.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				e.Request.QueryString = append(e.Request.QueryString, HARNameValue{Name: name, Value: v})
+			}
+		}
+	}
+	if req.Size > 0 {
+		e.Request.PostData = &HARPostData{
+			MimeType:  req.Headers.Get("Content-Type"),
+			Text:      req.Body.Body,
+			Encoding:  req.Encoding,
+			Truncated: req.Truncated,
+		}
+	}
+
+	// 请求失败时没有响应，按 Chrome 的做法输出状态码 0 和 _error
+	e.Response = HARResponse{
+		Cookies:     []HARCookie{},
+		Headers:     []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if resp := f.Response; resp != nil {
+		e.Response = HARResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+			HTTPVersion: resp.Proto,
+			Cookies:     exportCookies((&http.Response{Header: resp.Headers}).Cookies()),
+			Headers:     exportHeaders(resp.Headers),
+			Content: HARContent{
+				Size:      resp.Size,
+				MimeType:  resp.Headers.Get("Content-Type"),
+				Text:      resp.Body.Body,
+				Encoding:  resp.Encoding,
+				Truncated: resp.Truncated,
+			},
+			RedirectURL: resp.Headers.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    resp.Size,
+		}
+	}
+	return e
+}
+
+func exportHeaders(h http.Header) []HARNameValue {
+	headers := []HARNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+func exportCookies(cookies []*http.Cookie) []HARCookie {
+	result := []HARCookie{}
+	for _, c := range cookies {
+		hc := HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			hc.Expires = &expires
+		}
+		result = append(result, hc)
+	}
+	return result
+}
+
+// ParseHAR 读取 HAR 文件并转换为流量，消息体按 max_body_size 截断
+// 导入的流量使用新的 ID，原 ID 不会保留，避免与已有的流量冲突
+func (s *Store) ParseHAR(r io.Reader) ([]*Flow, error) {
+	var har HAR
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return nil, fmt.Errorf("无效的 HAR 文件: %v", err)
+	}
+	if har.Log.Entries == nil {
+		return nil, errors.New("无效的 HAR 文件: 缺少 log.entries")
+	}
+
+	limit := s.bodyLimit()
+	flows := make([]*Flow, 0, len(har.Log.Entries))
+	for i, e := range har.Log.Entries {
+		f, err := importEntry(&e, limit)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 条记录: %v", i+1, err)
+		}
+		flows = append(flows, f)
+	}
+	return flows, nil
+}
+
+func importEntry(e *HAREntry, limit int64) (*Flow, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("无效的 URL %q", e.Request.URL)
+	}
+	if e.Request.Method == "" {
+		return nil, errors.New("缺少请求方法")
+	}
+
+	f := &Flow{
+		ID:        uuid.Must(uuid.NewV7()).String(),
+		StartedAt: e.StartedDateTime,
+		Duration:  e.Time,
+		ClientIP:  e.ClientIP,
+		User:      e.User,
+		Request: Request{
+			Method:  e.Request.Method,
+			URL:     e.Request.URL,
+			Host:    domainfilter.NormalizeHost(u.Host),
+			Proto:   e.Request.HTTPVersion,
+			Headers: importHeaders(e.Request.Headers),
+		},
+		Timings: Timings{
+			Blocked: e.Timings.Blocked,
+			DNS:     e.Timings.DNS,
+			Connect: e.Timings.Connect,
+			SSL:     e.Timings.SSL,
+			Send:    e.Timings.Send,
+			Wait:    e.Timings.Wait,
+			Receive: e.Timings.Receive,
+		},
+		Rules: e.Rules,
+		Error: e.Error,
+	}
+	// 有的工具只在 cookies 中列出 Cookie，没有对应的头部
+	if f.Request.Headers.Get("Cookie") == "" && len(e.Request.Cookies) > 0 {
+		pairs := make([]string, 0, len(e.Request.Cookies))
+		for _, c := range e.Request.Cookies {
+			pairs = append(pairs, (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+		}
+		f.Request.Headers.Set("Cookie", strings.Join(pairs, "; "))
+	}
+	if p := e.Request.PostData; p != nil {
+		// bodySize 是传输的字节数（可能经过压缩），以内容的长度为准
+		if err := importBody(&f.Request.Body, p.Text, p.Encoding, 0, limit); err != nil {
+			return nil, fmt.Errorf("请求体: %v", err)
+		}
+		f.Request.Truncated = f.Request.Truncated || p.Truncated
+	}
+
+	if e.Response.Status == 0 {
+		if f.Error == "" {
+			f.Error = "no response"
+		}
+		return f, nil
+	}
+	// HTTP/2 没有状态描述，Chrome 导出的 statusText 为空
+	statusText := e.Response.StatusText
+	if statusText == "" {
+		statusText = http.StatusText(e.Response.Status)
+	}
+	resp := &Response{
+		StatusCode: e.Response.Status,
+		Status:     strings.TrimSpace(fmt.Sprintf("%d %s", e.Response.Status, statusText)),
+		Proto:      e.Response.HTTPVersion,
+		Headers:    importHeaders(e.Response.Headers),
+	}
+	if len(resp.Headers.Values("Set-Cookie")) == 0 {
+		for _, c := range e.Response.Cookies {
+			cookie := &http.Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HttpOnly: c.HTTPOnly, Secure: c.Secure}
+			if c.Expires != nil {
+				cookie.Expires = *c.Expires
+			}
+			resp.Headers.Add("Set-Cookie", cookie.String())
+		}
+	}
+	content := e.Response.Content
+	if err := importBody(&resp.Body, content.Text, content.Encoding, content.Size, limit); err != nil {
+		return nil, fmt.Errorf("响应体: %v", err)
+	}
+	resp.Truncated = resp.Truncated || content.Truncated
+	f.Response = resp
+	return f, nil
+}
+
+// importHeaders 转换头部，跳过 HTTP/2 的伪头部（:authority 等）
+func importHeaders(headers []HARNameValue) http.Header {
+	h := make(http.Header, len(headers))
+	for _, nv := range headers {
+		if strings.HasPrefix(nv.Name, ":") {
+			continue
+		}
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+// importBody 解码消息体，size 为 HAR 中记录的原始大小，为 0 或小于内容长度时使用内容的长度
+func importBody(b *Body, text, encoding string, size, limit int64) error {
+	data := []byte(text)
+	if encoding == "base64" {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(text); err != nil {
+			return err
+		}
+	}
+	if size < int64(len(data)) {
+		size = int64(len(data))
+	}
+	if int64(len(data)) > limit {
+		data = data[:limit]
+	}
+	b.set(data, size)
+	return nil
+}
+
+// Import 保存导入的流量，与捕获的流量一样可以查询，启用持久化时同时写入磁盘
+func (s *Store) Import(flows []*Flow) {
+	for _, f := range flows {
+		s.insert(f)
+	}
+}
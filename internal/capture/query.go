@@ -0,0 +1,157 @@
+package capture
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/internal/netutil"
+)
+
+const (
+	// 查询默认和最多返回的条数
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Query 流量查询条件，零值表示不限制
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Host   *domainfilter.Matcher // 规则格式同 domain_filter
+	Client *netutil.CIDRList
+	Method string
+	// 状态码范围，Failed 为 true 时只查没有响应的失败请求
+	StatusMin int
+	StatusMax int
+	Failed    bool
+
+	Offset int
+	Limit  int
+}
+
+// ParseQuery 解析查询参数
+//
+//	from, to  RFC3339 时间，或 "24h" 这样的时长表示距现在多久之前
+//	host      域名规则，例如 api.example.com、.example.com
+//	client    客户端 IP 或网段
+//	method    请求方法
+//	status    200、4xx 或 error（请求失败）
+//	limit, offset
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{Limit: DefaultLimit}
+	now := time.Now()
+	var err error
+
+	if q.From, err = parseTime(v.Get("from"), now); err != nil {
+		return q, fmt.Errorf("from: %v", err)
+	}
+	if q.To, err = parseTime(v.Get("to"), now); err != nil {
+		return q, fmt.Errorf("to: %v", err)
+	}
+	if host := v.Get("host"); host != "" {
+		if q.Host, err = domainfilter.NewMatcher([]string{host}); err != nil {
+			return q, fmt.Errorf("host: %v", err)
+		}
+	}
+	if client := v.Get("client"); client != "" {
+		if q.Client, err = netutil.ParseCIDRList([]string{client}); err != nil {
+			return q, fmt.Errorf("client: %v", err)
+		}
+	}
+	q.Method = strings.ToUpper(v.Get("method"))
+
+	switch status := strings.ToLower(v.Get("status")); {
+	case status == "":
+	case status == "error":
+		q.Failed = true
+	case len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5':
+		q.StatusMin = int(status[0]-'0') * 100
+		q.StatusMax = q.StatusMin + 99
+	default:
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 999 {
+			return q, fmt.Errorf("status: 无效的状态码 %q", status)
+		}
+		q.StatusMin, q.StatusMax = code, code
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("limit: 无效的数量 %q", s)
+		}
+		if q.Limit > MaxLimit {
+			q.Limit = MaxLimit
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("offset: 无效的偏移 %q", s)
+		}
+	}
+	return q, nil
+}
+
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("无效的时间 %q，应为 RFC3339 或时长", s)
+	}
+	return t, nil
+}
+
+// Match 检查流量概要是否满足查询条件
+func (q *Query) Match(s *Summary) bool {
+	if !q.From.IsZero() && s.StartedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && s.StartedAt.After(q.To) {
+		return false
+	}
+	if q.Host != nil {
+		if _, ok := q.Host.Match(s.Host); !ok {
+			return false
+		}
+	}
+	if q.Client != nil {
+		addr, err := netutil.ParseAddr(s.ClientIP)
+		if err != nil || !q.Client.Contains(addr) {
+			return false
+		}
+	}
+	if q.Method != "" && s.Method != q.Method {
+		return false
+	}
+	if q.Failed {
+		return s.StatusCode == 0
+	}
+	if q.StatusMin > 0 && (s.StatusCode < q.StatusMin || s.StatusCode > q.StatusMax) {
+		return false
+	}
+	return true
+}
+
+// page 按时间倒序排序后取 offset、limit 对应的一页
+func (q *Query) page(matched []Summary) []Summary {
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].StartedAt.After(matched[j].StartedAt)
+	})
+	if q.Offset >= len(matched) {
+		return []Summary{}
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	return matched
+}
@@ -0,0 +1,353 @@
+package capture
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"sunnyproxy/internal/domainfilter"
+)
+
+// Recorder 记录一次请求从收到到响应发送完毕的过程，完成后保存到 Store
+// 所有方法都可以在 nil 上调用（未启用捕获时 Begin 返回 nil）
+type Recorder struct {
+	store *Store
+	limit int64
+	flow  *Flow
+
+	reqBody  *bodyBuffer
+	respBody *bodyBuffer
+
+	mu           sync.Mutex
+	getConn      time.Time
+	gotConn      time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	upstreamTLS  *tls.ConnectionState
+	done         bool
+
+	once sync.Once
+}
+
+// Begin 开始记录请求，未启用捕获时返回 nil
+// 需要在规则修改请求之前调用，保存的是客户端发来的原始请求
+func (s *Store) Begin(req *http.Request, clientIP, user string) *Recorder {
+	if s == nil || !s.IsEnabled() {
+		return nil
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	r := &Recorder{
+		store: s,
+		limit: s.bodyLimit(),
+		flow: &Flow{
+			ID:        uuid.Must(uuid.NewV7()).String(),
+			StartedAt: time.Now(),
+			ClientIP:  clientIP,
+			User:      user,
+			Request: Request{
+				Method:  req.Method,
+				URL:     req.URL.String(),
+				Host:    domainfilter.NormalizeHost(host),
+				Proto:   req.Proto,
+				Headers: req.Header.Clone(),
+			},
+		},
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		r.reqBody = &bodyBuffer{limit: r.limit}
+		req.Body = &teeBody{ReadCloser: req.Body, buf: r.reqBody}
+	}
+	return r
+}
+
+// ID 返回流量 ID
+func (r *Recorder) ID() string {
+	if r == nil {
+		return ""
+	}
+	return r.flow.ID
+}
+
+// AddRules 记录命中的规则
+func (r *Recorder) AddRules(names ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flow.Rules = append(r.flow.Rules, names...)
+}
+
+// SetReplayOf 标记为重放产生的流量，id 为原流量的 ID
+func (r *Recorder) SetReplayOf(id string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flow.ReplayOf = id
+}
+
+// Trace 在请求上挂载 httptrace，用于统计连接、握手和等待时间
+func (r *Recorder) Trace(req *http.Request) *http.Request {
+	if r == nil {
+		return req
+	}
+	mark := func(t *time.Time) {
+		r.mu.Lock()
+		*t = time.Now()
+		r.mu.Unlock()
+	}
+	// 使用自定义 DialTLSContext 时 Transport 会在握手完成后再回调一次，只保留第一次
+	markFirst := func(t *time.Time) {
+		r.mu.Lock()
+		if t.IsZero() {
+			*t = time.Now()
+		}
+		r.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { mark(&r.getConn) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			mark(&r.gotConn)
+			if info.Reused {
+				// 复用的连接没有建立连接的耗时
+				r.mu.Lock()
+				r.dnsStart, r.dnsDone = time.Time{}, time.Time{}
+				r.connectStart, r.connectDone = time.Time{}, time.Time{}
+				r.tlsStart, r.tlsDone = time.Time{}, time.Time{}
+				r.mu.Unlock()
+			}
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&r.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&r.dnsDone) },
+		ConnectStart:         func(string, string) { mark(&r.connectStart) },
+		ConnectDone:          func(string, string, error) { mark(&r.connectDone) },
+		TLSHandshakeStart:    func() { markFirst(&r.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { markFirst(&r.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&r.wroteRequest) },
+		GotFirstResponseByte: func() { mark(&r.firstByte) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// Upstream 记录上游响应的 TLS 信息，并在响应体上统计发送给客户端的内容
+// 需要在响应交给 goproxy 之前调用，替换响应体不会影响 Content-Length 的处理
+func (r *Recorder) Upstream(resp *http.Response) {
+	if r == nil || resp == nil {
+		return
+	}
+	r.mu.Lock()
+	r.upstreamTLS = resp.TLS
+	r.mu.Unlock()
+	r.wrapBody(resp, r.upstreamDone)
+}
+
+// upstreamDone 上游响应体读完时调用
+// 断点等响应处理器可能读取上游响应体后换成新的，此时等新的响应体读完再保存
+func (r *Recorder) upstreamDone(buf *bodyBuffer) {
+	r.mu.Lock()
+	recorded := r.flow.Response != nil && r.respBody == buf
+	r.mu.Unlock()
+	if recorded {
+		r.finish()
+	}
+}
+
+// Response 记录返回给客户端的响应，需要在所有响应处理器之后调用
+// 响应体读完或关闭时保存流量；resp 为空表示上游请求失败
+func (r *Recorder) Response(resp *http.Response, err error) {
+	if r == nil {
+		return
+	}
+	if resp == nil {
+		r.Fail(err)
+		return
+	}
+
+	r.mu.Lock()
+	if r.done {
+		r.mu.Unlock()
+		return
+	}
+	r.flow.Response = &Response{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Proto:      resp.Proto,
+		Headers:    resp.Header.Clone(),
+	}
+	r.mu.Unlock()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		// WebSocket 等协议升级后的数据不属于这次请求
+		r.finish()
+		return
+	}
+	if _, ok := resp.Body.(*teeBody); !ok {
+		// 代理自己生成的响应（403、429 等），或被响应处理器替换的响应体，重新记录
+		r.mu.Lock()
+		r.respBody = nil
+		r.mu.Unlock()
+		r.wrapBody(resp, func(*bodyBuffer) { r.finish() })
+	}
+}
+
+// Fail 记录请求失败并保存流量
+func (r *Recorder) Fail(err error) {
+	if r == nil {
+		return
+	}
+	if err != nil {
+		r.mu.Lock()
+		if r.flow.Error == "" {
+			r.flow.Error = err.Error()
+		}
+		r.mu.Unlock()
+	}
+	r.finish()
+}
+
+func (r *Recorder) wrapBody(resp *http.Response, onDone func(*bodyBuffer)) {
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	r.mu.Lock()
+	if r.respBody == nil {
+		r.respBody = &bodyBuffer{limit: r.limit}
+	}
+	buf := r.respBody
+	r.mu.Unlock()
+	resp.Body = &teeBody{ReadCloser: resp.Body, buf: buf, onDone: onDone}
+}
+
+// finish 计算耗时并保存流量，只执行一次
+func (r *Recorder) finish() {
+	r.once.Do(func() {
+		done := time.Now()
+
+		r.mu.Lock()
+		r.done = true
+		f := r.flow
+		if r.reqBody != nil {
+			data, size := r.reqBody.snapshot()
+			f.Request.set(data, size)
+		}
+		if f.Response != nil && r.respBody != nil {
+			data, size := r.respBody.snapshot()
+			f.Response.set(data, size)
+		}
+		if r.upstreamTLS != nil {
+			f.TLS = newTLSInfo(r.upstreamTLS)
+		}
+		f.Duration = millis(f.StartedAt, done)
+		f.Timings = r.timings(done)
+		r.mu.Unlock()
+
+		r.store.add(f)
+	})
+}
+
+// timings 按 HAR 的定义计算各阶段耗时，调用方需持有锁
+func (r *Recorder) timings(done time.Time) Timings {
+	t := Timings{
+		Blocked: -1,
+		DNS:     millis(r.dnsStart, r.dnsDone),
+		Connect: millis(r.connectStart, r.tlsDone),
+		SSL:     millis(r.tlsStart, r.tlsDone),
+		Send:    millis(r.gotConn, r.wroteRequest),
+		Wait:    millis(r.wroteRequest, r.firstByte),
+		Receive: 0,
+	}
+	if t.Connect < 0 {
+		t.Connect = millis(r.connectStart, r.connectDone)
+	}
+	if !r.gotConn.IsZero() {
+		// 从收到请求到拿到连接，扣除建立连接的时间
+		blocked := millis(r.flow.StartedAt, r.gotConn)
+		for _, d := range []float64{t.DNS, t.Connect} {
+			if d > 0 {
+				blocked -= d
+			}
+		}
+		if blocked < 0 {
+			blocked = 0
+		}
+		t.Blocked = blocked
+	}
+	if !r.firstByte.IsZero() {
+		t.Receive = millis(r.firstByte, done)
+	} else {
+		// 没有收到上游响应：代理直接返回的响应全部计入 receive，请求失败时不计
+		t.Send, t.Wait = 0, 0
+		if r.flow.Response != nil {
+			t.Receive = millis(r.flow.StartedAt, done)
+		}
+	}
+	return t
+}
+
+// bodyBuffer 保存消息体的前 limit 个字节，并统计总长度
+type bodyBuffer struct {
+	mu    sync.Mutex
+	limit int64
+	data  []byte
+	size  int64
+}
+
+func (b *bodyBuffer) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if room := b.limit - int64(len(b.data)); room > 0 {
+		if int64(len(p)) > room {
+			p = p[:room]
+		}
+		b.data = append(b.data, p...)
+	}
+}
+
+func (b *bodyBuffer) snapshot() ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.data...), b.size
+}
+
+// teeBody 读取消息体的同时保存一份副本，读完或关闭时回调 onDone
+type teeBody struct {
+	io.ReadCloser
+	buf    *bodyBuffer
+	onDone func(*bodyBuffer)
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.buf.write(p[:n])
+	}
+	if err == io.EOF && t.onDone != nil {
+		t.onDone(t.buf)
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	err := t.ReadCloser.Close()
+	if t.onDone != nil {
+		t.onDone(t.buf)
+	}
+	return err
+}
@@ -0,0 +1,325 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 段文件由若干条记录组成，每条记录为 4 字节长度（大端）+ 1 字节标志 + 流量的 JSON
+// 同名的 .idx 文件每行保存一条记录的概要和位置，丢失或不完整时从 .dat 重建
+const (
+	recordHeaderSize = 5
+	flagDeflate      = 1 // 内容经过 deflate 压缩（压缩后的段）
+
+	// 单条记录的上限，超过时认为文件已损坏
+	maxRecordSize = 64 << 20
+
+	segmentExt = ".dat"
+	indexExt   = ".idx"
+	// 压缩后的段文件名带有该后缀，例如 00000012-c.dat
+	compactSuffix = "-c"
+)
+
+// indexEntry 一条记录的概要和位置
+type indexEntry struct {
+	Summary
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+
+	seg *segment
+}
+
+// segment 一个段文件，最后一个段用于追加写入，其余的只读
+type segment struct {
+	seq     int
+	compact bool
+	file    *os.File
+	index   *os.File // 仅在写入时打开
+	size    int64
+	created time.Time
+	entries []*indexEntry
+	newest  time.Time // 最新一条流量的开始时间
+}
+
+func segmentName(seq int, compact bool) string {
+	name := fmt.Sprintf("%08d", seq)
+	if compact {
+		name += compactSuffix
+	}
+	return name
+}
+
+// parseSegmentName 从文件名中解析段序号，不是段文件时返回 false
+func parseSegmentName(name string) (int, bool, bool) {
+	base, ok := strings.CutSuffix(name, segmentExt)
+	if !ok {
+		return 0, false, false
+	}
+	base, compact := strings.CutSuffix(base, compactSuffix)
+	seq, err := strconv.Atoi(base)
+	if err != nil || seq < 0 {
+		return 0, false, false
+	}
+	return seq, compact, true
+}
+
+func (s *segment) path(dir, ext string) string {
+	return filepath.Join(dir, segmentName(s.seq, s.compact)+ext)
+}
+
+// createSegment 创建一个新的段用于写入
+func createSegment(dir string, seq int, compact bool) (*segment, error) {
+	s := &segment{seq: seq, compact: compact, created: time.Now()}
+	file, err := os.OpenFile(s.path(dir, segmentExt), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(s.path(dir, indexExt), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		file.Close()
+		os.Remove(s.path(dir, segmentExt))
+		return nil, err
+	}
+	s.file = file
+	s.index = index
+	return s, nil
+}
+
+// openSegment 打开已有的段，按 .idx 加载概要，.idx 中缺失的记录从 .dat 中补齐
+// 末尾写了一半的记录（进程异常退出）会被截掉
+func openSegment(dir string, seq int, compact bool) (*segment, error) {
+	s := &segment{seq: seq, compact: compact}
+	file, err := os.OpenFile(s.path(dir, segmentExt), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.created = info.ModTime()
+	size := info.Size()
+
+	entries := readIndex(s.path(dir, indexExt))
+	stale := false // .idx 中有与 .dat 不符的记录
+	var end int64
+	for i, e := range entries {
+		if e.Offset != end || e.Offset+e.Length > size {
+			entries = entries[:i]
+			stale = true
+			break
+		}
+		end = e.Offset + e.Length
+	}
+	indexed := len(entries)
+
+	for end < size {
+		f, n, err := readRecordAt(file, end)
+		if err != nil {
+			// 不完整的记录，从这里截断
+			if err := file.Truncate(end); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		sum := f.Summary()
+		entries = append(entries, &indexEntry{Summary: sum, Offset: end, Length: n})
+		end += n
+	}
+	s.size = end
+
+	for _, e := range entries {
+		e.seg = s
+		if e.StartedAt.After(s.newest) {
+			s.newest = e.StartedAt
+		}
+	}
+	s.entries = entries
+
+	if stale || len(entries) != indexed {
+		if err := s.writeIndex(dir); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// readIndex 读取 .idx 文件，遇到无法解析的行时停止
+func readIndex(path string) []*indexEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var entries []*indexEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		var e indexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		entries = append(entries, &e)
+	}
+	return entries
+}
+
+// writeIndex 重新生成整个 .idx 文件
+func (s *segment) writeIndex(dir string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range s.entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	path := s.path(dir, indexExt)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// append 追加一条记录，compress 为 true 时压缩内容
+func (s *segment) append(f *Flow, compress bool) (*indexEntry, error) {
+	record, err := encodeRecord(f, compress)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		// 写了一部分时截掉，保持文件完整
+		s.file.Truncate(s.size)
+		return nil, err
+	}
+
+	e := &indexEntry{Summary: f.Summary(), Offset: s.size, Length: int64(len(record)), seg: s}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	// .idx 写入失败不影响数据，重新打开时会从 .dat 重建
+	s.index.Write(append(line, '\n'))
+
+	s.size += e.Length
+	s.entries = append(s.entries, e)
+	if f.StartedAt.After(s.newest) {
+		s.newest = f.StartedAt
+	}
+	return e, nil
+}
+
+// seal 结束写入，段变为只读
+func (s *segment) seal() error {
+	if s.index == nil {
+		return nil
+	}
+	err := s.index.Close()
+	s.index = nil
+	if syncErr := s.file.Sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// oldest 返回最早一条流量的开始时间，记录按完成顺序写入，所以需要遍历
+func (s *segment) oldest() time.Time {
+	var t time.Time
+	for _, e := range s.entries {
+		if t.IsZero() || e.StartedAt.Before(t) {
+			t = e.StartedAt
+		}
+	}
+	return t
+}
+
+func (s *segment) read(e *indexEntry) (*Flow, error) {
+	f, _, err := readRecordAt(s.file, e.Offset)
+	return f, err
+}
+
+// close 关闭文件
+func (s *segment) close() {
+	s.seal()
+	s.file.Close()
+}
+
+// remove 关闭并删除段文件
+func (s *segment) remove(dir string) {
+	s.close()
+	os.Remove(s.path(dir, segmentExt))
+	os.Remove(s.path(dir, indexExt))
+}
+
+func encodeRecord(f *Flow, compress bool) ([]byte, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, recordHeaderSize))
+	var flags byte
+	if compress {
+		flags = flagDeflate
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	} else {
+		buf.Write(data)
+	}
+
+	record := buf.Bytes()
+	if len(record)-recordHeaderSize > maxRecordSize {
+		return nil, fmt.Errorf("记录过大: %d 字节", len(record))
+	}
+	binary.BigEndian.PutUint32(record, uint32(len(record)-recordHeaderSize))
+	record[4] = flags
+	return record, nil
+}
+
+// readRecordAt 读取 offset 处的记录，返回流量和记录的总长度
+func readRecordAt(r io.ReaderAt, offset int64) (*Flow, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n > maxRecordSize {
+		return nil, 0, errors.New("记录长度无效")
+	}
+	payload := make([]byte, n)
+	if _, err := r.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+
+	var data io.Reader = bytes.NewReader(payload)
+	if header[4]&flagDeflate != 0 {
+		zr := flate.NewReader(data)
+		defer zr.Close()
+		data = zr
+	}
+	var f Flow
+	if err := json.NewDecoder(data).Decode(&f); err != nil {
+		return nil, 0, err
+	}
+	return &f, recordHeaderSize + int64(n), nil
+}
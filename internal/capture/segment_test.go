@@ -0,0 +1,259 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeTestSegment 创建一个包含 n 条记录的段并关闭，返回每条记录的结束位置
+func writeTestSegment(t *testing.T, dir string, n int, compress bool) []int64 {
+	t.Helper()
+	s, err := createSegment(dir, 1, compress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ends []int64
+	for i := 0; i < n; i++ {
+		f := &Flow{
+			ID:        fmt.Sprintf("flow-%d", i),
+			StartedAt: base.Add(time.Duration(i) * time.Second),
+			Request:   Request{Method: "GET", URL: fmt.Sprintf("https://example.com/%d", i), Host: "example.com"},
+		}
+		e, err := s.append(f, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, e.Offset+e.Length)
+	}
+	return ends
+}
+
+func TestOpenSegmentRecovery(t *testing.T) {
+	const records = 3
+
+	tests := []struct {
+		name     string
+		compress bool
+		damage   func(t *testing.T, dat, idx string, ends []int64)
+		want     int // 恢复后的记录数
+	}{
+		{
+			name:   "intact",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {},
+			want:   records,
+		},
+		{
+			name:     "intact compressed",
+			compress: true,
+			damage:   func(t *testing.T, dat, idx string, ends []int64) {},
+			want:     records,
+		},
+		{
+			name:   "index missing",
+			damage: func(t *testing.T, dat, idx string, ends []int64) { mustRemove(t, idx) },
+			want:   records,
+		},
+		{
+			name:     "index missing compressed",
+			compress: true,
+			damage:   func(t *testing.T, dat, idx string, ends []int64) { mustRemove(t, idx) },
+			want:     records,
+		},
+		{
+			name: "index partial",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				keepLines(t, idx, 1)
+			},
+			want: records,
+		},
+		{
+			name: "index garbage line",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				keepLines(t, idx, 1)
+				appendBytes(t, idx, []byte("{not json\n"))
+			},
+			want: records,
+		},
+		{
+			name: "data truncated to a record boundary",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				mustTruncate(t, dat, ends[1])
+			},
+			want: 2,
+		},
+		{
+			name: "index offset mismatch",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				data, err := os.ReadFile(idx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				lines[2] = bytes.Replace(lines[2], []byte(fmt.Sprintf(`"offset":%d`, ends[1])), []byte(`"offset":1`), 1)
+				if err := os.WriteFile(idx, bytes.Join(lines, nil), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: records,
+		},
+		{
+			name: "data truncated mid record",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				mustTruncate(t, dat, ends[2]-3)
+				mustRemove(t, idx)
+			},
+			want: 2,
+		},
+		{
+			name: "half written header",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				appendBytes(t, dat, []byte{0, 0})
+			},
+			want: records,
+		},
+		{
+			name: "trailing record length beyond file",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				appendBytes(t, dat, recordHeader(100, 0))
+				appendBytes(t, dat, []byte("{}"))
+			},
+			want: records,
+		},
+		{
+			name: "trailing record length over limit",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				appendBytes(t, dat, recordHeader(maxRecordSize+1, 0))
+			},
+			want: records,
+		},
+		{
+			name: "trailing record not json",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				appendBytes(t, dat, append(recordHeader(3, 0), "abc"...))
+			},
+			want: records,
+		},
+		{
+			name: "trailing record bad deflate",
+			damage: func(t *testing.T, dat, idx string, ends []int64) {
+				appendBytes(t, dat, append(recordHeader(3, flagDeflate), 0xff, 0xff, 0xff))
+			},
+			want: records,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ends := writeTestSegment(t, dir, records, tt.compress)
+			probe := &segment{seq: 1, compact: tt.compress}
+			dat, idx := probe.path(dir, segmentExt), probe.path(dir, indexExt)
+			tt.damage(t, dat, idx, ends)
+
+			s, err := openSegment(dir, 1, tt.compress)
+			if err != nil {
+				t.Fatalf("openSegment: %v", err)
+			}
+			defer s.close()
+
+			if len(s.entries) != tt.want {
+				t.Fatalf("recovered %d records, want %d", len(s.entries), tt.want)
+			}
+			wantSize := ends[tt.want-1]
+			if s.size != wantSize {
+				t.Errorf("size = %d, want %d", s.size, wantSize)
+			}
+			if info, err := os.Stat(dat); err != nil || info.Size() != wantSize {
+				t.Errorf("data file not truncated to %d: %v %v", wantSize, info.Size(), err)
+			}
+			for i, e := range s.entries {
+				f, err := s.read(e)
+				if err != nil {
+					t.Fatalf("read record %d: %v", i, err)
+				}
+				if id := fmt.Sprintf("flow-%d", i); f.ID != id || e.ID != id {
+					t.Errorf("record %d: flow %q, index %q, want %q", i, f.ID, e.ID, id)
+				}
+			}
+			if want := time.Date(2024, 1, 1, 0, 0, tt.want-1, 0, time.UTC); !s.newest.Equal(want) {
+				t.Errorf("newest = %v, want %v", s.newest, want)
+			}
+
+			// 重建后的 .idx 应该与 .dat 一致
+			index := readIndex(idx)
+			if len(index) != tt.want {
+				t.Fatalf("index has %d entries after recovery, want %d", len(index), tt.want)
+			}
+			for i, e := range index {
+				if e.Offset != s.entries[i].Offset || e.Length != s.entries[i].Length {
+					t.Errorf("index entry %d at %d+%d, want %d+%d", i, e.Offset, e.Length, s.entries[i].Offset, s.entries[i].Length)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeRecordTooLarge(t *testing.T) {
+	f := &Flow{ID: "big"}
+	f.Request.Body.Body = string(bytes.Repeat([]byte("a"), maxRecordSize))
+	if _, err := encodeRecord(f, false); err == nil {
+		t.Fatal("expected error for oversized record")
+	}
+	// 压缩后不超过上限时可以保存
+	if _, err := encodeRecord(f, true); err != nil {
+		t.Fatalf("compressed record: %v", err)
+	}
+}
+
+func recordHeader(length uint32, flags byte) []byte {
+	h := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(h, length)
+	h[4] = flags
+	return h
+}
+
+func mustRemove(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustTruncate(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keepLines 只保留文件的前 n 行
+func keepLines(t *testing.T, path string, n int) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if err := os.WriteFile(path, bytes.Join(lines[:n], nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
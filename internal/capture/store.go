@@ -0,0 +1,257 @@
+package capture
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"sunnyproxy/pkg/config"
+)
+
+// Stats 捕获统计
+type Stats struct {
+	Enabled     bool       `json:"enabled"`
+	Flows       int        `json:"flows"`
+	MaxFlows    int        `json:"max_flows"`
+	MaxBodySize int64      `json:"max_body_size"`
+	Captured    uint64     `json:"captured"` // 启动以来捕获的总数，包括已被淘汰的
+	Storage     *DiskStats `json:"storage,omitempty"`
+}
+
+// Store 在内存中保存最近的流量，超出容量时淘汰最旧的
+// 启用 storage 时同时写入磁盘，内存中淘汰的流量仍可从磁盘查询
+type Store struct {
+	mu          sync.RWMutex
+	enabled     bool
+	maxBodySize int64
+	ring        []*Flow // 环形缓冲区，容量为 max_flows
+	head        int     // 下一条写入的位置
+	count       int
+	index       map[string]*Flow
+	disk        *diskStore
+	onFinish    func(*Flow)
+
+	captured atomic.Uint64
+}
+
+// New 根据配置创建流量存储
+func New(cfg config.CaptureConfig) (*Store, error) {
+	s := &Store{index: make(map[string]*Flow)}
+	if err := s.Update(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update 重新应用配置，配置无效时保持原有状态不变；容量缩小时淘汰最旧的流量
+// 存储目录变化时打开新目录，旧目录中的流量不再可查
+func (s *Store) Update(cfg config.CaptureConfig) error {
+	commit, err := s.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+// 需要打开新的存储目录时在这里打开，调用方应在其他组件都准备好之后再调用，避免打开后不使用
+func (s *Store) Prepare(cfg config.CaptureConfig) (func(), error) {
+	if cfg.MaxFlows <= 0 {
+		return nil, fmt.Errorf("max_flows 必须大于 0")
+	}
+	if cfg.MaxBodySize < 0 {
+		return nil, fmt.Errorf("max_body_size 不能为负数")
+	}
+	if _, err := parseRetention(cfg.Storage); err != nil {
+		return nil, fmt.Errorf("storage: %v", err)
+	}
+
+	s.mu.RLock()
+	disk := s.disk
+	s.mu.RUnlock()
+
+	// 打开目录需要读取所有段，放在锁外进行
+	var opened *diskStore
+	if cfg.Storage.Enabled && (disk == nil || disk.dir != cfg.Storage.Dir) {
+		var err error
+		if opened, err = openDisk(cfg.Storage); err != nil {
+			return nil, fmt.Errorf("storage: %v", err)
+		}
+	}
+
+	return func() {
+		s.mu.Lock()
+		s.enabled = cfg.Enabled
+		s.maxBodySize = cfg.MaxBodySize
+		if cfg.MaxFlows != len(s.ring) {
+			s.resize(cfg.MaxFlows)
+		}
+		var closing *diskStore
+		switch {
+		case opened != nil:
+			closing, s.disk = s.disk, opened
+		case !cfg.Storage.Enabled:
+			closing, s.disk = s.disk, nil
+		case s.disk != nil:
+			s.disk.setRetention(cfg.Storage)
+		}
+		s.mu.Unlock()
+
+		if closing != nil {
+			closing.close()
+		}
+	}, nil
+}
+
+// Close 把尚未写入的流量写入磁盘并关闭存储
+func (s *Store) Close() {
+	s.mu.Lock()
+	disk := s.disk
+	s.disk = nil
+	s.mu.Unlock()
+
+	if disk != nil {
+		disk.close()
+	}
+}
+
+// resize 按新容量重建环形缓冲区，保留最新的流量，调用方需持有写锁
+func (s *Store) resize(size int) {
+	flows := s.newest(s.count)
+	if len(flows) > size {
+		for _, f := range flows[size:] {
+			delete(s.index, f.ID)
+		}
+		flows = flows[:size]
+	}
+
+	s.ring = make([]*Flow, size)
+	s.count = len(flows)
+	for i, f := range flows {
+		s.ring[len(flows)-1-i] = f
+	}
+	s.head = s.count % size
+}
+
+// newest 返回最新的 n 条流量，按时间倒序，调用方需持有锁
+func (s *Store) newest(n int) []*Flow {
+	if n > s.count {
+		n = s.count
+	}
+	flows := make([]*Flow, 0, n)
+	for i := 1; i <= n; i++ {
+		flows = append(flows, s.ring[(s.head-i+len(s.ring))%len(s.ring)])
+	}
+	return flows
+}
+
+func (s *Store) IsEnabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled
+}
+
+func (s *Store) bodyLimit() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxBodySize
+}
+
+// add 保存一条完成的流量
+func (s *Store) add(f *Flow) {
+	s.captured.Add(1)
+	s.insert(f)
+
+	s.mu.RLock()
+	onFinish := s.onFinish
+	s.mu.RUnlock()
+	if onFinish != nil {
+		onFinish(f)
+	}
+}
+
+// SetOnFinish 设置流量记录完成时的回调，例如推送到实时日志，回调中不能修改 Flow
+func (s *Store) SetOnFinish(fn func(*Flow)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onFinish = fn
+}
+
+// insert 把流量放入环形缓冲区，并写入磁盘
+func (s *Store) insert(f *Flow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.ring[s.head]; old != nil {
+		delete(s.index, old.ID)
+	}
+	s.ring[s.head] = f
+	s.index[f.ID] = f
+	s.head = (s.head + 1) % len(s.ring)
+	if s.count < len(s.ring) {
+		s.count++
+	}
+	if s.disk != nil {
+		s.disk.enqueue(f)
+	}
+}
+
+// Get 按 ID 获取流量，内存中没有时从磁盘读取，返回的 Flow 不能修改
+func (s *Store) Get(id string) (*Flow, bool) {
+	s.mu.RLock()
+	f, ok := s.index[id]
+	disk := s.disk
+	s.mu.RUnlock()
+
+	if !ok && disk != nil {
+		return disk.get(id)
+	}
+	return f, ok
+}
+
+// Query 查询流量概要，按时间倒序
+// 内存和磁盘中都有的流量只返回一次，尚未写入磁盘的流量也能查到
+func (s *Store) Query(q Query) []Summary {
+	s.mu.RLock()
+	flows := s.newest(s.count)
+	disk := s.disk
+	s.mu.RUnlock()
+
+	var matched []Summary
+	seen := make(map[string]bool, len(flows))
+	for _, f := range flows {
+		sum := f.Summary()
+		if q.Match(&sum) {
+			matched = append(matched, sum)
+			seen[sum.ID] = true
+		}
+	}
+	if disk != nil {
+		for _, sum := range disk.match(&q) {
+			if !seen[sum.ID] {
+				matched = append(matched, sum)
+			}
+		}
+	}
+	return q.page(matched)
+}
+
+// GetStats 获取捕获统计
+func (s *Store) GetStats() Stats {
+	s.mu.RLock()
+	stats := Stats{
+		Enabled:     s.enabled,
+		Flows:       s.count,
+		MaxFlows:    len(s.ring),
+		MaxBodySize: s.maxBodySize,
+		Captured:    s.captured.Load(),
+	}
+	disk := s.disk
+	s.mu.RUnlock()
+
+	if disk != nil {
+		storage := disk.stats()
+		stats.Storage = &storage
+	}
+	return stats
+}
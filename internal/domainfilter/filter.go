@@ -1,119 +1,192 @@
 package domainfilter
 
 import (
+	"fmt"
 	"log"
-	"strings"
 	"sync"
+
+	"sunnyproxy/pkg/config"
+)
+
+// 过滤模式
+const (
+	ModeAllowList = "allowlist" // 仅允许白名单中的域名
+	ModeAllowAll  = "allow_all" // 允许除黑名单外的所有域名
+)
+
+// 名单类型
+const (
+	ListAllow = "allow"
+	ListDeny  = "deny"
 )
 
 type DomainFilter struct {
-	enabled    bool
-	allowList  []string // 允许的域名/IP关键词
-	mu         sync.RWMutex
+	mu      sync.RWMutex
+	enabled bool
+	mode    string
+	allow   *Matcher
+	deny    *Matcher
+	file    string // 黑白名单持久化文件，为空则不持久化
+	stats   *statsTable
 }
 
-var (
-	filterInstance *DomainFilter
-	filterOnce     sync.Once
-)
+// TestResult 域名测试结果
+type TestResult struct {
+	Host         string `json:"host"`
+	Allowed      bool   `json:"allowed"`
+	Enabled      bool   `json:"enabled"`
+	Mode         string `json:"mode"`
+	MatchedAllow string `json:"matched_allow,omitempty"`
+	MatchedDeny  string `json:"matched_deny,omitempty"`
+}
+
+// New 根据配置创建域名过滤器
+func New(cfg config.DomainFilterConfig) (*DomainFilter, error) {
+	f := &DomainFilter{stats: newStatsTable()}
+	if err := f.Update(cfg); err != nil {
+		return nil, err
+	}
+	log.Printf("[DomainFilter] 域名过滤已加载，模式: %s，白名单 %d 条，黑名单 %d 条", f.mode, len(f.allow.patterns), len(f.deny.patterns))
+	return f, nil
+}
+
+// Update 重新应用配置，规则编译失败时保持原有状态不变
+// 持久化文件存在时，黑白名单以文件为准（通过 API 修改过）
+func (f *DomainFilter) Update(cfg config.DomainFilterConfig) error {
+	commit, err := f.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (f *DomainFilter) Prepare(cfg config.DomainFilterConfig) (func(), error) {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = ModeAllowList
+	}
+	if mode != ModeAllowList && mode != ModeAllowAll {
+		return nil, fmt.Errorf("未知的域名过滤模式: %s", cfg.Mode)
+	}
 
-func GetFilter() *DomainFilter {
-	filterOnce.Do(func() {
-		filterInstance = &DomainFilter{
-			enabled: true,
-			allowList: []string{
-				// IP地址
-				"114.66.51.98",
-				"110.42.67.153",
-
-				// suraimu
-				"suraimu.com",
-
-				// qmai相关
-				"qmai",
-
-				// 微信相关
-				"weixin.qq.com",
-				"wx.qq.com",
-				"wechat.com",
-				"weixin",
-				"weixinbridge",
-				"servicewechat",
-				"wechatpay.cn",    // 微信支付
-				"qlogo.cn",        // 微信头像
-				"qpic.cn",         // 微信图片
-				"wxpay.cn",        // 微信支付
-				"weixinmp.com",    // 微信公众平台
-				"wechatapp.com",   // 微信小程序
-
-				// QQ相关（微信依赖）
-				"qq.com",
-
-				// 微信支付
-				"tenpay.com",
-				"mch.weixin",
-
-				// 苹果推送（iOS需要）
-				"apple.com",
-				"icloud.com",
-				"mzstatic.com",
-
-				// 闲鱼相关
-				"idle.taobao.com",
-				"2.taobao.com",
-				"idlefish",
-				"xianyu",
-
-				// 阿里相关
-				"alibaba.com",
-				"alibabacloud.com",
-				"aliyun.com",
-				"aliyuncs.com",
-				"alicdn.com",
-				"taobao.com",
-				"tmall.com",
-				"alipay.com",
-				"alipayobjects.com",
-				"mmstat.com",
-				"tbcdn.cn",
-				"aliapp.org",
-				"amap.com",
-				"uc.cn",
-				"ucweb.com",
-			},
+	allowList, denyList := cfg.Allow, cfg.Deny
+	overridden := false // 配置中的名单与文件不同，被文件覆盖
+	if cfg.File != "" {
+		saved, err := loadLists(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 失败: %v", cfg.File, err)
 		}
-		log.Printf("[DomainFilter] 域名白名单已启用，允许 %d 个规则", len(filterInstance.allowList))
-	})
-	return filterInstance
+		if saved != nil {
+			allowList, denyList = saved.Allow, saved.Deny
+			overridden = !sameList(cfg.Allow, saved.Allow) || !sameList(cfg.Deny, saved.Deny)
+		}
+	}
+
+	allow, err := NewMatcher(allowList)
+	if err != nil {
+		return nil, fmt.Errorf("白名单: %v", err)
+	}
+	deny, err := NewMatcher(denyList)
+	if err != nil {
+		return nil, fmt.Errorf("黑名单: %v", err)
+	}
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// 启动时不提示，重新加载时配置文件中修改的名单不会生效，需要告知
+		if overridden && f.allow != nil {
+			log.Printf("[DomainFilter] 警告: 配置文件中的 allow/deny 与 %s 不同，以 %s 为准；需要改用配置中的名单时删除该文件后重新加载", cfg.File, cfg.File)
+		}
+		f.enabled = cfg.Enabled
+		f.mode = mode
+		f.allow = allow
+		f.deny = deny
+		f.file = cfg.File
+	}, nil
 }
 
-// IsAllowed 检查域名是否允许访问
+// sameList 比较两个名单，不区分顺序
+func sameList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int, len(a))
+	for _, p := range a {
+		count[p]++
+	}
+	for _, p := range b {
+		if count[p] == 0 {
+			return false
+		}
+		count[p]--
+	}
+	return true
+}
+
+// IsAllowed 检查域名是否允许访问，黑名单优先于白名单
 func (f *DomainFilter) IsAllowed(host string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
 	if !f.enabled {
 		return true
 	}
 
+	if _, denied := f.deny.Match(host); denied {
+		return false
+	}
+	if f.mode == ModeAllowAll {
+		return true
+	}
+	_, allowed := f.allow.Match(host)
+	return allowed
+}
+
+// CheckConnect 检查 CONNECT 目标域名并记录统计
+func (f *DomainFilter) CheckConnect(host string) bool {
+	allowed := f.IsAllowed(host)
+	f.stats.record(NormalizeHost(host), allowed)
+	return allowed
+}
+
+// Test 检查域名的过滤结果及命中的规则，不计入统计
+func (f *DomainFilter) Test(host string) TestResult {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	// 移除端口号
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		// 检查是否是IPv6
-		if !strings.Contains(host, "[") {
-			host = host[:idx]
-		}
+	result := TestResult{
+		Host:    NormalizeHost(host),
+		Enabled: f.enabled,
+		Mode:    f.mode,
 	}
+	result.MatchedAllow, _ = f.allow.Match(host)
+	matchedDeny, denied := f.deny.Match(host)
+	result.MatchedDeny = matchedDeny
 
-	host = strings.ToLower(host)
-
-	// 检查是否匹配白名单
-	for _, allowed := range f.allowList {
-		if strings.Contains(host, strings.ToLower(allowed)) {
-			return true
-		}
+	switch {
+	case !f.enabled:
+		result.Allowed = true
+	case denied:
+		result.Allowed = false
+	case f.mode == ModeAllowAll:
+		result.Allowed = true
+	default:
+		result.Allowed = result.MatchedAllow != ""
 	}
+	return result
+}
+
+// GetStats 获取各域名的 CONNECT 统计
+func (f *DomainFilter) GetStats() []DomainStats {
+	return f.stats.snapshot()
+}
 
-	return false
+// ResetStats 清空统计
+func (f *DomainFilter) ResetStats() {
+	f.stats.reset()
 }
 
 // SetEnabled 启用/禁用过滤
@@ -130,18 +203,112 @@ func (f *DomainFilter) IsEnabled() bool {
 	return f.enabled
 }
 
-// AddAllowed 添加允许的域名
-func (f *DomainFilter) AddAllowed(domain string) {
+// GetMode 获取过滤模式
+func (f *DomainFilter) GetMode() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mode
+}
+
+// AddAllowed 添加允许的域名规则
+func (f *DomainFilter) AddAllowed(domain string) error {
+	return f.AddPattern(ListAllow, domain)
+}
+
+// AddPattern 向白名单或黑名单添加规则并持久化，已存在时忽略
+func (f *DomainFilter) AddPattern(list, pattern string) error {
+	if err := ValidatePattern(pattern); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	target, err := f.listPtr(list)
+	if err != nil {
+		return err
+	}
+	patterns := (*target).Patterns()
+	for _, p := range patterns {
+		if p == pattern {
+			return nil
+		}
+	}
+	m, err := NewMatcher(append(patterns, pattern))
+	if err != nil {
+		return err
+	}
+	*target = m
+	log.Printf("[DomainFilter] 添加%s规则: %s", listName(list), pattern)
+	return f.save()
+}
+
+// RemovePattern 从白名单或黑名单移除规则并持久化，返回规则是否存在
+func (f *DomainFilter) RemovePattern(list, pattern string) (bool, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.allowList = append(f.allowList, domain)
+
+	target, err := f.listPtr(list)
+	if err != nil {
+		return false, err
+	}
+	patterns := (*target).Patterns()
+	remaining := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if p != pattern {
+			remaining = append(remaining, p)
+		}
+	}
+	if len(remaining) == len(patterns) {
+		return false, nil
+	}
+	m, err := NewMatcher(remaining)
+	if err != nil {
+		return false, err
+	}
+	*target = m
+	log.Printf("[DomainFilter] 移除%s规则: %s", listName(list), pattern)
+	return true, f.save()
+}
+
+func (f *DomainFilter) listPtr(list string) (**Matcher, error) {
+	switch list {
+	case ListAllow:
+		return &f.allow, nil
+	case ListDeny:
+		return &f.deny, nil
+	}
+	return nil, fmt.Errorf("未知的名单类型: %s", list)
+}
+
+func listName(list string) string {
+	if list == ListDeny {
+		return "黑名单"
+	}
+	return "白名单"
+}
+
+// save 持久化黑白名单，调用方需持有写锁
+func (f *DomainFilter) save() error {
+	if f.file == "" {
+		return nil
+	}
+	return saveLists(f.file, lists{
+		Allow: f.allow.Patterns(),
+		Deny:  f.deny.Patterns(),
+	})
 }
 
 // GetAllowList 获取白名单
 func (f *DomainFilter) GetAllowList() []string {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	result := make([]string, len(f.allowList))
-	copy(result, f.allowList)
-	return result
+	return f.allow.Patterns()
+}
+
+// GetDenyList 获取黑名单
+func (f *DomainFilter) GetDenyList() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.deny.Patterns()
 }
@@ -0,0 +1,142 @@
+package domainfilter
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// 域名匹配规则:
+//
+//	example.com       精确匹配
+//	.example.com      后缀匹配，匹配 example.com 及其所有子域名
+//	*.example.com     通配符匹配，* 匹配任意字符（含 .），? 匹配单个字符
+//	regex:^api\d+\.   正则匹配
+const regexPrefix = "regex:"
+
+type patternKind int
+
+const (
+	kindExact patternKind = iota
+	kindSuffix
+	kindWildcard
+	kindRegex
+)
+
+type pattern struct {
+	raw   string
+	kind  patternKind
+	value string
+	re    *regexp.Regexp
+}
+
+func compilePattern(raw string) (pattern, error) {
+	p := pattern{raw: raw}
+	value := strings.TrimSpace(raw)
+	if value == "" {
+		return p, fmt.Errorf("域名规则不能为空")
+	}
+
+	switch {
+	case strings.HasPrefix(value, regexPrefix):
+		re, err := regexp.Compile(value[len(regexPrefix):])
+		if err != nil {
+			return p, fmt.Errorf("正则 %q 无效: %v", raw, err)
+		}
+		p.kind = kindRegex
+		p.re = re
+	case strings.ContainsAny(value, "*?"):
+		value = strings.ToLower(value)
+		if _, err := path.Match(value, ""); err != nil {
+			return p, fmt.Errorf("通配符 %q 无效: %v", raw, err)
+		}
+		p.kind = kindWildcard
+		p.value = value
+	case strings.HasPrefix(value, "."):
+		p.kind = kindSuffix
+		p.value = strings.ToLower(value)
+	default:
+		p.kind = kindExact
+		p.value = strings.ToLower(value)
+	}
+	return p, nil
+}
+
+func (p pattern) match(host string) bool {
+	switch p.kind {
+	case kindExact:
+		return host == p.value
+	case kindSuffix:
+		return host == p.value[1:] || strings.HasSuffix(host, p.value)
+	case kindWildcard:
+		// path.Match 中 * 不跨越 /，域名中不含 /，因此可以匹配多级子域名
+		ok, _ := path.Match(p.value, host)
+		return ok
+	case kindRegex:
+		return p.re.MatchString(host)
+	}
+	return false
+}
+
+// Matcher 是一组域名规则，命中任意一条即视为匹配
+type Matcher struct {
+	patterns []pattern
+}
+
+// NewMatcher 编译一组域名规则
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{patterns: make([]pattern, 0, len(patterns))}
+	for _, raw := range patterns {
+		p, err := compilePattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return m, nil
+}
+
+// Match 检查主机名是否命中任意规则，返回命中的规则原文
+func (m *Matcher) Match(host string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	host = NormalizeHost(host)
+	for _, p := range m.patterns {
+		if p.match(host) {
+			return p.raw, true
+		}
+	}
+	return "", false
+}
+
+// Patterns 返回规则原文列表
+func (m *Matcher) Patterns() []string {
+	if m == nil {
+		return []string{}
+	}
+	result := make([]string, len(m.patterns))
+	for i, p := range m.patterns {
+		result[i] = p.raw
+	}
+	return result
+}
+
+// ValidatePattern 校验单条域名规则
+func ValidatePattern(raw string) error {
+	_, err := compilePattern(raw)
+	return err
+}
+
+// NormalizeHost 去掉端口号、IPv6 方括号和末尾的点，并转为小写
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
@@ -0,0 +1,83 @@
+package domainfilter
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxStatsHosts 最多统计的域名数量，超出后淘汰最久未出现的域名
+const maxStatsHosts = 2000
+
+// DomainStats 单个域名的 CONNECT 统计
+type DomainStats struct {
+	Host     string    `json:"host"`
+	Allowed  int64     `json:"allowed"`
+	Rejected int64     `json:"rejected"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type statsTable struct {
+	mu    sync.Mutex
+	hosts map[string]*DomainStats
+}
+
+func newStatsTable() *statsTable {
+	return &statsTable{hosts: make(map[string]*DomainStats)}
+}
+
+func (t *statsTable) record(host string, allowed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.hosts[host]
+	if !ok {
+		if len(t.hosts) >= maxStatsHosts {
+			t.evictOldest()
+		}
+		s = &DomainStats{Host: host}
+		t.hosts[host] = s
+	}
+	if allowed {
+		s.Allowed++
+	} else {
+		s.Rejected++
+	}
+	s.LastSeen = time.Now()
+}
+
+func (t *statsTable) evictOldest() {
+	var oldest string
+	var oldestTime time.Time
+	for host, s := range t.hosts {
+		if oldest == "" || s.LastSeen.Before(oldestTime) {
+			oldest = host
+			oldestTime = s.LastSeen
+		}
+	}
+	delete(t.hosts, oldest)
+}
+
+// snapshot 返回统计副本，按拒绝次数、允许次数降序
+func (t *statsTable) snapshot() []DomainStats {
+	t.mu.Lock()
+	result := make([]DomainStats, 0, len(t.hosts))
+	for _, s := range t.hosts {
+		result = append(result, *s)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Rejected != result[j].Rejected {
+			return result[i].Rejected > result[j].Rejected
+		}
+		return result[i].Allowed > result[j].Allowed
+	})
+	return result
+}
+
+func (t *statsTable) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hosts = make(map[string]*DomainStats)
+}
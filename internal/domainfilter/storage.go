@@ -0,0 +1,45 @@
+package domainfilter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// lists 是持久化到磁盘的黑白名单
+type lists struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// loadLists 从文件读取黑白名单，文件不存在时返回 nil
+func loadLists(path string) (*lists, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var l lists
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func saveLists(path string, l lists) error {
+	dir := filepath.Dir(path)
+	if dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
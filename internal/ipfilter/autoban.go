@@ -0,0 +1,222 @@
+package ipfilter
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"sunnyproxy/pkg/config"
+)
+
+// 违规类型
+const (
+	OffenceAuthFailed   = "auth_failed"   // 代理认证失败
+	OffenceDomainDenied = "domain_denied" // 访问被域名过滤拒绝
+	OffenceRateLimited  = "rate_limited"  // 触发限流
+)
+
+// Offender 被自动封禁过的 IP，再犯时按封禁次数延长封禁时间
+type Offender struct {
+	IP      string    `json:"ip"`
+	Bans    int       `json:"bans"`
+	LastBan time.Time `json:"last_ban"`
+}
+
+// Ban 当前生效的自动封禁
+type Ban struct {
+	Entry
+	Bans int `json:"bans"` // 累计封禁次数
+}
+
+// banPolicy 由 auto_ban 配置解析出的封禁策略
+type banPolicy struct {
+	enabled     bool
+	window      time.Duration
+	thresholds  map[string]int
+	banTime     time.Duration
+	escalation  float64
+	maxBanTime  time.Duration
+	forgetAfter time.Duration
+}
+
+func parseBanPolicy(cfg config.AutoBanConfig) (banPolicy, error) {
+	if cfg.AuthFailures < 0 || cfg.DeniedDomains < 0 || cfg.RateLimited < 0 {
+		return banPolicy{}, fmt.Errorf("阈值不能为负数")
+	}
+	if cfg.Enabled && (cfg.Window <= 0 || cfg.BanTime <= 0) {
+		return banPolicy{}, fmt.Errorf("window 和 ban_time 必须大于 0")
+	}
+	if cfg.MaxBanTime < 0 || cfg.ForgetAfter < 0 {
+		return banPolicy{}, fmt.Errorf("max_ban_time/forget_after 不能为负数")
+	}
+	escalation := cfg.Escalation
+	if escalation < 1 {
+		escalation = 1
+	}
+	return banPolicy{
+		enabled: cfg.Enabled,
+		window:  cfg.Window,
+		thresholds: map[string]int{
+			OffenceAuthFailed:   cfg.AuthFailures,
+			OffenceDomainDenied: cfg.DeniedDomains,
+			OffenceRateLimited:  cfg.RateLimited,
+		},
+		banTime:     cfg.BanTime,
+		escalation:  escalation,
+		maxBanTime:  cfg.MaxBanTime,
+		forgetAfter: cfg.ForgetAfter,
+	}, nil
+}
+
+// duration 第 n 次封禁的时长: ban_time * escalation^(n-1)，不超过 max_ban_time
+func (b *banPolicy) duration(n int) time.Duration {
+	d := float64(b.banTime) * math.Pow(b.escalation, float64(n-1))
+	if b.maxBanTime > 0 && d > float64(b.maxBanTime) {
+		return b.maxBanTime
+	}
+	if d > float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// SetOnBan 设置自动封禁回调，用于推送到实时日志
+func (f *Filter) SetOnBan(fn func(ip, offence string, bans int, d time.Duration)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onBan = fn
+}
+
+// Report 记录一次违规，统计窗口内次数达到阈值时自动封禁，返回是否触发了封禁
+// allow_cidrs、内网地址和手动加入白名单的 IP 不会被封禁
+func (f *Filter) Report(ip, offence string) bool {
+	addr, ok := parseAddr(ip)
+	if !ok {
+		return false
+	}
+	key := addr.String()
+	now := time.Now()
+
+	f.mu.Lock()
+	p := f.policy
+	threshold := p.ban.thresholds[offence]
+	if !f.enabled || !p.ban.enabled || threshold <= 0 ||
+		p.allowCIDRs.Contains(addr) || (p.allowPrivate && privateNets.Contains(addr)) ||
+		f.pinned(key, now) {
+		f.mu.Unlock()
+		return false
+	}
+
+	byType := f.offences[key]
+	if byType == nil {
+		byType = make(map[string][]time.Time)
+		f.offences[key] = byType
+	}
+	times := append(trimBefore(byType[offence], now.Add(-p.ban.window)), now)
+	if len(times) < threshold {
+		byType[offence] = times
+		f.mu.Unlock()
+		return false
+	}
+	delete(f.offences, key)
+
+	o := f.offenders[key]
+	if o == nil || (p.ban.forgetAfter > 0 && now.Sub(o.LastBan) > p.ban.forgetAfter) {
+		o = &Offender{IP: key}
+		f.offenders[key] = o
+	}
+	o.Bans++
+	o.LastBan = now
+	bans := o.Bans
+	d := p.ban.duration(bans)
+
+	f.blacklist[key] = &Entry{IP: key, Ban: offence, Added: now, Expires: expiresAt(now, d)}
+	delete(f.whitelist, key)
+	onBan := f.onBan
+	f.mu.Unlock()
+
+	log.Printf("[IPFilter] 自动封禁IP: %s，原因: %s，第 %d 次，时长 %v", key, offence, bans, d)
+	if onBan != nil {
+		onBan(key, offence, bans, d)
+	}
+	go f.save()
+	return true
+}
+
+// trimBefore 去掉早于 cutoff 的时间，times 按时间递增
+func trimBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(cutoff) })
+	return times[i:]
+}
+
+// purgeOffences 清理统计窗口外的违规记录和不再计为再犯的封禁历史，调用方需持有写锁
+func (f *Filter) purgeOffences(now time.Time) {
+	b := f.policy.ban
+	for ip, byType := range f.offences {
+		for offence, times := range byType {
+			if times = trimBefore(times, now.Add(-b.window)); len(times) == 0 {
+				delete(byType, offence)
+			} else {
+				byType[offence] = times
+			}
+		}
+		if len(byType) == 0 {
+			delete(f.offences, ip)
+		}
+	}
+	if b.forgetAfter > 0 {
+		for ip, o := range f.offenders {
+			if now.Sub(o.LastBan) > b.forgetAfter {
+				delete(f.offenders, ip)
+			}
+		}
+	}
+}
+
+// Bans 获取当前生效的自动封禁，按IP排序
+func (f *Filter) Bans() []Ban {
+	now := time.Now()
+	f.mu.RLock()
+	bans := []Ban{}
+	for ip, e := range f.blacklist {
+		if e.Ban == "" || e.expired(now) {
+			continue
+		}
+		b := Ban{Entry: *e}
+		if o := f.offenders[ip]; o != nil {
+			b.Bans = o.Bans
+		}
+		bans = append(bans, b)
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Unban 解除自动封禁并清除该 IP 的违规和封禁历史，再次违规时按首次封禁处理
+// 返回IP是否处于封禁中或有封禁历史
+func (f *Filter) Unban(ip string) (bool, error) {
+	if addr, ok := parseAddr(ip); ok {
+		ip = addr.String()
+	}
+
+	f.mu.Lock()
+	e, found := f.blacklist[ip]
+	found = found && e.Ban != ""
+	if found {
+		delete(f.blacklist, ip)
+		delete(f.blockedCount, ip)
+	}
+	_, known := f.offenders[ip]
+	delete(f.offences, ip)
+	delete(f.offenders, ip)
+	f.mu.Unlock()
+
+	if !found && !known {
+		return false, nil
+	}
+	return true, f.save()
+}
@@ -1,32 +1,117 @@
 package ipfilter
 
 import (
-	"bufio"
 	"fmt"
 	"log"
 	"net"
-	"os"
+	"net/netip"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/oschwald/geoip2-golang"
+	"sunnyproxy/internal/netutil"
+	"sunnyproxy/pkg/config"
 )
 
-type Filter struct {
-	enabled       bool
-	whitelist     map[string]bool // 白名单IP（已验证的中国IP）
-	blacklist     map[string]bool // 黑名单IP（已验证的境外IP）
-	blockedCount  map[string]int  // 拦截次数统计
-	mu            sync.RWMutex
-	whitelistFile string
-	geoDB         *geoip2.Reader
-}
-
-var (
-	filterInstance *Filter
-	filterOnce     sync.Once
+// 判定原因
+const (
+	ReasonDisabled   = "disabled"    // 过滤未启用
+	ReasonInvalid    = "invalid"     // 无法解析的地址
+	ReasonDenyCIDR   = "deny_cidr"   // 命中 deny_cidrs
+	ReasonAllowCIDR  = "allow_cidr"  // 命中 allow_cidrs
+	ReasonPrivate    = "private"     // 内网/回环地址
+	ReasonWhitelist  = "whitelist"   // 命中白名单缓存
+	ReasonBlacklist  = "blacklist"   // 命中黑名单缓存
+	ReasonBanned     = "banned"      // 被自动封禁
+	ReasonCountry    = "country"     // 按 GeoIP 国家判定
+	ReasonGeoIPError = "geoip_error" // GeoIP 查询失败，按 fail_open 判定
 )
 
+// Entry 黑白名单中的一条记录
+type Entry struct {
+	IP      string     `json:"ip"`
+	Country string     `json:"country,omitempty"`
+	Manual  bool       `json:"manual,omitempty"` // 手动添加，不会因国家策略变化被清除
+	Ban     string     `json:"ban,omitempty"`    // 自动封禁的违规类型
+	Added   time.Time  `json:"added"`
+	Expires *time.Time `json:"expires,omitempty"` // 为空表示永不过期
+}
+
+func (e *Entry) expired(now time.Time) bool {
+	return e.Expires != nil && now.After(*e.Expires)
+}
+
+func expiresAt(now time.Time, ttl time.Duration) *time.Time {
+	t := now.Add(ttl)
+	return &t
+}
+
+// Verdict 一次 IP 检查的结果
+type Verdict struct {
+	IP      string `json:"ip"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+	Country string `json:"country,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// policy 由配置解析出的判定策略，更新时整体替换
+type policy struct {
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	failOpen       bool
+	allowCIDRs     *netutil.CIDRList
+	denyCIDRs      *netutil.CIDRList
+	allowPrivate   bool
+	whitelistTTL   time.Duration
+	blacklistTTL   time.Duration
+	ban            banPolicy
+}
+
+// countryAllowed 拒绝列表优先；允许列表为空时放行所有未被拒绝的国家
+func (p *policy) countryAllowed(code string) bool {
+	if p.denyCountries[code] {
+		return false
+	}
+	return len(p.allowCountries) == 0 || p.allowCountries[code]
+}
+
+// sameCountries 检查国家策略是否相同，不同时之前缓存的判定结果需要作废
+func (p *policy) sameCountries(o *policy) bool {
+	return p.failOpen == o.failOpen &&
+		sameSet(p.allowCountries, o.allowCountries) &&
+		sameSet(p.denyCountries, o.denyCountries)
+}
+
+func sameSet(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+type Filter struct {
+	enabled      bool
+	policy       *policy
+	whitelist    map[string]*Entry                 // 白名单IP（GeoIP 判定放行或手动添加）
+	blacklist    map[string]*Entry                 // 黑名单IP（GeoIP 判定拒绝）
+	blockedCount map[string]int                    // 拦截次数统计
+	offences     map[string]map[string][]time.Time // 统计窗口内各类违规的时间
+	offenders    map[string]*Offender              // 被自动封禁过的 IP
+	onBan        func(ip, offence string, bans int, d time.Duration)
+	mu           sync.RWMutex
+	stateFile    string
+	saveMu       sync.Mutex
+	geoDB        *geoip2.Reader
+}
+
 // GeoIP 数据库路径搜索顺序
 var geoDBPaths = []string{
 	"GeoLite2-Country.mmdb",
@@ -35,7 +120,7 @@ var geoDBPaths = []string{
 	"/var/lib/GeoIP/GeoLite2-Country.mmdb",
 }
 
-// 私有/内网IP段（始终允许）
+// 私有/内网IP段（allow_private 时放行）
 var privateRanges = []string{
 	"10.0.0.0/8",
 	"172.16.0.0/12",
@@ -47,84 +132,144 @@ var privateRanges = []string{
 	"fe80::/10",
 }
 
-var privateNets []*net.IPNet
+var privateNets, _ = netutil.ParseCIDRList(privateRanges)
+
+// New 根据配置创建 IP 过滤器，加载 GeoIP 数据库和持久化的黑白名单
+// geoip_db 和 state_file 只在启动时读取
+func New(cfg config.IPFilterConfig) (*Filter, error) {
+	f := &Filter{
+		whitelist:    make(map[string]*Entry),
+		blacklist:    make(map[string]*Entry),
+		blockedCount: make(map[string]int),
+		offences:     make(map[string]map[string][]time.Time),
+		offenders:    make(map[string]*Offender),
+		stateFile:    cfg.StateFile,
+	}
+	if err := f.Update(cfg); err != nil {
+		return nil, err
+	}
 
-func init() {
-	for _, cidr := range privateRanges {
-		_, ipNet, err := net.ParseCIDR(cidr)
-		if err == nil {
-			privateNets = append(privateNets, ipNet)
-		}
+	f.loadGeoDB(cfg.GeoIPDB)
+	f.loadState()
+	log.Printf("[IPFilter] 白名单 %d 个IP，黑名单 %d 个IP", len(f.whitelist), len(f.blacklist))
+	return f, nil
+}
+
+// Update 重新应用配置，配置无效时保持原有状态不变
+// 国家策略变化时清除 GeoIP 判定的缓存，手动添加的记录保留
+func (f *Filter) Update(cfg config.IPFilterConfig) error {
+	commit, err := f.Prepare(cfg)
+	if err != nil {
+		return err
 	}
+	commit()
+	return nil
 }
 
-func GetFilter() *Filter {
-	filterOnce.Do(func() {
-		filterInstance = &Filter{
-			enabled:       true,
-			whitelist:     make(map[string]bool),
-			blacklist:     make(map[string]bool),
-			blockedCount:  make(map[string]int),
-			whitelistFile: "whitelist.txt",
-		}
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (f *Filter) Prepare(cfg config.IPFilterConfig) (func(), error) {
+	p, err := parsePolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-		// 加载 GeoIP 数据库
-		filterInstance.loadGeoDB()
-		filterInstance.loadWhitelist()
-		log.Printf("[IPFilter] IP过滤器已启动，仅允许中国IP访问")
-		log.Printf("[IPFilter] 白名单已加载 %d 个IP", len(filterInstance.whitelist))
-	})
-	return filterInstance
-}
+	return func() {
+		f.mu.Lock()
+		changed := f.policy != nil && !f.policy.sameCountries(p)
+		f.enabled = cfg.Enabled
+		f.policy = p
+		if changed {
+			f.dropAutoEntries()
+		}
+		f.mu.Unlock()
 
-// loadGeoDB 加载 GeoIP 数据库
-func (f *Filter) loadGeoDB() {
-	for _, path := range geoDBPaths {
-		db, err := geoip2.Open(path)
-		if err == nil {
-			f.geoDB = db
-			log.Printf("[IPFilter] GeoIP 数据库已加载: %s", path)
-			return
+		if changed {
+			log.Printf("[IPFilter] 国家策略已变更，已清除自动判定的黑白名单")
+			go f.save()
 		}
-	}
-	log.Printf("[IPFilter] 警告: 未找到 GeoIP 数据库，将仅使用白名单/黑名单过滤")
+	}, nil
 }
 
-// loadWhitelist 从文件加载白名单
-func (f *Filter) loadWhitelist() {
-	file, err := os.Open(f.whitelistFile)
+func parsePolicy(cfg config.IPFilterConfig) (*policy, error) {
+	allowCountries, err := parseCountries(cfg.AllowedCountries)
 	if err != nil {
-		// 文件不存在，忽略
-		return
+		return nil, fmt.Errorf("allowed_countries: %v", err)
+	}
+	denyCountries, err := parseCountries(cfg.DeniedCountries)
+	if err != nil {
+		return nil, fmt.Errorf("denied_countries: %v", err)
+	}
+	allowCIDRs, err := netutil.ParseCIDRList(cfg.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %v", err)
+	}
+	denyCIDRs, err := netutil.ParseCIDRList(cfg.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %v", err)
+	}
+	if cfg.WhitelistTTL < 0 || cfg.BlacklistTTL < 0 {
+		return nil, fmt.Errorf("whitelist_ttl/blacklist_ttl 不能为负数")
+	}
+	ban, err := parseBanPolicy(cfg.AutoBan)
+	if err != nil {
+		return nil, fmt.Errorf("auto_ban: %v", err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		ip := strings.TrimSpace(scanner.Text())
-		if ip != "" && !strings.HasPrefix(ip, "#") {
-			f.whitelist[ip] = true
+	return &policy{
+		allowCountries: allowCountries,
+		denyCountries:  denyCountries,
+		failOpen:       cfg.FailOpen,
+		allowCIDRs:     allowCIDRs,
+		denyCIDRs:      denyCIDRs,
+		allowPrivate:   cfg.AllowPrivate,
+		whitelistTTL:   cfg.WhitelistTTL,
+		blacklistTTL:   cfg.BlacklistTTL,
+		ban:            ban,
+	}, nil
+}
+
+// parseCountries 解析 ISO 3166 两位国家代码，不区分大小写
+func parseCountries(codes []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("无效的国家代码 %q", code)
 		}
+		set[code] = true
 	}
+	return set, nil
 }
 
-// saveWhitelist 保存白名单到文件
-func (f *Filter) saveWhitelist() {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-
-	file, err := os.Create(f.whitelistFile)
-	if err != nil {
-		log.Printf("[IPFilter] 保存白名单失败: %v", err)
-		return
+// dropAutoEntries 清除 GeoIP 自动判定的记录，手动添加和自动封禁的记录保留，调用方需持有写锁
+func (f *Filter) dropAutoEntries() {
+	for ip, e := range f.whitelist {
+		if !e.Manual {
+			delete(f.whitelist, ip)
+		}
+	}
+	for ip, e := range f.blacklist {
+		if !e.Manual && e.Ban == "" {
+			delete(f.blacklist, ip)
+		}
 	}
-	defer file.Close()
+}
 
-	file.WriteString("# SunnyProxy IP Whitelist (已验证的中国IP)\n")
-	file.WriteString("# 自动生成，请勿手动编辑\n\n")
-	for ip := range f.whitelist {
-		file.WriteString(ip + "\n")
+// loadGeoDB 加载 GeoIP 数据库，配置了路径时只尝试该路径
+func (f *Filter) loadGeoDB(path string) {
+	paths := geoDBPaths
+	if path != "" {
+		paths = []string{path}
 	}
+	for _, path := range paths {
+		db, err := geoip2.Open(path)
+		if err == nil {
+			f.geoDB = db
+			log.Printf("[IPFilter] GeoIP 数据库已加载: %s", path)
+			return
+		}
+	}
+	log.Printf("[IPFilter] 警告: 未找到 GeoIP 数据库，将仅使用网段和黑白名单过滤")
 }
 
 func (f *Filter) SetEnabled(enabled bool) {
@@ -139,96 +284,206 @@ func (f *Filter) IsEnabled() bool {
 	return f.enabled
 }
 
-// isPrivateIP 检查是否是内网IP
-func isPrivateIP(ip net.IP) bool {
-	for _, ipNet := range privateNets {
-		if ipNet.Contains(ip) {
-			return true
-		}
+// parseAddr 解析IP地址（可能带端口）
+func parseAddr(ipStr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(ipStr)
+	if err != nil {
+		host = ipStr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
 	}
-	return false
+	return addr.Unmap(), true
 }
 
-// queryIPLocation 使用本地 GeoIP 数据库查询IP归属地
-func (f *Filter) queryIPLocation(ipStr string) (bool, error) {
+// queryCountry 使用本地 GeoIP 数据库查询IP所属国家
+func (f *Filter) queryCountry(addr netip.Addr) (string, error) {
 	if f.geoDB == nil {
-		return false, fmt.Errorf("GeoIP 数据库未加载")
-	}
-
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return false, fmt.Errorf("无效IP: %s", ipStr)
+		return "", fmt.Errorf("GeoIP 数据库未加载")
 	}
 
-	record, err := f.geoDB.Country(ip)
+	record, err := f.geoDB.Country(net.IP(addr.AsSlice()))
 	if err != nil {
-		return false, err
+		return "", err
 	}
-
-	return record.Country.IsoCode == "CN", nil
+	if record.Country.IsoCode == "" {
+		return "", fmt.Errorf("数据库中没有该IP的国家信息")
+	}
+	return record.Country.IsoCode, nil
 }
 
 // IsAllowed 检查IP是否允许访问
 func (f *Filter) IsAllowed(ipStr string) bool {
-	if !f.IsEnabled() {
-		return true
-	}
+	return f.Check(ipStr).Allowed
+}
 
-	// 解析IP地址（可能带端口）
-	host, _, err := net.SplitHostPort(ipStr)
-	if err != nil {
-		host = ipStr
+// Check 检查IP是否允许访问，GeoIP 判定结果按 TTL 缓存到黑白名单
+func (f *Filter) Check(ipStr string) Verdict {
+	addr, ok := parseAddr(ipStr)
+	if !ok {
+		if !f.IsEnabled() {
+			return Verdict{IP: ipStr, Allowed: true, Reason: ReasonDisabled}
+		}
+		return Verdict{IP: ipStr, Reason: ReasonInvalid}
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return false
+	v, p := f.evaluate(addr, true)
+	if v.Reason == ReasonCountry {
+		f.remember(v, p)
 	}
+	if !v.Allowed {
+		f.mu.Lock()
+		f.blockedCount[v.IP]++
+		f.mu.Unlock()
+	}
+	return v
+}
 
-	// 内网IP始终允许
-	if isPrivateIP(ip) {
-		return true
+// Lookup 查询IP当前的判定结果，不写入缓存，也不计入拦截统计
+func (f *Filter) Lookup(ipStr string) (Verdict, error) {
+	addr, ok := parseAddr(ipStr)
+	if !ok {
+		return Verdict{}, fmt.Errorf("无效的 IP %q", ipStr)
 	}
+	v, _ := f.evaluate(addr, true)
+	if v.Country == "" && v.Reason != ReasonGeoIPError {
+		// 被网段或名单提前判定时也补充国家信息，便于排查
+		v.Country, _ = f.queryCountry(addr)
+	}
+	return v, nil
+}
+
+// GeoIPLoaded 检查 GeoIP 数据库是否已加载
+func (f *Filter) GeoIPLoaded() bool {
+	return f.geoDB != nil
+}
+
+// evaluate 按 deny_cidrs > allow_cidrs > 内网 > 黑白名单 > GeoIP 的顺序判定
+func (f *Filter) evaluate(addr netip.Addr, useCache bool) (Verdict, *policy) {
+	v := Verdict{IP: addr.String()}
 
-	// 检查白名单（已验证的中国IP）
 	f.mu.RLock()
-	if f.whitelist[host] {
-		f.mu.RUnlock()
-		return true
-	}
-	// 检查黑名单（已验证的境外IP）
-	if f.blacklist[host] {
-		f.blockedCount[host]++
-		f.mu.RUnlock()
-		return false
+	enabled, p := f.enabled, f.policy
+	var cached *Entry
+	var cachedAllow bool
+	if useCache {
+		now := time.Now()
+		if e, ok := f.whitelist[v.IP]; ok && !e.expired(now) {
+			cached, cachedAllow = e, true
+		} else if e, ok := f.blacklist[v.IP]; ok && !e.expired(now) {
+			cached = e
+		}
 	}
 	f.mu.RUnlock()
 
-	// 新IP，使用 GeoIP 查询归属地
-	isChina, err := f.queryIPLocation(host)
+	switch {
+	case !enabled:
+		v.Allowed, v.Reason = true, ReasonDisabled
+		return v, p
+	case p.denyCIDRs.Contains(addr):
+		v.Reason = ReasonDenyCIDR
+		return v, p
+	case p.allowCIDRs.Contains(addr):
+		v.Allowed, v.Reason = true, ReasonAllowCIDR
+		return v, p
+	case p.allowPrivate && privateNets.Contains(addr):
+		v.Allowed, v.Reason = true, ReasonPrivate
+		return v, p
+	case cached != nil:
+		v.Allowed, v.Country = cachedAllow, cached.Country
+		switch {
+		case cachedAllow:
+			v.Reason = ReasonWhitelist
+		case cached.Ban != "":
+			v.Reason = ReasonBanned
+		default:
+			v.Reason = ReasonBlacklist
+		}
+		return v, p
+	}
+
+	country, err := f.queryCountry(addr)
 	if err != nil {
-		// GeoIP 查询失败，默认允许（避免误杀）
-		log.Printf("[IPFilter] 查询IP %s 失败: %v，默认允许", host, err)
-		return true
+		v.Allowed, v.Reason, v.Error = p.failOpen, ReasonGeoIPError, err.Error()
+		if f.geoDB != nil {
+			log.Printf("[IPFilter] 查询IP %s 失败: %v，fail_open=%v", v.IP, err, p.failOpen)
+		}
+		return v, p
 	}
+	v.Allowed, v.Reason, v.Country = p.countryAllowed(country), ReasonCountry, country
+	return v, p
+}
+
+// remember 缓存 GeoIP 判定结果，到期后重新查询，避免 IP 被重新分配后沿用旧结果
+func (f *Filter) remember(v Verdict, p *policy) {
+	now := time.Now()
+	e := &Entry{IP: v.IP, Country: v.Country, Added: now}
 
 	f.mu.Lock()
-	if isChina {
-		// 中国IP，加入白名单
-		f.whitelist[host] = true
+	if f.policy != p || f.pinned(v.IP, now) {
+		// 判定期间策略已更新或被手动添加/封禁，结果作废
 		f.mu.Unlock()
-		// 异步保存白名单
-		go f.saveWhitelist()
-		log.Printf("[IPFilter] 新增白名单IP: %s (中国)", host)
-		return true
+		return
+	}
+	if v.Allowed {
+		if p.whitelistTTL > 0 {
+			e.Expires = expiresAt(now, p.whitelistTTL)
+		}
+		f.whitelist[v.IP] = e
+		delete(f.blacklist, v.IP)
 	} else {
-		// 境外IP，加入黑名单
-		f.blacklist[host] = true
-		f.blockedCount[host] = 1
-		f.mu.Unlock()
-		log.Printf("[IPFilter] 拦截境外IP: %s", host)
-		return false
+		if p.blacklistTTL > 0 {
+			e.Expires = expiresAt(now, p.blacklistTTL)
+		}
+		f.blacklist[v.IP] = e
+		delete(f.whitelist, v.IP)
+	}
+	f.mu.Unlock()
+
+	if v.Allowed {
+		log.Printf("[IPFilter] 新增白名单IP: %s (%s)", v.IP, v.Country)
+	} else {
+		log.Printf("[IPFilter] 拦截IP: %s (%s)", v.IP, v.Country)
+	}
+	go f.save()
+}
+
+// pinned 检查IP是否有未过期的手动记录或封禁记录，这些记录不会被 GeoIP 判定结果覆盖，调用方需持有锁
+func (f *Filter) pinned(ip string, now time.Time) bool {
+	if e, ok := f.whitelist[ip]; ok && e.Manual && !e.expired(now) {
+		return true
+	}
+	e, ok := f.blacklist[ip]
+	return ok && (e.Manual || e.Ban != "") && !e.expired(now)
+}
+
+// PurgeExpired 清除已过期的黑白名单记录，返回清除的数量
+func (f *Filter) PurgeExpired() int {
+	now := time.Now()
+	removed := 0
+
+	f.mu.Lock()
+	for ip, e := range f.whitelist {
+		if e.expired(now) {
+			delete(f.whitelist, ip)
+			removed++
+		}
 	}
+	for ip, e := range f.blacklist {
+		if e.expired(now) {
+			delete(f.blacklist, ip)
+			delete(f.blockedCount, ip)
+			removed++
+		}
+	}
+	f.purgeOffences(now)
+	f.mu.Unlock()
+
+	if removed > 0 {
+		go f.save()
+	}
+	return removed
 }
 
 // Close 关闭 GeoIP 数据库
@@ -238,36 +493,111 @@ func (f *Filter) Close() {
 	}
 }
 
-// AddToWhitelist 手动添加IP到白名单
-func (f *Filter) AddToWhitelist(ip string) {
+// AddToWhitelist 手动添加IP到白名单，ttl 为 0 表示永不过期
+func (f *Filter) AddToWhitelist(ip string, ttl time.Duration) (Entry, error) {
+	return f.addManual(ip, ttl, true)
+}
+
+// AddToBlacklist 手动添加IP到黑名单，ttl 为 0 表示永不过期
+// 黑名单不影响 allow_cidrs 和内网地址
+func (f *Filter) AddToBlacklist(ip string, ttl time.Duration) (Entry, error) {
+	return f.addManual(ip, ttl, false)
+}
+
+func (f *Filter) addManual(ip string, ttl time.Duration, allow bool) (Entry, error) {
+	addr, ok := parseAddr(ip)
+	if !ok {
+		return Entry{}, fmt.Errorf("无效的 IP %q", ip)
+	}
+	if ttl < 0 {
+		return Entry{}, fmt.Errorf("ttl 不能为负数")
+	}
+	now := time.Now()
+	e := &Entry{IP: addr.String(), Manual: true, Added: now}
+	if ttl > 0 {
+		e.Expires = expiresAt(now, ttl)
+	}
+
 	f.mu.Lock()
-	f.whitelist[ip] = true
-	delete(f.blacklist, ip)
+	if allow {
+		f.whitelist[e.IP] = e
+		delete(f.blacklist, e.IP)
+	} else {
+		f.blacklist[e.IP] = e
+		delete(f.whitelist, e.IP)
+	}
 	f.mu.Unlock()
-	f.saveWhitelist()
-	log.Printf("[IPFilter] 手动添加白名单IP: %s", ip)
+
+	if allow {
+		log.Printf("[IPFilter] 手动添加白名单IP: %s", e.IP)
+	} else {
+		log.Printf("[IPFilter] 手动添加黑名单IP: %s", e.IP)
+	}
+	return *e, f.save()
 }
 
-// RemoveFromWhitelist 从白名单移除IP
-func (f *Filter) RemoveFromWhitelist(ip string) {
+// RemoveFromWhitelist 从白名单移除IP，返回IP是否在白名单中
+func (f *Filter) RemoveFromWhitelist(ip string) (bool, error) {
+	return f.remove(f.whitelist, ip)
+}
+
+// RemoveFromBlacklist 从黑名单移除IP，返回IP是否在黑名单中
+func (f *Filter) RemoveFromBlacklist(ip string) (bool, error) {
+	return f.remove(f.blacklist, ip)
+}
+
+func (f *Filter) remove(list map[string]*Entry, ip string) (bool, error) {
+	if addr, ok := parseAddr(ip); ok {
+		ip = addr.String()
+	}
 	f.mu.Lock()
-	delete(f.whitelist, ip)
+	_, found := list[ip]
+	delete(list, ip)
+	if found {
+		delete(f.blockedCount, ip)
+	}
 	f.mu.Unlock()
-	f.saveWhitelist()
+	if !found {
+		return false, nil
+	}
+	return true, f.save()
 }
 
-// GetWhitelist 获取白名单列表
+// GetWhitelist 获取白名单列表（不含已过期的记录）
 func (f *Filter) GetWhitelist() []string {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-
-	list := make([]string, 0, len(f.whitelist))
-	for ip := range f.whitelist {
-		list = append(list, ip)
+	entries := f.WhitelistEntries()
+	list := make([]string, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e.IP)
 	}
 	return list
 }
 
+// WhitelistEntries 获取白名单记录（不含已过期的记录），按IP排序
+func (f *Filter) WhitelistEntries() []Entry {
+	return f.entries(f.whitelist)
+}
+
+// BlacklistEntries 获取黑名单记录（不含已过期的记录），按IP排序
+func (f *Filter) BlacklistEntries() []Entry {
+	return f.entries(f.blacklist)
+}
+
+func (f *Filter) entries(list map[string]*Entry) []Entry {
+	now := time.Now()
+	f.mu.RLock()
+	result := make([]Entry, 0, len(list))
+	for _, e := range list {
+		if !e.expired(now) {
+			result = append(result, *e)
+		}
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].IP < result[j].IP })
+	return result
+}
+
 // GetBlockedIPs 获取被拦截的IP及次数
 func (f *Filter) GetBlockedIPs() map[string]int {
 	f.mu.RLock()
@@ -0,0 +1,148 @@
+package ipfilter
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// legacyWhitelistFile 旧版本只持久化白名单，每行一个IP
+const legacyWhitelistFile = "whitelist.txt"
+
+// state 持久化到 state_file 的黑白名单和封禁历史
+type state struct {
+	Whitelist []*Entry    `json:"whitelist"`
+	Blacklist []*Entry    `json:"blacklist"`
+	Offenders []*Offender `json:"offenders,omitempty"`
+}
+
+// loadState 加载持久化的黑白名单，跳过已过期的记录
+// state_file 不存在时尝试导入旧版 whitelist.txt，按 whitelist_ttl 设置过期时间，到期后重新校验
+func (f *Filter) loadState() {
+	if f.stateFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(f.stateFile)
+	if os.IsNotExist(err) {
+		f.importLegacyWhitelist()
+		return
+	}
+	if err != nil {
+		log.Printf("[IPFilter] 读取黑白名单失败: %v", err)
+		return
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		log.Printf("[IPFilter] 解析黑白名单失败: %v", err)
+		return
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range s.Whitelist {
+		if e != nil && e.IP != "" && !e.expired(now) {
+			f.whitelist[e.IP] = e
+		}
+	}
+	for _, e := range s.Blacklist {
+		if e != nil && e.IP != "" && !e.expired(now) {
+			f.blacklist[e.IP] = e
+		}
+	}
+	for _, o := range s.Offenders {
+		if o != nil && o.IP != "" {
+			f.offenders[o.IP] = o
+		}
+	}
+}
+
+func (f *Filter) importLegacyWhitelist() {
+	file, err := os.Open(legacyWhitelistFile)
+	if err != nil {
+		// 文件不存在，忽略
+		return
+	}
+	defer file.Close()
+
+	now := time.Now()
+	f.mu.Lock()
+	var expires *time.Time
+	if f.policy.whitelistTTL > 0 {
+		expires = expiresAt(now, f.policy.whitelistTTL)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if addr, ok := parseAddr(line); ok {
+			ip := addr.String()
+			f.whitelist[ip] = &Entry{IP: ip, Added: now, Expires: expires}
+		}
+	}
+	count := len(f.whitelist)
+	f.mu.Unlock()
+
+	if count > 0 {
+		log.Printf("[IPFilter] 已从 %s 导入 %d 个白名单IP", legacyWhitelistFile, count)
+		f.save()
+	}
+}
+
+// save 将黑白名单写入 state_file，先写临时文件再重命名
+func (f *Filter) save() error {
+	if f.stateFile == "" {
+		return nil
+	}
+
+	f.saveMu.Lock()
+	defer f.saveMu.Unlock()
+
+	f.mu.RLock()
+	s := state{
+		Whitelist: make([]*Entry, 0, len(f.whitelist)),
+		Blacklist: make([]*Entry, 0, len(f.blacklist)),
+	}
+	for _, e := range f.whitelist {
+		s.Whitelist = append(s.Whitelist, e)
+	}
+	for _, e := range f.blacklist {
+		s.Blacklist = append(s.Blacklist, e)
+	}
+	for _, o := range f.offenders {
+		s.Offenders = append(s.Offenders, o)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	f.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.stateFile), ".ipfilter-*.tmp")
+	if err != nil {
+		log.Printf("[IPFilter] 保存黑白名单失败: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		log.Printf("[IPFilter] 保存黑白名单失败: %v", err)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.stateFile); err != nil {
+		log.Printf("[IPFilter] 保存黑白名单失败: %v", err)
+		return err
+	}
+	return nil
+}
@@ -4,19 +4,41 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
 	"sunnyproxy/internal/rules"
+	"sunnyproxy/pkg/config"
 )
 
 type Broadcaster struct {
 	mu      sync.RWMutex
-	clients map[*websocket.Conn]bool
+	clients map[*websocket.Conn]*client
 	console bool
+	ws      config.WebSocketConfig
+
+	// 已断开连接的丢弃数，加上当前连接的即为累计丢弃数
+	droppedClosed   atomic.Uint64
+	slowDisconnects atomic.Uint64
+}
+
+// BroadcastStats 实时日志推送统计
+type BroadcastStats struct {
+	Clients         []ClientStats `json:"clients"`
+	Dropped         uint64        `json:"dropped"`          // 累计丢弃的消息，包括已断开的连接
+	SlowDisconnects uint64        `json:"slow_disconnects"` // 因跟不上推送速度被断开的连接数
+	Policy          string        `json:"policy"`
+	QueueSize       int           `json:"queue_size"`
 }
 
+// 没有 operator 权限的连接看到的凭据值
+const redactedValue = "[redacted]"
+
 var (
 	instance *Broadcaster
 	once     sync.Once
@@ -25,8 +47,9 @@ var (
 func GetBroadcaster() *Broadcaster {
 	once.Do(func() {
 		instance = &Broadcaster{
-			clients: make(map[*websocket.Conn]bool),
+			clients: make(map[*websocket.Conn]*client),
 			console: true,
+			ws:      config.Default().Logging.WebSocket,
 		}
 	})
 	return instance
@@ -38,41 +61,177 @@ func (b *Broadcaster) SetConsoleOutput(enabled bool) {
 	b.console = enabled
 }
 
-func (b *Broadcaster) AddClient(conn *websocket.Conn) {
+// SetWebSocketConfig 设置实时日志推送的队列和心跳，queue_size 只对之后建立的连接生效
+func (b *Broadcaster) SetWebSocketConfig(cfg config.WebSocketConfig) error {
+	commit, err := b.PrepareWebSocketConfig(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareWebSocketConfig 检查实时日志推送的配置，返回的函数应用配置，不会失败
+func (b *Broadcaster) PrepareWebSocketConfig(cfg config.WebSocketConfig) (func(), error) {
+	if err := validateWebSocketConfig(cfg); err != nil {
+		return nil, err
+	}
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.ws = cfg
+	}, nil
+}
+
+func (b *Broadcaster) wsConfig() config.WebSocketConfig {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.ws
+}
+
+// AddClient 添加连接并启动写协程，客户端需要在 ping 之后及时回复 pong，否则连接被断开
+// redact 为 true 时推送给该连接的日志去掉 Token 等凭据的值
+// 调用方需要持续读取连接（处理订阅消息和 pong）
+func (b *Broadcaster) AddClient(conn *websocket.Conn, redact bool) {
+	b.mu.Lock()
+	cfg := b.ws
+	c := newClient(conn, cfg.QueueSize)
+	c.redact = redact
+	b.clients[conn] = c
+	b.mu.Unlock()
+
+	conn.SetReadDeadline(time.Now().Add(pongTimeout(cfg)))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout(b.wsConfig())))
+	})
+	go b.writeLoop(c)
+}
+
+// Subscribe 设置连接的订阅条件，可以随时修改，条件全部为空时接收全部日志
+func (b *Broadcaster) Subscribe(conn *websocket.Conn, s Subscription) error {
+	f, err := newFilter(s)
+	if err != nil {
+		return err
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.clients[conn] = true
+	c, ok := b.clients[conn]
+	if !ok {
+		return fmt.Errorf("连接已关闭")
+	}
+	c.filter = f
+	return nil
+}
+
+// Send 只向指定连接发送一条消息，例如订阅的回复
+func (b *Broadcaster) Send(conn *websocket.Conn, entry rules.LogEntry) error {
+	b.mu.RLock()
+	c, ok := b.clients[conn]
+	b.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("连接已关闭")
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// 回复不受 disconnect 策略影响，队列满时丢弃最旧的日志
+	if !c.enqueue(data, PolicyDropOldest) {
+		return fmt.Errorf("连接已关闭")
+	}
+	return nil
 }
 
+// RemoveClient 移除并关闭连接，可以重复调用
 func (b *Broadcaster) RemoveClient(conn *websocket.Conn) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	c, ok := b.clients[conn]
 	delete(b.clients, conn)
-	conn.Close()
+	b.mu.Unlock()
+
+	if !ok {
+		conn.Close()
+		return
+	}
+	c.close()
+	b.droppedClosed.Add(c.dropped.Load())
+}
+
+// Stats 返回实时日志推送统计
+func (b *Broadcaster) Stats() BroadcastStats {
+	b.mu.RLock()
+	stats := BroadcastStats{
+		Clients:   make([]ClientStats, 0, len(b.clients)),
+		Policy:    b.ws.Policy,
+		QueueSize: b.ws.QueueSize,
+	}
+	for _, c := range b.clients {
+		cs := c.stats()
+		cs.Filtered = c.filter != nil
+		stats.Clients = append(stats.Clients, cs)
+		stats.Dropped += cs.Dropped
+	}
+	b.mu.RUnlock()
+
+	stats.Dropped += b.droppedClosed.Load()
+	stats.SlowDisconnects = b.slowDisconnects.Load()
+	sort.Slice(stats.Clients, func(i, j int) bool {
+		return stats.Clients[i].ConnectedAt.Before(stats.Clients[j].ConnectedAt)
+	})
+	return stats
 }
 
+// Broadcast 把日志放进各连接的发送队列，不等待发送完成
 func (b *Broadcaster) Broadcast(entry rules.LogEntry) {
 	b.mu.RLock()
 	consoleEnabled := b.console
-	clients := make([]*websocket.Conn, 0, len(b.clients))
-	for c := range b.clients {
-		clients = append(clients, c)
+	policy := b.ws.Policy
+	type target struct {
+		c      *client
+		filter *filter
+	}
+	targets := make([]target, 0, len(b.clients))
+	for _, c := range b.clients {
+		targets = append(targets, target{c, c.filter})
 	}
 	b.mu.RUnlock()
 
 	if consoleEnabled {
 		b.printToConsole(entry)
 	}
+	if len(targets) == 0 {
+		return
+	}
 
 	data, err := json.Marshal(entry)
 	if err != nil {
 		return
 	}
+	// 去掉凭据的版本只在有需要的连接时生成
+	var redacted []byte
 
-	for _, client := range clients {
-		err := client.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			b.RemoveClient(client)
+	for _, t := range targets {
+		if !t.filter.match(&entry) {
+			continue
+		}
+		msg := data
+		if t.c.redact && len(entry.Headers) > 0 {
+			if redacted == nil {
+				if redacted, err = json.Marshal(redactEntry(entry)); err != nil {
+					continue
+				}
+			}
+			msg = redacted
+		}
+		if !t.c.enqueue(msg, policy) && policy == PolicyDisconnect {
+			select {
+			case <-t.c.done:
+				// 已经关闭
+			default:
+				b.slowDisconnects.Add(1)
+				log.Printf("[Logs] 实时日志客户端 %s 跟不上推送速度，已断开", t.c.conn.RemoteAddr())
+				b.RemoveClient(t.c.conn)
+			}
 		}
 	}
 }
@@ -88,37 +247,59 @@ func (b *Broadcaster) printToConsole(entry rules.LogEntry) {
 		}
 		log.Printf("[%s] %s %s %s%s\n", timestamp, entry.Type, entry.Method, entry.URL, modified)
 	case "response":
-		log.Printf("[%s] %s %d %s\n", timestamp, entry.Type, entry.StatusCode, entry.URL)
+		if entry.Error != "" {
+			log.Printf("[%s] %s FAILED %s - %s\n", timestamp, entry.Type, entry.URL, entry.Error)
+		} else {
+			log.Printf("[%s] %s %d %s\n", timestamp, entry.Type, entry.StatusCode, entry.URL)
+		}
 	case "error":
 		log.Printf("[%s] ERROR: %s - %s\n", timestamp, entry.URL, entry.Error)
 	case "token":
 		log.Printf("[%s] TOKEN EXTRACTED: %s\n", timestamp, entry.URL)
+	case "rule_disabled":
+		log.Printf("[%s] RULE DISABLED: %s - %s\n", timestamp, entry.URL, entry.Message)
+	case "auth_failed":
+		log.Printf("[%s] AUTH FAILED: %s -> %s - %s\n", timestamp, entry.ClientIP, entry.URL, entry.Message)
+	case "rate_limited":
+		log.Printf("[%s] RATE LIMITED: %s - %s\n", timestamp, entry.ClientIP, entry.Message)
+	case "breakpoint":
+		log.Printf("[%s] BREAKPOINT %s: %s %s\n", timestamp, entry.Message, entry.Method, entry.URL)
+	case "ipfilter":
+		if entry.ClientIP != "" {
+			log.Printf("[%s] IPFILTER: %s %s\n", timestamp, entry.ClientIP, entry.Message)
+		} else {
+			log.Printf("[%s] IPFILTER: %s\n", timestamp, entry.Message)
+		}
 	default:
 		log.Printf("[%s] %s: %s\n", timestamp, entry.Type, entry.URL)
 	}
 }
 
-func (b *Broadcaster) LogRequest(method, url string, modified bool, appliedRules []string) {
+func (b *Broadcaster) LogRequest(method, url, clientIP string, modified bool, appliedRules []string) {
 	entry := rules.LogEntry{
 		ID:           fmt.Sprintf("%d", time.Now().UnixNano()),
 		Timestamp:    time.Now(),
 		Type:         "request",
 		Method:       method,
 		URL:          url,
+		ClientIP:     clientIP,
 		Modified:     modified,
 		RulesApplied: appliedRules,
 	}
 	b.Broadcast(entry)
 }
 
-func (b *Broadcaster) LogResponse(method, url string, statusCode int) {
+func (b *Broadcaster) LogResponse(method, url, clientIP string, statusCode int, appliedRules []string, errMsg string) {
 	entry := rules.LogEntry{
-		ID:         fmt.Sprintf("%d", time.Now().UnixNano()),
-		Timestamp:  time.Now(),
-		Type:       "response",
-		Method:     method,
-		URL:        url,
-		StatusCode: statusCode,
+		ID:           fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp:    time.Now(),
+		Type:         "response",
+		Method:       method,
+		URL:          url,
+		ClientIP:     clientIP,
+		StatusCode:   statusCode,
+		RulesApplied: appliedRules,
+		Error:        errMsg,
 	}
 	b.Broadcast(entry)
 }
@@ -144,3 +325,109 @@ func (b *Broadcaster) LogToken(name, value, url string) {
 	}
 	b.Broadcast(entry)
 }
+
+// LogRuleDisabled 推送规则被自动禁用的事件
+func (b *Broadcaster) LogRuleDisabled(rule rules.Rule, reason string) {
+	entry := rules.LogEntry{
+		ID:           fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp:    time.Now(),
+		Type:         "rule_disabled",
+		URL:          rule.Name,
+		RulesApplied: []string{rule.ID},
+		Message:      reason,
+	}
+	b.Broadcast(entry)
+}
+
+// LogAuthFailure 推送代理认证失败事件
+func (b *Broadcaster) LogAuthFailure(clientIP, username, target string) {
+	entry := rules.LogEntry{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp: time.Now(),
+		Type:      "auth_failed",
+		URL:       target,
+		ClientIP:  clientIP,
+		Message:   fmt.Sprintf("代理认证失败，用户: %q", safeUsername(username)),
+	}
+	b.Broadcast(entry)
+}
+
+// 日志中用户名的最大长度（字符数）
+const maxLoggedUsername = 32
+
+// safeUsername 认证失败时的用户名由客户端任意填写，只保留字母、数字和 ._-@，其余字符替换为 ?，过长时截断
+func safeUsername(name string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range name {
+		if n == maxLoggedUsername {
+			sb.WriteString("...")
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-@", r) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('?')
+		}
+		n++
+	}
+	return sb.String()
+}
+
+// LogRateLimited 推送限流拒绝事件，reason 为 requests 或 connections
+func (b *Broadcaster) LogRateLimited(clientIP, user, reason string) {
+	msg := "请求速率超限"
+	if reason == "connections" {
+		msg = "并发连接数超限"
+	}
+	if user != "" {
+		msg += fmt.Sprintf("，用户: %q", safeUsername(user))
+	}
+	entry := rules.LogEntry{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp: time.Now(),
+		Type:      "rate_limited",
+		ClientIP:  clientIP,
+		Message:   msg,
+	}
+	b.Broadcast(entry)
+}
+
+// LogIPFilter 推送 IP 过滤的变更事件，ip 为空表示针对整个过滤器
+func (b *Broadcaster) LogIPFilter(ip, message string) {
+	entry := rules.LogEntry{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp: time.Now(),
+		Type:      "ipfilter",
+		ClientIP:  ip,
+		Message:   message,
+	}
+	b.Broadcast(entry)
+}
+
+// redactEntry 去掉日志中的头部值（Token 日志的 Token 值），只保留名称
+func redactEntry(entry rules.LogEntry) rules.LogEntry {
+	headers := make(map[string]string, len(entry.Headers))
+	for name := range entry.Headers {
+		headers[name] = redactedValue
+	}
+	entry.Headers = headers
+	return entry
+}
+
+// LogBreakpoint 推送断点事件，message 为 paused、continue、abort、mock、timeout 或 cancelled
+// 只带断点 ID，头部和消息体可能包含凭据，由 operator 通过 GET /api/breakpoints/{id} 查看
+func (b *Broadcaster) LogBreakpoint(id, ruleID, clientIP, method, url, message string) {
+	entry := rules.LogEntry{
+		ID:           fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp:    time.Now(),
+		Type:         "breakpoint",
+		Method:       method,
+		URL:          url,
+		ClientIP:     clientIP,
+		Message:      message,
+		RulesApplied: []string{"breakpoint:" + ruleID},
+		Data:         map[string]string{"id": id},
+	}
+	b.Broadcast(entry)
+}
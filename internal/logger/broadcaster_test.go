@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafeUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "alice", "alice"},
+		{"allowed punctuation", "ops.team-1_a@example.com", "ops.team-1_a@example.com"},
+		{"unicode letters", "张三", "张三"},
+		{"html", "<img src=x onerror=alert(1)>", "?img?src?x?onerror?alert?1??"},
+		{"quotes", `a"b'c`, "a?b?c"},
+		{"control characters", "a\x1b[31mb\r\n", "a??31mb??"},
+		{"truncated", strings.Repeat("a", 40), strings.Repeat("a", maxLoggedUsername) + "..."},
+		{"exactly max", strings.Repeat("a", maxLoggedUsername), strings.Repeat("a", maxLoggedUsername)},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := safeUsername(tt.in)
+			if got != tt.want {
+				t.Errorf("safeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if strings.ContainsAny(got, `<>&"'`) {
+				t.Errorf("safeUsername(%q) = %q contains HTML special characters", tt.in, got)
+			}
+		})
+	}
+}
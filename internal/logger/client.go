@@ -0,0 +1,155 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"sunnyproxy/pkg/config"
+)
+
+// 客户端跟不上推送速度时的处理方式
+const (
+	PolicyDropOldest = "drop_oldest" // 丢弃队列中最旧的消息
+	PolicyDisconnect = "disconnect"  // 断开连接，客户端重连后从最新的日志开始接收
+)
+
+// validateWebSocketConfig 检查实时日志推送的配置
+func validateWebSocketConfig(cfg config.WebSocketConfig) error {
+	if cfg.QueueSize <= 0 {
+		return fmt.Errorf("websocket.queue_size 必须大于 0")
+	}
+	if cfg.Policy != PolicyDropOldest && cfg.Policy != PolicyDisconnect {
+		return fmt.Errorf("websocket.policy 必须是 %s 或 %s", PolicyDropOldest, PolicyDisconnect)
+	}
+	if cfg.WriteTimeout <= 0 {
+		return fmt.Errorf("websocket.write_timeout 必须大于 0")
+	}
+	if cfg.PingInterval <= 0 {
+		return fmt.Errorf("websocket.ping_interval 必须大于 0")
+	}
+	return nil
+}
+
+// client 一个实时日志连接
+// 广播只把消息放进队列，由单独的写协程发送，慢客户端不会阻塞代理请求
+type client struct {
+	conn        *websocket.Conn
+	filter      *filter // nil 表示接收全部日志，由 Broadcaster.mu 保护
+	redact      bool    // 推送前去掉凭据的值
+	queue       chan []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+	connectedAt time.Time
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// ClientStats 一个实时日志连接的统计
+type ClientStats struct {
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Queued      int       `json:"queued"`
+	QueueSize   int       `json:"queue_size"`
+	Sent        uint64    `json:"sent"`
+	Dropped     uint64    `json:"dropped"`
+	Filtered    bool      `json:"filtered"` // 设置了订阅条件
+	Redacted    bool      `json:"redacted"` // 不推送凭据的值（viewer）
+}
+
+func newClient(conn *websocket.Conn, queueSize int) *client {
+	return &client{
+		conn:        conn,
+		queue:       make(chan []byte, queueSize),
+		done:        make(chan struct{}),
+		connectedAt: time.Now(),
+	}
+}
+
+// enqueue 把消息放进发送队列，队列已满时按 policy 处理
+// 返回 false 表示连接已关闭或需要断开
+func (c *client) enqueue(data []byte, policy string) bool {
+	for {
+		select {
+		case <-c.done:
+			return false
+		default:
+		}
+		select {
+		case c.queue <- data:
+			return true
+		default:
+		}
+
+		if policy == PolicyDisconnect {
+			c.dropped.Add(1)
+			return false
+		}
+		// 丢弃最旧的一条后重试，写协程可能同时取走了消息，那样就不需要丢弃
+		select {
+		case <-c.queue:
+			c.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// close 通知写协程退出并关闭连接，可以重复调用
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *client) stats() ClientStats {
+	return ClientStats{
+		RemoteAddr:  c.conn.RemoteAddr().String(),
+		ConnectedAt: c.connectedAt,
+		Queued:      len(c.queue),
+		QueueSize:   cap(c.queue),
+		Sent:        c.sent.Load(),
+		Dropped:     c.dropped.Load(),
+		Redacted:    c.redact,
+	}
+}
+
+// writeLoop 发送队列中的消息并定时发送 ping，写入失败或超时时断开
+func (b *Broadcaster) writeLoop(c *client) {
+	defer b.RemoveClient(c.conn)
+
+	cfg := b.wsConfig()
+	ping := time.NewTimer(cfg.PingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case data := <-c.queue:
+			cfg = b.wsConfig()
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+			c.sent.Add(1)
+
+		case <-ping.C:
+			cfg = b.wsConfig()
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			ping.Reset(cfg.PingInterval)
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// pongTimeout 收到 pong 的最长等待时间，超时后读取失败，连接被断开
+func pongTimeout(cfg config.WebSocketConfig) time.Duration {
+	return 2*cfg.PingInterval + cfg.WriteTimeout
+}
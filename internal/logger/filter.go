@@ -0,0 +1,179 @@
+package logger
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/internal/netutil"
+	"sunnyproxy/internal/rules"
+)
+
+// Subscription 实时日志客户端的订阅条件，空字段表示不限制，各条件同时满足才推送
+type Subscription struct {
+	Host   string   `json:"host,omitempty"`   // 域名规则，格式同 domain_filter，例如 .example.com
+	Method string   `json:"method,omitempty"` // 请求方法
+	Status string   `json:"status,omitempty"` // 200、4xx 或 400-499，设置后只推送带状态码的日志
+	Client string   `json:"client,omitempty"` // 客户端 IP 或网段，设置后只推送带客户端 IP 的日志
+	Types  []string `json:"types,omitempty"`  // 日志类型，例如 request、response、error、breakpoint
+	Rule   string   `json:"rule,omitempty"`   // 命中的规则 ID，也匹配 breakpoint:ID 这样带前缀的记录
+	Text   string   `json:"text,omitempty"`   // 在 URL、方法、客户端 IP、消息和错误中查找，不区分大小写
+}
+
+// filter 解析后的订阅条件
+type filter struct {
+	host      *domainfilter.Matcher
+	method    string
+	statusMin int
+	statusMax int
+	client    *netutil.CIDRList
+	types     map[string]bool
+	rule      string
+	text      string
+}
+
+// newFilter 解析订阅条件，条件全部为空时返回 nil（接收全部日志）
+func newFilter(s Subscription) (*filter, error) {
+	f := &filter{
+		method: strings.ToUpper(strings.TrimSpace(s.Method)),
+		rule:   strings.TrimSpace(s.Rule),
+		text:   strings.ToLower(strings.TrimSpace(s.Text)),
+	}
+	empty := f.method == "" && f.rule == "" && f.text == ""
+	var err error
+
+	if host := strings.TrimSpace(s.Host); host != "" {
+		if f.host, err = domainfilter.NewMatcher([]string{host}); err != nil {
+			return nil, fmt.Errorf("host: %v", err)
+		}
+		empty = false
+	}
+	if client := strings.TrimSpace(s.Client); client != "" {
+		if f.client, err = netutil.ParseCIDRList([]string{client}); err != nil {
+			return nil, fmt.Errorf("client: %v", err)
+		}
+		empty = false
+	}
+	if status := strings.ToLower(strings.TrimSpace(s.Status)); status != "" {
+		if f.statusMin, f.statusMax, err = parseStatusRange(status); err != nil {
+			return nil, fmt.Errorf("status: %v", err)
+		}
+		empty = false
+	}
+	for _, t := range s.Types {
+		if t = strings.TrimSpace(t); t != "" {
+			if f.types == nil {
+				f.types = make(map[string]bool)
+			}
+			f.types[t] = true
+			empty = false
+		}
+	}
+
+	if empty {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// parseStatusRange 解析 200、4xx 或 400-499
+func parseStatusRange(s string) (int, int, error) {
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		min := int(s[0]-'0') * 100
+		return min, min + 99, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil || min < 100 || min > 999 {
+		return 0, 0, fmt.Errorf("无效的状态码 %q", s)
+	}
+	max := min
+	if isRange {
+		max, err = strconv.Atoi(strings.TrimSpace(hi))
+		if err != nil || max < min || max > 999 {
+			return 0, 0, fmt.Errorf("无效的状态码范围 %q", s)
+		}
+	}
+	return min, max, nil
+}
+
+// match 检查日志是否满足订阅条件，nil 表示不过滤
+func (f *filter) match(e *rules.LogEntry) bool {
+	if f == nil {
+		return true
+	}
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	if f.method != "" && e.Method != f.method {
+		return false
+	}
+	if f.statusMin > 0 && (e.StatusCode < f.statusMin || e.StatusCode > f.statusMax) {
+		return false
+	}
+	if f.host != nil {
+		host := entryHost(e.URL)
+		if host == "" {
+			return false
+		}
+		if _, ok := f.host.Match(host); !ok {
+			return false
+		}
+	}
+	if f.client != nil {
+		addr, err := netutil.ParseAddr(e.ClientIP)
+		if err != nil || !f.client.Contains(addr) {
+			return false
+		}
+	}
+	if f.rule != "" && !matchRule(e.RulesApplied, f.rule) {
+		return false
+	}
+	if f.text != "" {
+		found := false
+		for _, s := range []string{e.URL, e.Method, e.ClientIP, e.Message, e.Error} {
+			if strings.Contains(strings.ToLower(s), f.text) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// entryHost 从日志的 URL 中取出域名，URL 也可能是 CONNECT 的 host:port
+func entryHost(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return ""
+		}
+		return domainfilter.NormalizeHost(u.Host)
+	}
+	if strings.ContainsAny(raw, "/ ") {
+		// 不是地址，例如规则名称
+		return ""
+	}
+	return domainfilter.NormalizeHost(raw)
+}
+
+// matchRule 检查命中的规则中是否有 id，断点等记录带有类型前缀，例如 breakpoint:ID
+func matchRule(applied []string, id string) bool {
+	for _, v := range applied {
+		if v == id {
+			return true
+		}
+		if _, suffix, ok := strings.Cut(v, ":"); ok && suffix == id {
+			return true
+		}
+	}
+	return false
+}
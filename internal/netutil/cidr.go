@@ -0,0 +1,131 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// CIDRList 是一组 IP 或网段，支持 IPv4 和 IPv6
+// 单个 IP 视为 /32 或 /128；"*" 匹配所有地址
+type CIDRList struct {
+	prefixes []netip.Prefix
+	any      bool
+	raw      []string
+}
+
+// ParseCIDRList 解析 IP/网段列表，例如 "10.0.0.0/8"、"192.168.1.10"、"2001:db8::/32"
+func ParseCIDRList(entries []string) (*CIDRList, error) {
+	l := &CIDRList{raw: append([]string(nil), entries...)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			l.any = true
+			continue
+		}
+		p, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		l.prefixes = append(l.prefixes, p)
+	}
+	return l, nil
+}
+
+// ParsePrefix 解析单个 IP 或网段
+func ParsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("无效的网段 %q", entry)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("无效的 IP %q", entry)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Contains 检查 IP 是否在列表中，IPv4 映射的 IPv6 地址按 IPv4 处理；列表为 nil 时返回 false
+func (l *CIDRList) Contains(addr netip.Addr) bool {
+	if l == nil || !addr.IsValid() {
+		return false
+	}
+	if l.any {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range l.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty 检查列表是否为空
+func (l *CIDRList) Empty() bool {
+	return l == nil || (!l.any && len(l.prefixes) == 0)
+}
+
+// Entries 返回原始配置项
+func (l *CIDRList) Entries() []string {
+	if l == nil {
+		return nil
+	}
+	return append([]string(nil), l.raw...)
+}
+
+// ParseAddr 解析 IP 或 "IP:端口"（含 "[IPv6]:端口"）
+func ParseAddr(s string) (netip.Addr, error) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	// 去掉 IPv6 zone 之外的方括号
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// ClientAddr 返回请求的真实客户端 IP
+// 只有直连地址属于受信任代理时才读取 X-Forwarded-For，从右往左跳过受信任代理，第一个不受信任的地址即客户端
+func ClientAddr(r *http.Request, trusted *CIDRList) netip.Addr {
+	remote, err := ParseAddr(r.RemoteAddr)
+	if err != nil || !trusted.Contains(remote) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := ParseAddr(hops[i])
+		if err != nil {
+			// 格式错误的条目可能是客户端伪造的，不再继续往左信任
+			break
+		}
+		client = addr
+		if !trusted.Contains(addr) {
+			break
+		}
+	}
+	return client
+}
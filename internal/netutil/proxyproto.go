@@ -0,0 +1,287 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"sunnyproxy/pkg/config"
+)
+
+// PROXY protocol v2 的固定签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// v1 头最长 107 字节（含 CRLF）
+	proxyV1MaxLen = 107
+	// 同时等待解析 PROXY 头的连接数上限，超过后 Accept 暂停
+	proxyPendingLimit = 1024
+)
+
+// ProxyProtocol 在负载均衡器后面部署时解析 PROXY protocol v1/v2 头，把连接的地址换成真实客户端地址
+// 只信任来自 trusted_cidrs 的连接；受信任的连接没有 PROXY 头时（例如健康检查）按原地址处理
+type ProxyProtocol struct {
+	trusted *CIDRList
+	timeout time.Duration
+}
+
+// NewProxyProtocol 根据配置创建 PROXY protocol 解析器，未启用时返回 nil
+func NewProxyProtocol(cfg config.ProxyProtocolConfig) (*ProxyProtocol, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	trusted, err := ParseCIDRList(cfg.TrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_cidrs: %v", err)
+	}
+	if trusted.Empty() {
+		// 信任所有地址会让任何人都能伪造客户端 IP，必须显式配置（可以写 "*"）
+		return nil, fmt.Errorf("trusted_cidrs 不能为空")
+	}
+	timeout := cfg.HeaderTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &ProxyProtocol{trusted: trusted, timeout: timeout}, nil
+}
+
+// Listener 包装监听器，p 为 nil 时原样返回
+// PROXY 头在后台读取，慢速或恶意的连接不会阻塞其他连接的 Accept
+func (p *ProxyProtocol) Listener(l net.Listener) net.Listener {
+	if p == nil {
+		return l
+	}
+	pl := &proxyListener{
+		Listener: l,
+		p:        p,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		pending:  make(chan struct{}, proxyPendingLimit),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+type proxyListener struct {
+	net.Listener
+	p       *ProxyProtocol
+	conns   chan net.Conn
+	done    chan struct{}
+	pending chan struct{}
+	err     error
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+
+		l.pending <- struct{}{}
+		go func() {
+			defer func() { <-l.pending }()
+			c, err := l.p.wrap(conn)
+			if err != nil {
+				// 负载均衡器的 TCP 健康检查会直接断开，不记录
+				if err != io.EOF {
+					log.Printf("[ProxyProtocol] %s: %v", conn.RemoteAddr(), err)
+				}
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- c:
+			case <-l.done:
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// proxyConn 读取过 PROXY 头的连接，缓冲区中剩余的数据仍需从 r 读取
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// wrap 来自受信任地址的连接读取 PROXY 头，其他连接原样返回
+func (p *ProxyProtocol) wrap(conn net.Conn) (net.Conn, error) {
+	peer, err := ParseAddr(conn.RemoteAddr().String())
+	if err != nil || !p.trusted.Contains(peer) {
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	c := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var src, dst net.Addr
+	switch first[0] {
+	case 'P':
+		src, dst, err = readProxyV1(c.r)
+	case '\r':
+		src, dst, err = readProxyV2(c.r)
+	default:
+		// 没有 PROXY 头
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src != nil {
+		c.remote, c.local = src, dst
+	}
+	return c, nil
+}
+
+// readProxyV1 解析文本格式: "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"，UNKNOWN 时返回 nil 地址
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+		// 以 P 开头的普通请求（如 POST、PUT）
+		return nil, nil, nil
+	}
+
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("读取 PROXY v1 头失败: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY v1 头过长或格式错误")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("PROXY v1 头格式错误: %q", line)
+	}
+	src, err := parseAddrPort(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseAddrPort(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	// 两个地址都要符合声明的地址族；TCP6 中的 IPv4 映射地址与 v2 一样按 IPv4 处理
+	tcp4 := fields[1] == "TCP4"
+	if src.Addr().Is4() != tcp4 || dst.Addr().Is4() != tcp4 {
+		return nil, nil, fmt.Errorf("PROXY v1 地址族不匹配: %q", line)
+	}
+	return net.TCPAddrFromAddrPort(unmapAddrPort(src)), net.TCPAddrFromAddrPort(unmapAddrPort(dst)), nil
+}
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func parseAddrPort(ip, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("PROXY 头中的 IP 无效: %q", ip)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("PROXY 头中的端口无效: %q", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(n)), nil
+}
+
+// readProxyV2 解析二进制格式，LOCAL 命令和非 TCP 地址族返回 nil 地址，TLV 扩展直接跳过
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header, err := r.Peek(16)
+	if err != nil || !bytes.Equal(header[:12], proxyV2Signature) {
+		// 不是 PROXY v2 头，交给上层按普通数据处理
+		return nil, nil, nil
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("不支持的 PROXY v2 版本: %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if _, err := r.Discard(16); err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("读取 PROXY v2 头失败: %v", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL，负载均衡器自己的连接（如健康检查）
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("不支持的 PROXY v2 命令: %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, fmt.Errorf("PROXY v2 地址长度不足")
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : ipLen*2])
+	srcPort := binary.BigEndian.Uint16(payload[ipLen*2:])
+	dstPort := binary.BigEndian.Uint16(payload[ipLen*2+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP.Unmap(), srcPort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP.Unmap(), dstPort)), nil
+}
@@ -0,0 +1,142 @@
+package netutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		src     string // 为空表示不替换地址
+		dst     string
+		wantErr bool
+		rest    string // 头之后留在缓冲区中的数据
+	}{
+		{name: "tcp4", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nGET /", src: "1.2.3.4:1234", dst: "5.6.7.8:80", rest: "GET /"},
+		{name: "tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", src: "[2001:db8::1]:1234", dst: "[2001:db8::2]:443"},
+		{name: "unknown", input: "PROXY UNKNOWN\r\nGET /", rest: "GET /"},
+		{name: "unknown with addresses", input: "PROXY UNKNOWN 1.2.3.4 5.6.7.8 1234 80\r\n"},
+		{name: "not a proxy header", input: "POST / HTTP/1.1\r\n", rest: "POST / HTTP/1.1\r\n"},
+		{name: "short non-header", input: "PUT", rest: "PUT"},
+		{name: "truncated", input: "PROXY TCP4 1.2.3.4 5.6.7.8 12", wantErr: true},
+		{name: "missing CR", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\n", wantErr: true},
+		{name: "oversized", input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "missing field", input: "PROXY TCP4 1.2.3.4 5.6.7.8 1234\r\n", wantErr: true},
+		{name: "unknown protocol", input: "PROXY UDP4 1.2.3.4 5.6.7.8 1234 80\r\n", wantErr: true},
+		{name: "invalid ip", input: "PROXY TCP4 1.2.3 5.6.7.8 1234 80\r\n", wantErr: true},
+		{name: "invalid port", input: "PROXY TCP4 1.2.3.4 5.6.7.8 65536 80\r\n", wantErr: true},
+		{name: "family mismatch", input: "PROXY TCP4 2001:db8::1 5.6.7.8 1234 80\r\n", wantErr: true},
+		{name: "dst family mismatch", input: "PROXY TCP4 1.2.3.4 2001:db8::2 1234 80\r\n", wantErr: true},
+		{name: "tcp6 with ipv4 dst", input: "PROXY TCP6 2001:db8::1 5.6.7.8 1234 80\r\n", wantErr: true},
+		{name: "tcp4 with mapped address", input: "PROXY TCP4 ::ffff:1.2.3.4 5.6.7.8 1234 80\r\n", wantErr: true},
+		{name: "tcp6 mapped addresses", input: "PROXY TCP6 ::ffff:1.2.3.4 ::ffff:5.6.7.8 1234 80\r\n", src: "1.2.3.4:1234", dst: "5.6.7.8:80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			src, dst, err := readProxyV1(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got src=%v dst=%v", src, dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkAddrs(t, src, dst, tt.src, tt.dst)
+			rest, _ := io.ReadAll(r)
+			if string(rest) != tt.rest {
+				t.Errorf("remaining data = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+// proxyV2Header 构造 PROXY v2 头，length 为负数时按 payload 长度填写
+func proxyV2Header(verCmd, family byte, length int, payload []byte) []byte {
+	if length < 0 {
+		length = len(payload)
+	}
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(length))
+	return append(h, payload...)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	ipv4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0xd2, 0x00, 0x50}
+	ipv6 := make([]byte, 36)
+	ipv6[0], ipv6[1], ipv6[15] = 0x20, 0x01, 1
+	ipv6[16], ipv6[17], ipv6[31] = 0x20, 0x01, 2
+	binary.BigEndian.PutUint16(ipv6[32:], 1234)
+	binary.BigEndian.PutUint16(ipv6[34:], 443)
+	withTLV := append(append([]byte(nil), ipv4...), 0x01, 0x00, 0x02, 'h', '2')
+
+	tests := []struct {
+		name    string
+		input   []byte
+		src     string
+		dst     string
+		wantErr bool
+		rest    string
+	}{
+		{name: "tcp4", input: append(proxyV2Header(0x21, 0x11, -1, ipv4), "GET /"...), src: "1.2.3.4:1234", dst: "5.6.7.8:80", rest: "GET /"},
+		{name: "tcp6", input: proxyV2Header(0x21, 0x21, -1, ipv6), src: "[2001::1]:1234", dst: "[2001::2]:443"},
+		{name: "tlv skipped", input: append(proxyV2Header(0x21, 0x11, -1, withTLV), "x"...), src: "1.2.3.4:1234", dst: "5.6.7.8:80", rest: "x"},
+		{name: "local command", input: append(proxyV2Header(0x20, 0x00, -1, nil), "x"...), rest: "x"},
+		{name: "udp keeps address", input: proxyV2Header(0x21, 0x12, -1, ipv4)},
+		{name: "not a proxy header", input: []byte("\r\nGET / HTTP/1.1\r\n\r\n"), rest: "\r\nGET / HTTP/1.1\r\n\r\n"},
+		{name: "truncated signature", input: proxyV2Signature[:8], rest: string(proxyV2Signature[:8])},
+		{name: "truncated payload", input: proxyV2Header(0x21, 0x11, 12, ipv4[:6]), wantErr: true},
+		{name: "length beyond data", input: proxyV2Header(0x21, 0x11, 0xffff, ipv4), wantErr: true},
+		{name: "short address", input: proxyV2Header(0x21, 0x11, -1, ipv4[:8]), wantErr: true},
+		{name: "short ipv6 address", input: proxyV2Header(0x21, 0x21, -1, ipv4), wantErr: true},
+		{name: "bad version", input: proxyV2Header(0x11, 0x11, -1, ipv4), wantErr: true},
+		{name: "bad command", input: proxyV2Header(0x22, 0x11, -1, ipv4), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.input))
+			src, dst, err := readProxyV2(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got src=%v dst=%v", src, dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			checkAddrs(t, src, dst, tt.src, tt.dst)
+			rest, _ := io.ReadAll(r)
+			if string(rest) != tt.rest {
+				t.Errorf("remaining data = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func checkAddrs(t *testing.T, src, dst interface{ String() string }, wantSrc, wantDst string) {
+	t.Helper()
+	if wantSrc == "" {
+		if src != nil || dst != nil {
+			t.Errorf("expected no address, got src=%v dst=%v", src, dst)
+		}
+		return
+	}
+	if src == nil || dst == nil {
+		t.Fatalf("expected src=%s dst=%s, got none", wantSrc, wantDst)
+	}
+	if src.String() != wantSrc || dst.String() != wantDst {
+		t.Errorf("src=%s dst=%s, want src=%s dst=%s", src, dst, wantSrc, wantDst)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+	"sunnyproxy/internal/auth"
+	"sunnyproxy/internal/capture"
+	"sunnyproxy/internal/ipfilter"
+	"sunnyproxy/internal/logger"
+)
+
+// clientSession 记录已认证的客户端
+// goproxy 会把 CONNECT 请求的 UserData 传给隧道内解密后的请求，这些请求不再携带 Proxy-Authorization
+type clientSession struct {
+	user     string
+	recorder *capture.Recorder // 当前请求的流量捕获
+	// 当前请求的响应来自上游，而不是代理自己生成的
+	upstreamResp bool
+}
+
+func sessionFrom(ctx *goproxy.ProxyCtx) *clientSession {
+	session, _ := ctx.UserData.(*clientSession)
+	return session
+}
+
+// clientIP 返回请求的客户端 IP
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// SetOnViolation 设置客户端违规（认证失败、访问被拒绝的域名）的回调，用于自动封禁
+func (w *Wrapper) SetOnViolation(fn func(ip, offence string)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onViolation = fn
+}
+
+func (w *Wrapper) reportViolation(req *http.Request, offence string) {
+	w.mu.RLock()
+	fn := w.onViolation
+	w.mu.RUnlock()
+	if fn != nil {
+		fn(clientIP(req), offence)
+	}
+}
+
+// SetProxyAuth 设置代理认证，为 nil 时不认证
+func (w *Wrapper) SetProxyAuth(a *auth.ProxyAuth) *Wrapper {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.proxyAuth = a
+	return w
+}
+
+func (w *Wrapper) GetProxyAuth() *auth.ProxyAuth {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.proxyAuth
+}
+
+// authenticate 校验代理认证，返回用户名；认证失败时返回 407 响应
+func (w *Wrapper) authenticate(req *http.Request, target string) (string, *http.Response) {
+	proxyAuth := w.GetProxyAuth()
+	if proxyAuth == nil || !proxyAuth.IsEnabled() {
+		return "", nil
+	}
+
+	ip := clientIP(req)
+	user, err := proxyAuth.Authenticate(req.Header.Get("Proxy-Authorization"), ip, target)
+	req.Header.Del("Proxy-Authorization")
+	if err == nil {
+		return user, nil
+	}
+
+	if errors.Is(err, auth.ErrBadCredentials) {
+		logger.GetBroadcaster().LogAuthFailure(ip, user, target)
+		w.reportViolation(req, ipfilter.OffenceAuthFailed)
+	}
+	return "", proxyAuth.RequireAuth(req)
+}
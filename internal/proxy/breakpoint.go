@@ -0,0 +1,554 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elazarl/goproxy"
+	"github.com/google/uuid"
+	"sunnyproxy/internal/logger"
+	"sunnyproxy/internal/rules"
+	"sunnyproxy/pkg/config"
+)
+
+// 断点中可以查看和修改的消息体上限，超过时消息体原样放行
+const maxBreakpointBody = 1 << 20
+
+// 断点所处的阶段
+const (
+	StageRequest  = "request"
+	StageResponse = "response"
+)
+
+// 断点的处理方式
+const (
+	ActionContinue = "continue" // 放行，可以带上修改
+	ActionAbort    = "abort"    // 中止，向客户端返回 502
+	ActionMock     = "mock"     // 不再转发（或丢弃上游响应），直接返回给定的响应
+)
+
+// ErrBreakpointNotFound 断点不存在或已经处理（包括超时自动放行）
+var ErrBreakpointNotFound = errors.New("断点不存在或已处理")
+
+// Breakpoint 一个暂停中的请求或响应
+type Breakpoint struct {
+	ID           string      `json:"id"`
+	Stage        string      `json:"stage"`
+	RuleID       string      `json:"rule_id"`
+	RuleName     string      `json:"rule_name,omitempty"`
+	FlowID       string      `json:"flow_id,omitempty"` // 未启用流量捕获时为空
+	ClientIP     string      `json:"client_ip"`
+	PausedAt     time.Time   `json:"paused_at"`
+	Deadline     time.Time   `json:"deadline"` // 到期后自动放行
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	StatusCode   int         `json:"status_code,omitempty"` // 仅响应阶段
+	Headers      http.Header `json:"headers"`
+	Body         string      `json:"body,omitempty"`
+	Encoding     string      `json:"encoding,omitempty"`       // 内容不是合法 UTF-8 时为 "base64"
+	BodyTooLarge bool        `json:"body_too_large,omitempty"` // 消息体超过 1MB，不显示也不能修改
+}
+
+// Resolution 断点的处理结果
+// continue 时未填写的字段保持不变，headers 不为空时整体替换；mock 时 status_code 默认为 200
+type Resolution struct {
+	Action     string      `json:"action"`
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Body       *string     `json:"body,omitempty"`
+	Encoding   string      `json:"encoding,omitempty"` // body 为 base64 时填 "base64"
+}
+
+// BreakpointStats 断点统计
+type BreakpointStats struct {
+	Paused    int     `json:"paused"`
+	MaxPaused int     `json:"max_paused"`
+	Timeout   float64 `json:"timeout"` // 秒
+	Total     uint64  `json:"total"`
+	Resolved  uint64  `json:"resolved"`
+	TimedOut  uint64  `json:"timed_out"`
+	Skipped   uint64  `json:"skipped"` // 达到 max_paused 时未暂停直接放行
+}
+
+type pendingBreakpoint struct {
+	bp   Breakpoint
+	done chan Resolution
+}
+
+// Breakpoints 管理暂停中的断点，命中 breakpoint 规则的请求或响应在这里等待处理
+type Breakpoints struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	maxPaused int
+	paused    map[string]*pendingBreakpoint
+	stats     BreakpointStats
+}
+
+// NewBreakpoints 根据配置创建断点管理
+func NewBreakpoints(cfg config.BreakpointConfig) (*Breakpoints, error) {
+	b := &Breakpoints{paused: make(map[string]*pendingBreakpoint)}
+	if err := b.Update(cfg); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Update 重新应用配置，只影响之后暂停的断点
+func (b *Breakpoints) Update(cfg config.BreakpointConfig) error {
+	commit, err := b.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (b *Breakpoints) Prepare(cfg config.BreakpointConfig) (func(), error) {
+	if cfg.Timeout <= 0 {
+		return nil, fmt.Errorf("breakpoints.timeout 必须大于 0")
+	}
+	if cfg.MaxPaused <= 0 {
+		return nil, fmt.Errorf("breakpoints.max_paused 必须大于 0")
+	}
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.timeout = cfg.Timeout
+		b.maxPaused = cfg.MaxPaused
+	}, nil
+}
+
+// List 返回暂停中的断点，按暂停时间排序
+func (b *Breakpoints) List() []Breakpoint {
+	b.mu.Lock()
+	list := make([]Breakpoint, 0, len(b.paused))
+	for _, p := range b.paused {
+		list = append(list, p.bp)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PausedAt.Before(list[j].PausedAt)
+	})
+	return list
+}
+
+// Get 返回指定的断点
+func (b *Breakpoints) Get(id string) (Breakpoint, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.paused[id]
+	if !ok {
+		return Breakpoint{}, false
+	}
+	return p.bp, true
+}
+
+// Stats 返回断点统计
+func (b *Breakpoints) Stats() BreakpointStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.Paused = len(b.paused)
+	s.MaxPaused = b.maxPaused
+	s.Timeout = b.timeout.Seconds()
+	return s
+}
+
+// Resolve 处理暂停中的断点，断点不存在时返回 ErrBreakpointNotFound
+func (b *Breakpoints) Resolve(id string, res Resolution) error {
+	b.mu.Lock()
+	p, ok := b.paused[id]
+	b.mu.Unlock()
+	if !ok {
+		return ErrBreakpointNotFound
+	}
+	if err := validateResolution(p.bp, res); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	// 校验期间可能已超时或被其他人处理
+	if _, ok := b.paused[id]; !ok {
+		b.mu.Unlock()
+		return ErrBreakpointNotFound
+	}
+	delete(b.paused, id)
+	b.stats.Resolved++
+	b.mu.Unlock()
+
+	p.done <- res
+	logger.GetBroadcaster().LogBreakpoint(id, p.bp.RuleID, p.bp.ClientIP, p.bp.Method, p.bp.URL, res.Action)
+	return nil
+}
+
+func validateResolution(bp Breakpoint, res Resolution) error {
+	switch res.Action {
+	case ActionContinue, ActionAbort, ActionMock:
+	default:
+		return fmt.Errorf("未知的 action: %q", res.Action)
+	}
+	if res.Encoding != "" && res.Encoding != "base64" {
+		return fmt.Errorf("未知的 encoding: %q", res.Encoding)
+	}
+	if _, err := resolutionBody(res); err != nil {
+		return err
+	}
+	if res.Body != nil && bp.BodyTooLarge && res.Action == ActionContinue {
+		return errors.New("消息体过大，不能修改")
+	}
+	if res.StatusCode != 0 && (res.StatusCode < 100 || res.StatusCode > 999) {
+		return fmt.Errorf("无效的 status_code: %d", res.StatusCode)
+	}
+	if res.Action != ActionContinue {
+		return nil
+	}
+	if bp.Stage == StageRequest {
+		if res.StatusCode != 0 {
+			return errors.New("请求阶段不能修改 status_code")
+		}
+		if res.URL != "" {
+			if _, err := parseTargetURL(res.URL); err != nil {
+				return err
+			}
+		}
+	} else if res.Method != "" || res.URL != "" {
+		return errors.New("响应阶段不能修改 method 和 url")
+	}
+	return nil
+}
+
+// resolutionBody 解码处理结果中的消息体，未填写时返回 nil
+func resolutionBody(res Resolution) ([]byte, error) {
+	if res.Body == nil {
+		return nil, nil
+	}
+	if res.Encoding == "base64" {
+		data, err := base64.StdEncoding.DecodeString(*res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("body 不是有效的 base64: %v", err)
+		}
+		return data, nil
+	}
+	return []byte(*res.Body), nil
+}
+
+func parseTargetURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url 必须是完整的 http 或 https 地址: %q", raw)
+	}
+	return u, nil
+}
+
+// pause 暂停直到断点被处理、超时或客户端断开，超时和断开都按原样放行
+// 暂停数达到上限时不暂停，返回 false
+func (b *Breakpoints) pause(ctx context.Context, bp Breakpoint) (Resolution, bool) {
+	b.mu.Lock()
+	if len(b.paused) >= b.maxPaused {
+		b.stats.Skipped++
+		b.mu.Unlock()
+		return Resolution{}, false
+	}
+	bp.ID = uuid.New().String()
+	bp.PausedAt = time.Now()
+	bp.Deadline = bp.PausedAt.Add(b.timeout)
+	p := &pendingBreakpoint{bp: bp, done: make(chan Resolution, 1)}
+	b.paused[bp.ID] = p
+	b.stats.Total++
+	timeout := b.timeout
+	b.mu.Unlock()
+
+	broadcaster := logger.GetBroadcaster()
+	broadcaster.LogBreakpoint(bp.ID, bp.RuleID, bp.ClientIP, bp.Method, bp.URL, "paused")
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-p.done:
+		return res, true
+	case <-timer.C:
+		if b.remove(bp.ID, true) {
+			broadcaster.LogBreakpoint(bp.ID, bp.RuleID, bp.ClientIP, bp.Method, bp.URL, "timeout")
+			return Resolution{Action: ActionContinue}, true
+		}
+	case <-ctx.Done():
+		if b.remove(bp.ID, false) {
+			broadcaster.LogBreakpoint(bp.ID, bp.RuleID, bp.ClientIP, bp.Method, bp.URL, "cancelled")
+			return Resolution{Action: ActionContinue}, true
+		}
+	}
+	// 与 Resolve 同时发生，以 Resolve 的结果为准
+	return <-p.done, true
+}
+
+// remove 移除未处理的断点，已被 Resolve 移除时返回 false
+func (b *Breakpoints) remove(id string, timedOut bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.paused[id]; !ok {
+		return false
+	}
+	delete(b.paused, id)
+	if timedOut {
+		b.stats.TimedOut++
+	}
+	return true
+}
+
+// SetBreakpoints 设置断点管理，为 nil 时断点规则不生效
+func (w *Wrapper) SetBreakpoints(b *Breakpoints) *Wrapper {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.breakpoints = b
+	return w
+}
+
+func (w *Wrapper) GetBreakpoints() *Breakpoints {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.breakpoints
+}
+
+func (w *Wrapper) GetEngine() *rules.Engine {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.engine
+}
+
+// matchBreakpoint 查找匹配的断点规则，未设置断点管理或规则引擎时不匹配
+func (w *Wrapper) matchBreakpoint(url string, target rules.RuleTarget) (*Breakpoints, rules.Rule, bool) {
+	b, engine := w.GetBreakpoints(), w.GetEngine()
+	if b == nil || engine == nil {
+		return nil, rules.Rule{}, false
+	}
+	rule, ok := engine.MatchBreakpoint(url, target)
+	return b, rule, ok
+}
+
+// EnableBreakpoints 注册断点处理器
+// 需要在改写规则的处理器之后、记录响应的处理器之前注册，暂停时看到的是规则修改后的内容
+func (w *Wrapper) EnableBreakpoints() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.proxy.OnRequest().DoFunc(w.breakRequest)
+	w.proxy.OnResponse().DoFunc(w.breakResponse)
+}
+
+func (w *Wrapper) breakRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if bypassRules(req) {
+		return req, nil
+	}
+	target := requestURL(req)
+	b, rule, ok := w.matchBreakpoint(target, rules.RuleTargetRequest)
+	if !ok {
+		return req, nil
+	}
+
+	data, body, tooLarge, err := readBreakpointBody(req.Body)
+	req.Body = body
+	if err != nil {
+		return req, nil
+	}
+
+	bp := Breakpoint{
+		Stage:    StageRequest,
+		RuleID:   rule.ID,
+		RuleName: rule.Name,
+		FlowID:   recorderFrom(ctx).ID(),
+		ClientIP: clientIP(req),
+		Method:   req.Method,
+		URL:      target,
+		Headers:  req.Header.Clone(),
+	}
+	bp.setBody(data, tooLarge)
+
+	res, paused := b.pause(req.Context(), bp)
+	if !paused {
+		return req, nil
+	}
+	recorderFrom(ctx).AddRules("breakpoint:" + rule.ID)
+
+	switch res.Action {
+	case ActionAbort:
+		return req, abortResponse(req)
+	case ActionMock:
+		return req, mockResponse(req, res)
+	}
+
+	if res.Method != "" {
+		req.Method = res.Method
+	}
+	if res.URL != "" {
+		u, _ := parseTargetURL(res.URL)
+		req.URL = u
+		req.Host = u.Host
+	}
+	if res.Headers != nil {
+		req.Header = res.Headers.Clone()
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+			req.Header.Del("Host")
+		}
+		req.Header.Del("Content-Length")
+		req.Header.Del("Transfer-Encoding")
+	}
+	if edited, _ := resolutionBody(res); edited != nil {
+		req.Body = io.NopCloser(bytes.NewReader(edited))
+		req.ContentLength = int64(len(edited))
+	}
+	return req, nil
+}
+
+func (w *Wrapper) breakResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	req := ctx.Req
+	if resp == nil || req == nil || bypassRules(req) {
+		return resp
+	}
+	// 只暂停上游返回的响应，代理自己生成的响应（拒绝、限流、断点的中止和模拟）不暂停
+	if session := sessionFrom(ctx); session == nil || !session.upstreamResp {
+		return resp
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp
+	}
+	target := requestURL(req)
+	b, rule, ok := w.matchBreakpoint(target, rules.RuleTargetResponse)
+	if !ok {
+		return resp
+	}
+
+	data, body, tooLarge, err := readBreakpointBody(resp.Body)
+	resp.Body = body
+	if err != nil {
+		return resp
+	}
+
+	bp := Breakpoint{
+		Stage:      StageResponse,
+		RuleID:     rule.ID,
+		RuleName:   rule.Name,
+		FlowID:     recorderFrom(ctx).ID(),
+		ClientIP:   clientIP(req),
+		Method:     req.Method,
+		URL:        target,
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header.Clone(),
+	}
+	bp.setBody(data, tooLarge)
+
+	res, paused := b.pause(req.Context(), bp)
+	if !paused {
+		return resp
+	}
+	recorderFrom(ctx).AddRules("breakpoint:" + rule.ID)
+
+	switch res.Action {
+	case ActionAbort:
+		resp.Body.Close()
+		return abortResponse(req)
+	case ActionMock:
+		resp.Body.Close()
+		return mockResponse(req, res)
+	}
+
+	if res.StatusCode != 0 {
+		resp.StatusCode = res.StatusCode
+		resp.Status = statusLine(res.StatusCode)
+	}
+	if res.Headers != nil {
+		resp.Header = res.Headers.Clone()
+	}
+	if edited, _ := resolutionBody(res); edited != nil {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(edited))
+		resp.ContentLength = int64(len(edited))
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = nil
+	}
+	return resp
+}
+
+func (bp *Breakpoint) setBody(data []byte, tooLarge bool) {
+	if tooLarge {
+		bp.BodyTooLarge = true
+		return
+	}
+	if utf8.Valid(data) {
+		bp.Body = string(data)
+	} else {
+		bp.Body = base64.StdEncoding.EncodeToString(data)
+		bp.Encoding = "base64"
+	}
+}
+
+// readBreakpointBody 读取消息体用于显示，返回读到的内容和替换后的消息体
+// 超过 maxBreakpointBody 时只读取开头，替换后的消息体由读到的部分和剩余部分拼接而成
+func readBreakpointBody(rc io.ReadCloser) ([]byte, io.ReadCloser, bool, error) {
+	if rc == nil || rc == http.NoBody {
+		return nil, rc, false, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, maxBreakpointBody+1))
+	if err != nil || len(data) > maxBreakpointBody {
+		rest := struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), rc), rc}
+		return data, rest, err == nil, err
+	}
+	// 原消息体已读完，关闭后用读到的内容代替
+	rc.Close()
+	return data, io.NopCloser(bytes.NewReader(data)), false, nil
+}
+
+// requestURL 返回请求的完整 URL，MITM 解密后的请求可能不带 scheme 和 host
+func requestURL(req *http.Request) string {
+	if req.URL.Scheme != "" && req.URL.Host != "" {
+		return req.URL.String()
+	}
+	u := *req.URL
+	u.Scheme = "https"
+	u.Host = req.Host
+	return u.String()
+}
+
+func statusLine(code int) string {
+	return strconv.Itoa(code) + " " + http.StatusText(code)
+}
+
+func abortResponse(req *http.Request) *http.Response {
+	return goproxy.NewResponse(req, "text/plain; charset=utf-8", http.StatusBadGateway, "请求已在断点处中止\n")
+}
+
+// mockResponse 根据处理结果生成响应，未填写 headers 时返回 text/plain
+func mockResponse(req *http.Request, res Resolution) *http.Response {
+	code := res.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	body, _ := resolutionBody(res)
+	resp := goproxy.NewResponse(req, "text/plain; charset=utf-8", code, string(body))
+	resp.Status = statusLine(code)
+	if res.Headers != nil {
+		resp.Header = res.Headers.Clone()
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Transfer-Encoding")
+	}
+	return resp
+}
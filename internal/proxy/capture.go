@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+	"sunnyproxy/internal/capture"
+)
+
+// SetCapture 设置流量捕获，为 nil 时不捕获
+func (w *Wrapper) SetCapture(s *capture.Store) *Wrapper {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.capture = s
+	return w
+}
+
+func (w *Wrapper) GetCapture() *capture.Store {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.capture
+}
+
+// recorderFrom 返回当前请求的捕获记录，未捕获时返回 nil
+// 同一个 MITM 隧道内的请求是依次处理的，所以可以把当前请求的记录放在共享的会话上
+func recorderFrom(ctx *goproxy.ProxyCtx) *capture.Recorder {
+	if session := sessionFrom(ctx); session != nil {
+		return session.recorder
+	}
+	return nil
+}
+
+// EnableCapture 注册记录响应的处理器
+// 需要在其他响应处理器之后注册，记录的是修改后返回给客户端的响应
+func (w *Wrapper) EnableCapture() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		recorderFrom(ctx).Response(resp, ctx.Error)
+		return resp
+	})
+}
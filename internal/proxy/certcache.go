@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// 叶子证书密钥类型
+const (
+	LeafKeyECDSA = "ecdsa"
+	LeafKeyRSA   = "rsa"
+)
+
+// 叶子证书有效期，iOS 要求不超过 825 天
+const leafValidity = 365 * 24 * time.Hour
+
+// CertCacheStats 叶子证书缓存统计
+type CertCacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	TTL       string `json:"ttl"`
+	KeyType   string `json:"key_type"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+	Errors    uint64 `json:"errors"`
+}
+
+// certKey 叶子证书按签发的 CA 和 SNI 区分，更换 CA 期间新旧 CA 的握手不会拿到对方的证书
+type certKey struct {
+	ca   [sha256.Size]byte
+	host string
+}
+
+type certEntry struct {
+	key     certKey
+	cert    *tls.Certificate
+	expires time.Time
+}
+
+// pendingCert 正在生成中的证书，相同 CA 和 SNI 的并发握手共享同一次生成
+type pendingCert struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// certCache 按 CA 和 SNI 缓存 MITM 叶子证书的 LRU 缓存
+type certCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	keyType  string
+	ll       *list.List
+	items    map[certKey]*list.Element
+	pending  map[certKey]*pendingCert
+	gen      uint64 // 每次清空时加一，清空前开始生成的证书不再放回缓存
+
+	hits, misses, evictions, expired, errors uint64
+}
+
+func newCertCache(capacity int, ttl time.Duration, keyType string) *certCache {
+	c := &certCache{
+		ll:      list.New(),
+		items:   make(map[certKey]*list.Element),
+		pending: make(map[certKey]*pendingCert),
+	}
+	c.configure(capacity, ttl, keyType)
+	return c
+}
+
+// configure 调整缓存容量、有效期和密钥类型，密钥类型变化时清空缓存
+func (c *certCache) configure(capacity int, ttl time.Duration, keyType string) {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	if keyType != LeafKeyRSA {
+		keyType = LeafKeyECDSA
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keyType != "" && c.keyType != keyType {
+		c.purgeLocked()
+	}
+	c.capacity = capacity
+	c.ttl = ttl
+	c.keyType = keyType
+	for c.ll.Len() > c.capacity {
+		c.removeOldestLocked()
+	}
+}
+
+// get 返回缓存中的证书，不存在或已过期时调用 sign 生成
+func (c *certCache) get(host string, ca *tls.Certificate) (*tls.Certificate, error) {
+	key := certKey{ca: sha256.Sum256(ca.Certificate[0]), host: host}
+
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*certEntry)
+		if time.Now().Before(entry.expires) {
+			c.ll.MoveToFront(elem)
+			c.hits++
+			c.mu.Unlock()
+			return entry.cert, nil
+		}
+		c.ll.Remove(elem)
+		delete(c.items, key)
+		c.expired++
+	}
+
+	if p, ok := c.pending[key]; ok {
+		c.mu.Unlock()
+		<-p.done
+		return p.cert, p.err
+	}
+
+	c.misses++
+	p := &pendingCert{done: make(chan struct{})}
+	c.pending[key] = p
+	keyType := c.keyType
+	gen := c.gen
+	c.mu.Unlock()
+
+	p.cert, p.err = signLeaf(ca, host, keyType)
+
+	c.mu.Lock()
+	if c.pending[key] == p {
+		delete(c.pending, key)
+	}
+	switch {
+	case p.err != nil:
+		c.errors++
+	case gen == c.gen:
+		c.addLocked(key, p.cert)
+	}
+	c.mu.Unlock()
+	close(p.done)
+
+	return p.cert, p.err
+}
+
+func (c *certCache) addLocked(key certKey, cert *tls.Certificate) {
+	expires := cert.Leaf.NotAfter
+	if c.ttl > 0 {
+		if t := time.Now().Add(c.ttl); t.Before(expires) {
+			expires = t
+		}
+	}
+
+	entry := &certEntry{key: key, cert: cert, expires: expires}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.capacity {
+		c.removeOldestLocked()
+	}
+}
+
+func (c *certCache) removeOldestLocked() {
+	elem := c.ll.Back()
+	if elem == nil {
+		return
+	}
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*certEntry).key)
+	c.evictions++
+}
+
+// purge 清空缓存（更换 CA 后调用）
+func (c *certCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purgeLocked()
+}
+
+// purgeLocked 清空缓存和正在生成的记录，正在生成的证书完成后只返回给等待它的握手
+func (c *certCache) purgeLocked() {
+	c.ll.Init()
+	c.items = make(map[certKey]*list.Element)
+	c.pending = make(map[certKey]*pendingCert)
+	c.gen++
+}
+
+func (c *certCache) stats() CertCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CertCacheStats{
+		Size:      c.ll.Len(),
+		Capacity:  c.capacity,
+		TTL:       c.ttl.String(),
+		KeyType:   c.keyType,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Expired:   c.expired,
+		Errors:    c.errors,
+	}
+}
+
+// signLeaf 使用 CA 为指定主机签发叶子证书
+func signLeaf(ca *tls.Certificate, host string, keyType string) (*tls.Certificate, error) {
+	if ca.Leaf == nil {
+		return nil, fmt.Errorf("CA 证书未解析")
+	}
+
+	var key crypto.Signer
+	var err error
+	if keyType == LeafKeyRSA {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	// 回拨一小时，避免客户端时钟略慢导致证书尚未生效
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(leafValidity)
+	if notAfter.After(ca.Leaf.NotAfter) {
+		notAfter = ca.Leaf.NotAfter
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"SunnyProxy"},
+			CommonName:   host,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	if keyType == LeafKeyRSA {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Leaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCA(t *testing.T, name string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertCacheSeparatesCAs(t *testing.T) {
+	c := newCertCache(10, time.Hour, LeafKeyECDSA)
+	oldCA, newCA := testCA(t, "old"), testCA(t, "new")
+
+	tests := []struct {
+		name string
+		ca   *tls.Certificate
+	}{
+		{"old ca", oldCA},
+		{"new ca", newCA},
+		{"old ca cached", oldCA},
+		{"new ca cached", newCA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := c.get("example.com", tt.ca)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cert.Leaf.CheckSignatureFrom(tt.ca.Leaf); err != nil {
+				t.Errorf("leaf not signed by %s: %v", tt.ca.Leaf.Subject.CommonName, err)
+			}
+		})
+	}
+	if s := c.stats(); s.Size != 2 || s.Hits != 2 || s.Misses != 2 {
+		t.Errorf("stats = %+v, want size 2, 2 hits, 2 misses", s)
+	}
+}
+
+func TestCertCachePurgeDropsInFlight(t *testing.T) {
+	c := newCertCache(10, time.Hour, LeafKeyECDSA)
+	oldCA, newCA := testCA(t, "old"), testCA(t, "new")
+
+	// 模拟 purge 之前开始、之后才完成的签发：生成的证书不能放回缓存，也不能被新 CA 的握手共享
+	key := certKey{host: "example.com"}
+	c.mu.Lock()
+	c.pending[key] = &pendingCert{done: make(chan struct{})}
+	gen := c.gen
+	c.mu.Unlock()
+	c.purge()
+
+	c.mu.Lock()
+	if len(c.pending) != 0 {
+		t.Errorf("pending not cleared by purge")
+	}
+	if c.gen == gen {
+		t.Errorf("generation not bumped by purge")
+	}
+	c.mu.Unlock()
+
+	if _, err := c.get("example.com", oldCA); err != nil {
+		t.Fatal(err)
+	}
+	c.purge()
+	cert, err := c.get("example.com", newCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.CheckSignatureFrom(newCA.Leaf); err != nil {
+		t.Errorf("leaf after purge not signed by new CA: %v", err)
+	}
+	if s := c.stats(); s.Size != 1 || s.Hits != 0 {
+		t.Errorf("stats = %+v, want only the new CA leaf cached", s)
+	}
+}
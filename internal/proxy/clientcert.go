@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/pkg/config"
+)
+
+// 客户端证书来源
+const (
+	ClientCertFromConfig = "config" // config.yaml 中配置，只能通过修改配置删除
+	ClientCertFromAPI    = "api"    // 通过 API 上传，保存在 client_cert_file
+)
+
+// ClientCert 上游客户端证书信息
+type ClientCert struct {
+	ID          string    `json:"id"`
+	Host        string    `json:"host"`
+	Source      string    `json:"source"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"fingerprint_sha256"`
+}
+
+type clientCertEntry struct {
+	info    ClientCert
+	matcher *domainfilter.Matcher
+	pair    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// storedClientCert 是持久化到磁盘的客户端证书
+type storedClientCert struct {
+	Host    string `json:"host"`
+	CertPEM string `json:"cert_pem"`
+	KeyPEM  string `json:"key_pem"`
+}
+
+// ClientCerts 按域名选择上游 TLS 握手时出示的客户端证书
+// 按列表顺序匹配，配置文件中的证书在前，API 上传的在后
+type ClientCerts struct {
+	mu         sync.RWMutex
+	fromConfig []*clientCertEntry
+	fromAPI    []*clientCertEntry
+	file       string
+}
+
+// NewClientCerts 根据配置创建客户端证书列表
+func NewClientCerts(cfg config.UpstreamTLSConfig) (*ClientCerts, error) {
+	c := &ClientCerts{}
+	if err := c.Update(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Update 重新加载配置中的证书和 API 上传的证书，出错时保持原有状态不变
+func (c *ClientCerts) Update(cfg config.UpstreamTLSConfig) error {
+	commit, err := c.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (c *ClientCerts) Prepare(cfg config.UpstreamTLSConfig) (func(), error) {
+	fromConfig := make([]*clientCertEntry, 0, len(cfg.ClientCerts))
+	for _, cc := range cfg.ClientCerts {
+		certPEM, err := os.ReadFile(cc.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("client_certs: %v", err)
+		}
+		keyPEM, err := os.ReadFile(cc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client_certs: %v", err)
+		}
+		entry, err := newClientCertEntry(cc.Host, certPEM, keyPEM, ClientCertFromConfig)
+		if err != nil {
+			return nil, fmt.Errorf("client_certs %s: %v", cc.Host, err)
+		}
+		fromConfig = append(fromConfig, entry)
+	}
+
+	fromAPI, err := loadClientCerts(cfg.ClientCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %v", cfg.ClientCertFile, err)
+	}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.fromConfig = fromConfig
+		c.fromAPI = fromAPI
+		c.file = cfg.ClientCertFile
+	}, nil
+}
+
+// Match 返回访问该域名时应出示的客户端证书，没有时返回 nil
+func (c *ClientCerts) Match(host string) *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, list := range [][]*clientCertEntry{c.fromConfig, c.fromAPI} {
+		for _, e := range list {
+			if _, ok := e.matcher.Match(host); ok {
+				return e.pair
+			}
+		}
+	}
+	return nil
+}
+
+// List 列出所有客户端证书，不包含私钥
+func (c *ClientCerts) List() []ClientCert {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make([]ClientCert, 0, len(c.fromConfig)+len(c.fromAPI))
+	for _, e := range c.fromConfig {
+		result = append(result, e.info)
+	}
+	for _, e := range c.fromAPI {
+		result = append(result, e.info)
+	}
+	return result
+}
+
+// Add 添加 PEM 格式的客户端证书并持久化，同一域名和证书已存在时替换
+func (c *ClientCerts) Add(host string, certPEM, keyPEM []byte) (ClientCert, error) {
+	entry, err := newClientCertEntry(host, certPEM, keyPEM, ClientCertFromAPI)
+	if err != nil {
+		return ClientCert{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]*clientCertEntry, 0, len(c.fromAPI)+1)
+	for _, e := range c.fromAPI {
+		if e.info.ID != entry.info.ID {
+			list = append(list, e)
+		}
+	}
+	list = append(list, entry)
+	if err := saveClientCerts(c.file, list); err != nil {
+		return ClientCert{}, err
+	}
+	c.fromAPI = list
+	log.Printf("[mTLS] 添加客户端证书: %s (%s)", host, entry.info.Subject)
+	return entry.info, nil
+}
+
+// AddPKCS12 添加 PKCS#12 格式的客户端证书
+func (c *ClientCerts) AddPKCS12(host string, data []byte, password string) (ClientCert, error) {
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return ClientCert{}, fmt.Errorf("解析 PKCS#12 失败: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return ClientCert{}, fmt.Errorf("不支持的私钥类型: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	for _, ca := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return c.Add(host, certPEM, keyPEM)
+}
+
+// Remove 删除 API 上传的客户端证书，返回证书是否存在
+func (c *ClientCerts) Remove(id string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.fromConfig {
+		if e.info.ID == id {
+			return false, fmt.Errorf("该证书来自配置文件，请修改 upstream_tls.client_certs 后重新加载")
+		}
+	}
+
+	list := make([]*clientCertEntry, 0, len(c.fromAPI))
+	var removed *clientCertEntry
+	for _, e := range c.fromAPI {
+		if e.info.ID == id {
+			removed = e
+			continue
+		}
+		list = append(list, e)
+	}
+	if removed == nil {
+		return false, nil
+	}
+	if err := saveClientCerts(c.file, list); err != nil {
+		return false, err
+	}
+	c.fromAPI = list
+	log.Printf("[mTLS] 删除客户端证书: %s (%s)", removed.info.Host, removed.info.Subject)
+	return true, nil
+}
+
+func newClientCertEntry(host string, certPEM, keyPEM []byte, source string) (*clientCertEntry, error) {
+	if host == "" {
+		return nil, fmt.Errorf("域名不能为空")
+	}
+	matcher, err := domainfilter.NewMatcher([]string{host})
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("证书与私钥不匹配: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	pair.Leaf = leaf
+
+	sum := sha256.Sum256(leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	id := sha256.Sum256([]byte(host + "|" + fingerprint))
+
+	return &clientCertEntry{
+		info: ClientCert{
+			ID:          hex.EncodeToString(id[:6]),
+			Host:        host,
+			Source:      source,
+			Subject:     leaf.Subject.String(),
+			Issuer:      leaf.Issuer.String(),
+			NotAfter:    leaf.NotAfter,
+			Fingerprint: fingerprint,
+		},
+		matcher: matcher,
+		pair:    &pair,
+		certPEM: certPEM,
+		keyPEM:  keyPEM,
+	}, nil
+}
+
+// loadClientCerts 读取 API 上传的证书，文件不存在时返回空列表
+func loadClientCerts(path string) ([]*clientCertEntry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var stored []storedClientCert
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	entries := make([]*clientCertEntry, 0, len(stored))
+	for _, s := range stored {
+		entry, err := newClientCertEntry(s.Host, []byte(s.CertPEM), []byte(s.KeyPEM), ClientCertFromAPI)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Host, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// saveClientCerts 保存 API 上传的证书，文件包含私钥，仅当前用户可读
+func saveClientCerts(path string, entries []*clientCertEntry) error {
+	if path == "" {
+		return fmt.Errorf("未配置 upstream_tls.client_cert_file，无法保存证书")
+	}
+	stored := make([]storedClientCert, 0, len(entries))
+	for _, e := range entries {
+		stored = append(stored, storedClientCert{
+			Host:    e.info.Host,
+			CertPEM: string(e.certPEM),
+			KeyPEM:  string(e.keyPEM),
+		})
+	}
+
+	dir := filepath.Dir(path)
+	if dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
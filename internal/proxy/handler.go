@@ -30,6 +30,10 @@ func (h *Handler) SetupHandlers(proxy *goproxy.ProxyHttpServer) {
 }
 
 func (h *Handler) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if bypassRules(req) {
+		return req, nil
+	}
+
 	url := req.URL.String()
 	if req.URL.Scheme == "" {
 		url = "https://" + req.Host + req.URL.Path
@@ -80,7 +84,8 @@ func (h *Handler) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http
 			}
 		}
 
-		h.broadcaster.LogRequest(method, url, true, []string{"payment-replace"})
+		recorderFrom(ctx).AddRules("payment-replace")
+		h.broadcaster.LogRequest(method, url, clientIP(req), true, []string{"payment-replace"})
 		return req, nil
 	}
 
@@ -122,7 +127,7 @@ func getContentType(path string) string {
 }
 
 func (h *Handler) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	if resp == nil || ctx.Req == nil {
+	if resp == nil || ctx.Req == nil || bypassRules(ctx.Req) {
 		return resp
 	}
 
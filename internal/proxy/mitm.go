@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/internal/logger"
+	"sunnyproxy/pkg/config"
+)
+
+// PinnedHost 因客户端拒绝证书而自动改为透传的域名
+type PinnedHost struct {
+	Host      string    `json:"host"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error"`
+}
+
+// 握手失败的类型
+const (
+	rejectNone        = iota
+	rejectCertAlert   // 客户端回复了证书相关的 TLS alert，明确拒绝了证书
+	rejectAbruptClose // 握手中直接断开，也可能是端口扫描、取消的请求或不稳定的网络
+)
+
+// 直接断开的次数需要达到阈值的多少倍才改为透传
+const abruptCloseFactor = 5
+
+// 表示客户端不接受证书的 TLS alert，"bad certificate" 同时覆盖 bad certificate status response 等
+var certAlerts = []string{
+	"bad certificate",
+	"unsupported certificate",
+	"revoked certificate",
+	"expired certificate",
+	"unknown certificate", // 包括 unknown certificate authority
+}
+
+// handshakeFailures 一个域名连续握手失败的次数，按类型分别计数
+type handshakeFailures struct {
+	alerts int
+	closes int
+}
+
+// MitmScope 决定哪些 CONNECT 目标需要 MITM 解密
+// exclude 优先于 include/all；检测到证书固定的域名会自动改为透传
+type MitmScope struct {
+	mu        sync.RWMutex
+	all       bool
+	include   *domainfilter.Matcher
+	exclude   *domainfilter.Matcher
+	fallback  bool
+	threshold int
+	ttl       time.Duration
+	failures  map[string]*handshakeFailures
+	pinned    map[string]*PinnedHost
+}
+
+// NewMitmScope 根据配置创建 MITM 范围
+func NewMitmScope(cfg config.MitmConfig) (*MitmScope, error) {
+	s := &MitmScope{
+		failures: make(map[string]*handshakeFailures),
+		pinned:   make(map[string]*PinnedHost),
+	}
+	if err := s.Update(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Update 重新应用配置，已检测到的证书固定域名保留
+func (s *MitmScope) Update(cfg config.MitmConfig) error {
+	commit, err := s.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (s *MitmScope) Prepare(cfg config.MitmConfig) (func(), error) {
+	include, err := domainfilter.NewMatcher(cfg.Include)
+	if err != nil {
+		return nil, fmt.Errorf("mitm.include: %v", err)
+	}
+	exclude, err := domainfilter.NewMatcher(cfg.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("mitm.exclude: %v", err)
+	}
+
+	threshold := cfg.PinningThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.all = cfg.All
+		s.include = include
+		s.exclude = exclude
+		s.fallback = cfg.PinningFallback
+		s.threshold = threshold
+		s.ttl = cfg.PinningTTL
+	}, nil
+}
+
+// Config 返回当前 MITM 范围设置
+func (s *MitmScope) Config() config.MitmConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return config.MitmConfig{
+		All:              s.all,
+		Include:          s.include.Patterns(),
+		Exclude:          s.exclude.Patterns(),
+		PinningFallback:  s.fallback,
+		PinningThreshold: s.threshold,
+		PinningTTL:       s.ttl,
+	}
+}
+
+// ShouldMitm 检查是否需要对该域名进行 MITM
+func (s *MitmScope) ShouldMitm(host string) bool {
+	host = domainfilter.NormalizeHost(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, excluded := s.exclude.Match(host); excluded {
+		return false
+	}
+	if p, ok := s.pinned[host]; ok && s.fallback {
+		if s.ttl <= 0 || time.Since(p.Since) < s.ttl {
+			return false
+		}
+		delete(s.pinned, host)
+		log.Printf("[MITM] %s 的透传已过期，重新尝试解密", host)
+	}
+
+	if s.all {
+		return true
+	}
+	_, included := s.include.Match(host)
+	return included
+}
+
+// recordHandshakeFailure 记录客户端拒绝 MITM 证书，连续失败达到阈值后改为透传
+// 直接断开的证据较弱，需要达到阈值的 abruptCloseFactor 倍
+func (s *MitmScope) recordHandshakeFailure(host, reason string, kind int) {
+	host = domainfilter.NormalizeHost(host)
+	broadcaster := logger.GetBroadcaster()
+	what := "客户端拒绝 MITM 证书"
+	if kind == rejectAbruptClose {
+		what = "客户端在 TLS 握手中断开"
+	}
+
+	s.mu.Lock()
+	if !s.fallback {
+		s.mu.Unlock()
+		broadcaster.LogError(host, what+": "+reason)
+		return
+	}
+	if _, ok := s.pinned[host]; ok {
+		s.mu.Unlock()
+		return
+	}
+	f := s.failures[host]
+	if f == nil {
+		f = &handshakeFailures{}
+		s.failures[host] = f
+	}
+	var failures, threshold int
+	if kind == rejectCertAlert {
+		f.alerts++
+		failures, threshold = f.alerts, s.threshold
+	} else {
+		f.closes++
+		failures, threshold = f.closes, s.threshold*abruptCloseFactor
+	}
+	pinned := failures >= threshold
+	if pinned {
+		delete(s.failures, host)
+		s.pinned[host] = &PinnedHost{Host: host, Since: time.Now(), LastError: reason}
+	}
+	s.mu.Unlock()
+
+	if pinned {
+		log.Printf("[MITM] %s 疑似证书固定（%s），后续连接改为透传", host, reason)
+		broadcaster.LogError(host, fmt.Sprintf("疑似证书固定，已改为透传: %s", reason))
+	} else {
+		broadcaster.LogError(host, fmt.Sprintf("%s（第 %d/%d 次）: %s", what, failures, threshold, reason))
+	}
+}
+
+// recordHandshakeSuccess 收到解密后的请求说明握手成功，清零失败计数
+func (s *MitmScope) recordHandshakeSuccess(host string) {
+	host = domainfilter.NormalizeHost(host)
+
+	s.mu.RLock()
+	_, failed := s.failures[host]
+	s.mu.RUnlock()
+	if !failed {
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.failures, host)
+	s.mu.Unlock()
+}
+
+// GetPinnedHosts 获取已改为透传的域名
+func (s *MitmScope) GetPinnedHosts() []PinnedHost {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]PinnedHost, 0, len(s.pinned))
+	for _, p := range s.pinned {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Since.After(result[j].Since)
+	})
+	return result
+}
+
+// ClearPinned 移除透传记录，host 为空时全部清除
+func (s *MitmScope) ClearPinned(host string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if host == "" {
+		n := len(s.pinned)
+		s.pinned = make(map[string]*PinnedHost)
+		return n
+	}
+	host = domainfilter.NormalizeHost(host)
+	if _, ok := s.pinned[host]; !ok {
+		return 0
+	}
+	delete(s.pinned, host)
+	return 1
+}
+
+// classifyHandshakeError 判断握手错误是否可能是客户端拒绝了证书
+// 客户端校验失败时通常回复证书相关的 TLS alert；TLS 1.3 下 OpenSSL 等客户端以明文发送 alert，
+// 服务端解密失败表现为 bad record MAC；部分 App 会直接断开连接
+func classifyHandshakeError(errMsg string) int {
+	if strings.Contains(errMsg, "bad record MAC") {
+		return rejectCertAlert
+	}
+	if _, alert, ok := strings.Cut(errMsg, "remote error: tls: "); ok {
+		for _, a := range certAlerts {
+			if strings.HasPrefix(alert, a) {
+				return rejectCertAlert
+			}
+		}
+		return rejectNone
+	}
+	if strings.HasSuffix(errMsg, "EOF") || strings.Contains(errMsg, "connection reset by peer") {
+		return rejectAbruptClose
+	}
+	return rejectNone
+}
+
+// proxyLogger 接管 goproxy 的日志输出，从中识别客户端 TLS 握手失败
+type proxyLogger struct {
+	scope func() *MitmScope
+}
+
+func (l *proxyLogger) Printf(format string, v ...interface{}) {
+	// goproxy: ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
+	if strings.Contains(format, "Cannot handshake client") && len(v) >= 3 {
+		host := fmt.Sprint(v[1])
+		errMsg := fmt.Sprint(v[2])
+		if kind := classifyHandshakeError(errMsg); kind != rejectNone {
+			if scope := l.scope(); scope != nil {
+				scope.recordHandshakeFailure(host, errMsg, kind)
+			}
+		}
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+
+	"sunnyproxy/internal/ratelimit"
+)
+
+// SetRateLimiter 设置限流器，为 nil 时不限流
+func (w *Wrapper) SetRateLimiter(l *ratelimit.Limiter) *Wrapper {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limiter = l
+	return w
+}
+
+func (w *Wrapper) GetRateLimiter() *ratelimit.Limiter {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.limiter
+}
+
+// checkRateLimit 在认证之后检查请求速率，超限时返回 429 响应
+func (w *Wrapper) checkRateLimit(req *http.Request, user string) *http.Response {
+	limiter := w.GetRateLimiter()
+	if limiter == nil {
+		return nil
+	}
+	if limiter.AllowRequest(req.RemoteAddr, user) {
+		return nil
+	}
+	return ratelimit.TooManyRequests(req)
+}
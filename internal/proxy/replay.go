@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"sunnyproxy/internal/capture"
+)
+
+type replayKey struct{}
+
+// replayInfo 重放请求的附加信息，通过请求的 context 传给处理器
+type replayInfo struct {
+	original    string // 原流量的 ID
+	user        string
+	bypassRules bool
+	flowID      string // 新流量的 ID，由请求处理器填写
+}
+
+func replayFrom(req *http.Request) *replayInfo {
+	if req == nil {
+		return nil
+	}
+	info, _ := req.Context().Value(replayKey{}).(*replayInfo)
+	return info
+}
+
+// bypassRules 检查请求是否为要求跳过规则的重放
+func bypassRules(req *http.Request) bool {
+	info := replayFrom(req)
+	return info != nil && info.bypassRules
+}
+
+// Replay 通过代理重新发送请求，与客户端的请求经过相同的处理器和上游连接，返回新的流量
+// 重放由管理接口发起，已经过 Web 认证，所以不做代理认证和限流；bypass 为 true 时跳过改写规则
+func (w *Wrapper) Replay(req *http.Request, original, user string, bypass bool) (*capture.Flow, error) {
+	store := w.GetCapture()
+	if store == nil || !store.IsEnabled() {
+		return nil, errors.New("流量捕获未启用")
+	}
+	if req.Header.Get("Upgrade") != "" {
+		return nil, errors.New("不支持重放 WebSocket 等协议升级请求")
+	}
+
+	info := &replayInfo{original: original, user: user, bypassRules: bypass}
+	req = req.WithContext(context.WithValue(req.Context(), replayKey{}, info))
+	// goproxy 按普通 HTTP 代理请求处理，HTTPS 的 URL 同样由 Transport 直接连接上游
+	w.GetProxy().ServeHTTP(&discardResponseWriter{header: make(http.Header)}, req)
+
+	// 响应体读完后流量才保存，ServeHTTP 返回时已经完成
+	if info.flowID == "" {
+		return nil, errors.New("重放的请求未被记录")
+	}
+	flow, ok := store.Get(info.flowID)
+	if !ok {
+		return nil, errors.New("重放的请求未被记录")
+	}
+	return flow, nil
+}
+
+// discardResponseWriter 丢弃返回给客户端的响应，重放的结果从捕获的流量中获取
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
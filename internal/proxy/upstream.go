@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/pkg/config"
+)
+
+// UpstreamTLS 决定如何校验上游服务器的证书
+// insecure_hosts 中的域名不校验；root_cas 中的证书与系统根证书一起作为信任根
+type UpstreamTLS struct {
+	mu       sync.RWMutex
+	verify   bool
+	insecure *domainfilter.Matcher
+	rootCAs  []string
+	roots    *x509.CertPool // nil 表示只使用系统根证书
+}
+
+// CertError 上游证书校验失败
+type CertError struct {
+	Host        string    `json:"host"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"fingerprint_sha256"`
+	Err         error     `json:"-"`
+}
+
+func (e *CertError) Error() string {
+	return fmt.Sprintf("上游证书校验失败 %s: %v", e.Host, e.Err)
+}
+
+func (e *CertError) Unwrap() error {
+	return e.Err
+}
+
+// Details 返回证书信息，用于日志和错误页面
+func (e *CertError) Details() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v\n", e.Err)
+	fmt.Fprintf(&b, "subject: %s\n", e.Subject)
+	fmt.Fprintf(&b, "issuer: %s\n", e.Issuer)
+	if len(e.DNSNames) > 0 {
+		fmt.Fprintf(&b, "dns_names: %s\n", strings.Join(e.DNSNames, ", "))
+	}
+	fmt.Fprintf(&b, "validity: %s - %s\n", e.NotBefore.Format(time.RFC3339), e.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(&b, "sha256: %s", e.Fingerprint)
+	return b.String()
+}
+
+// NewUpstreamTLS 根据配置创建上游证书校验策略
+func NewUpstreamTLS(cfg config.UpstreamTLSConfig) (*UpstreamTLS, error) {
+	u := &UpstreamTLS{}
+	if err := u.Update(cfg); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Update 重新应用配置，出错时保持原有状态不变
+func (u *UpstreamTLS) Update(cfg config.UpstreamTLSConfig) error {
+	commit, err := u.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (u *UpstreamTLS) Prepare(cfg config.UpstreamTLSConfig) (func(), error) {
+	insecure, err := domainfilter.NewMatcher(cfg.InsecureHosts)
+	if err != nil {
+		return nil, fmt.Errorf("upstream_tls.insecure_hosts: %v", err)
+	}
+
+	var roots *x509.CertPool
+	if len(cfg.RootCAs) > 0 {
+		roots, err = x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		for _, file := range cfg.RootCAs {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("upstream_tls.root_cas: %v", err)
+			}
+			if !roots.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("upstream_tls.root_cas: %s 中没有有效的 PEM 证书", file)
+			}
+		}
+	}
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.verify = cfg.Verify
+		u.insecure = insecure
+		u.rootCAs = append([]string(nil), cfg.RootCAs...)
+		u.roots = roots
+	}, nil
+}
+
+// Config 返回当前校验策略
+func (u *UpstreamTLS) Config() config.UpstreamTLSConfig {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return config.UpstreamTLSConfig{
+		Verify:        u.verify,
+		InsecureHosts: u.insecure.Patterns(),
+		RootCAs:       append([]string(nil), u.rootCAs...),
+	}
+}
+
+// tlsConfig 返回上游连接使用的 TLS 配置
+// 关闭内置校验，改由 verifyConnection 按域名决定是否校验，修改策略后无需重建 Transport
+func (u *UpstreamTLS) tlsConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   u.verifyConnection,
+	}
+}
+
+func (u *UpstreamTLS) verifyConnection(cs tls.ConnectionState) error {
+	u.mu.RLock()
+	verify, roots := u.verify, u.roots
+	_, skip := u.insecure.Match(cs.ServerName)
+	u.mu.RUnlock()
+
+	if !verify || skip {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return &CertError{Host: cs.ServerName, Err: fmt.Errorf("服务器未提供证书")}
+	}
+
+	leaf := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(leaf.Raw)
+	return &CertError{
+		Host:        cs.ServerName,
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		DNSNames:    leaf.DNSNames,
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Err:         err,
+	}
+}
+
+// certErrorResponse 生成上游证书校验失败时返回给客户端的响应
+func certErrorResponse(req *http.Request, certErr *CertError) *http.Response {
+	body := fmt.Sprintf("SunnyProxy: 上游服务器 %s 的证书校验失败，已拒绝转发\n\n%s\n\n"+
+		"如果确认该服务器可信，请将其加入 upstream_tls.insecure_hosts 或把其根证书加入 upstream_tls.root_cas\n",
+		certErr.Host, certErr.Details())
+	resp := goproxy.NewResponse(req, "text/plain; charset=utf-8", http.StatusBadGateway, body)
+	resp.Header.Set("X-SunnyProxy-Error", "upstream-certificate")
+	return resp
+}
@@ -1,64 +1,226 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/elazarl/goproxy"
-	"github.com/elazarl/goproxy/ext/auth"
+	"sunnyproxy/internal/auth"
+	"sunnyproxy/internal/capture"
 	"sunnyproxy/internal/domainfilter"
+	"sunnyproxy/internal/ipfilter"
+	"sunnyproxy/internal/logger"
+	"sunnyproxy/internal/ratelimit"
 	"sunnyproxy/internal/rules"
+	"sunnyproxy/pkg/config"
 )
 
 type Wrapper struct {
-	mu          sync.RWMutex
-	proxy       *goproxy.ProxyHttpServer
-	port        int
-	caCert      []byte
-	caKey       []byte
-	certPool    *x509.CertPool
-	engine      *rules.Engine
-	transport   *http.Transport
-	authEnabled bool
-	authUser    string
-	authPass    string
+	mu        sync.RWMutex
+	proxy     *goproxy.ProxyHttpServer
+	port      int
+	caCert    []byte
+	caKey     []byte
+	certPool  *x509.CertPool
+	engine    *rules.Engine
+	transport *http.Transport
+	proxyAuth *auth.ProxyAuth
+	limiter   *ratelimit.Limiter
+	capture   *capture.Store
+
+	breakpoints *Breakpoints
+
+	onViolation func(ip, offence string)
+
+	domainFilter *domainfilter.DomainFilter
+	mitmScope    *MitmScope
+	certCache    *certCache
+	upstreamTLS  *UpstreamTLS
+	clientCerts  *ClientCerts
+	dialer       *net.Dialer
+	connect      *connectActions // 由 mu 保护，更换 CA 时整体替换
+}
+
+// connectActions CONNECT 处理器返回的动作，MITM 使用当前 CA 签发叶子证书
+// 不修改 goproxy 的全局变量，运行中更换 CA 不会与正在处理的 CONNECT 竞争
+type connectActions struct {
+	accept *goproxy.ConnectAction
+	mitm   *goproxy.ConnectAction
+	reject *goproxy.ConnectAction
 }
 
 func NewWrapper() *Wrapper {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = false
 
+	defaults := config.Default()
+	upstreamTLS, _ := NewUpstreamTLS(defaults.UpstreamTLS)
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
 	// 创建优化的 Transport，启用连接池和 Keep-Alive
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
 		MaxIdleConns:          100,
 		MaxIdleConnsPerHost:   10,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		ForceAttemptHTTP2:     true,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		TLSClientConfig:       upstreamTLS.tlsConfig(),
 	}
 
 	// 设置代理的 Transport
 	proxy.Tr = transport
 
-	return &Wrapper{
-		proxy:     proxy,
-		transport: transport,
+	mitmScope, _ := NewMitmScope(defaults.Mitm)
+
+	w := &Wrapper{
+		proxy:       proxy,
+		transport:   transport,
+		mitmScope:   mitmScope,
+		certCache:   newCertCache(defaults.Mitm.CertCacheSize, defaults.Mitm.CertCacheTTL, defaults.Mitm.LeafKeyType),
+		upstreamTLS: upstreamTLS,
+		clientCerts: &ClientCerts{},
+		dialer:      dialer,
+		// 设置 CA 之前沿用 goproxy 自带的 CA
+		connect: &connectActions{
+			accept: goproxy.OkConnect,
+			mitm:   goproxy.MitmConnect,
+			reject: goproxy.RejectConnect,
+		},
 	}
+	// 自行完成上游 TLS 握手，以便按域名出示客户端证书
+	transport.DialTLSContext = w.dialTLS
+	// 通过 goproxy 日志识别客户端拒绝证书的握手
+	proxy.Logger = &proxyLogger{scope: w.GetMitmScope}
+	return w
+}
+
+// GetMitmScope 获取 MITM 解密范围
+func (w *Wrapper) GetMitmScope() *MitmScope {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.mitmScope
+}
+
+// GetUpstreamTLS 获取上游证书校验策略
+func (w *Wrapper) GetUpstreamTLS() *UpstreamTLS {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.upstreamTLS
+}
+
+// GetClientCerts 获取上游客户端证书列表
+func (w *Wrapper) GetClientCerts() *ClientCerts {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.clientCerts
+}
+
+// SetUpstreamTLS 更新上游证书校验策略和客户端证书，并关闭按旧策略建立的空闲连接
+func (w *Wrapper) SetUpstreamTLS(cfg config.UpstreamTLSConfig) error {
+	commit, err := w.PrepareUpstreamTLS(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareUpstreamTLS 检查上游证书配置并加载证书，返回的函数应用配置，不会失败
+func (w *Wrapper) PrepareUpstreamTLS(cfg config.UpstreamTLSConfig) (func(), error) {
+	commitTLS, err := w.GetUpstreamTLS().Prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	commitCerts, err := w.GetClientCerts().Prepare(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		commitTLS()
+		commitCerts()
+		w.CloseIdleConnections()
+	}, nil
+}
+
+// dialTLS 建立上游 TLS 连接，匹配到客户端证书时在握手中出示
+// 服务器不要求客户端证书时不会发送，所以对其他域名没有影响
+func (w *Wrapper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := w.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := w.GetUpstreamTLS().tlsConfig()
+	tlsConfig.ServerName = host
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	if cert := w.GetClientCerts().Match(host); cert != nil {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+
+	// 自定义 DialTLSContext 时 Transport 在握手完成后才回调 TLS 握手的 httptrace，由这里按实际时间回调
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	hsCtx, cancel := context.WithTimeout(ctx, w.transport.TLSHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.HandshakeContext(hsCtx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// roundTrip 转发请求到上游，证书校验失败时返回 502 并记录证书信息
+// goproxy 在 MITM 连接上遇到转发错误会直接断开，客户端看不到原因，所以这里转换成响应
+func (w *Wrapper) roundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	rec := recorderFrom(ctx)
+	resp, err := w.transport.RoundTrip(rec.Trace(req))
+	if err == nil {
+		rec.Upstream(resp)
+		if session := sessionFrom(ctx); session != nil {
+			session.upstreamResp = true
+		}
+		return resp, nil
+	}
+
+	var certErr *CertError
+	if !errors.As(err, &certErr) {
+		// MITM 连接上转发失败时 goproxy 不会调用响应处理器
+		rec.Fail(err)
+		return nil, err
+	}
+	log.Printf("[UpstreamTLS] %v (subject: %s, issuer: %s, sha256: %s)", certErr, certErr.Subject, certErr.Issuer, certErr.Fingerprint)
+	logger.GetBroadcaster().LogError(req.URL.String(), certErr.Details())
+	return certErrorResponse(req, certErr), nil
 }
 
 func (w *Wrapper) SetEngine(engine *rules.Engine) *Wrapper {
@@ -68,6 +230,32 @@ func (w *Wrapper) SetEngine(engine *rules.Engine) *Wrapper {
 	return w
 }
 
+// SetDomainFilter 设置域名过滤器，为 nil 时不过滤
+func (w *Wrapper) SetDomainFilter(filter *domainfilter.DomainFilter) *Wrapper {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.domainFilter = filter
+	return w
+}
+
+func (w *Wrapper) GetDomainFilter() *domainfilter.DomainFilter {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.domainFilter
+}
+
+// isDomainAllowed 检查域名是否通过域名过滤
+func (w *Wrapper) isDomainAllowed(host string) bool {
+	filter := w.GetDomainFilter()
+	return filter == nil || filter.IsAllowed(host)
+}
+
+// isConnectAllowed 检查 CONNECT 目标域名，并计入域名统计
+func (w *Wrapper) isConnectAllowed(host string) bool {
+	filter := w.GetDomainFilter()
+	return filter == nil || filter.CheckConnect(host)
+}
+
 func (w *Wrapper) SetPort(port int) *Wrapper {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -102,13 +290,12 @@ func (w *Wrapper) Stop() {
 	}
 }
 
-func (w *Wrapper) SetCA(cert, key []byte) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	w.caCert = cert
-	w.caKey = key
+// CloseIdleConnections 关闭上游空闲连接，使新的 TLS 设置对后续请求立即生效
+func (w *Wrapper) CloseIdleConnections() {
+	w.transport.CloseIdleConnections()
+}
 
+func (w *Wrapper) SetCA(cert, key []byte) error {
 	goproxyCa, err := tls.X509KeyPair(cert, key)
 	if err != nil {
 		return err
@@ -118,15 +305,62 @@ func (w *Wrapper) SetCA(cert, key []byte) error {
 		return err
 	}
 
-	goproxy.GoproxyCa = goproxyCa
-	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	tlsConfig := w.tlsConfigFromCA(&goproxyCa)
+	actions := &connectActions{
+		accept: &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: tlsConfig},
+		mitm:   &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: tlsConfig},
+		reject: &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: tlsConfig},
+	}
+
+	w.mu.Lock()
+	w.caCert = cert
+	w.caKey = key
+	w.connect = actions
+	w.mu.Unlock()
 
+	// 更换 CA 后旧的叶子证书不再可信
+	w.certCache.purge()
 	return nil
 }
 
+// connectActionsFor 获取当前 CA 对应的 CONNECT 动作
+func (w *Wrapper) connectActionsFor() *connectActions {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.connect
+}
+
+// tlsConfigFromCA 返回 MITM 握手使用的 TLS 配置
+// 叶子证书按 SNI 从缓存中获取，客户端未发送 SNI 时使用 CONNECT 的目标主机
+func (w *Wrapper) tlsConfigFromCA(ca *tls.Certificate) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		connectHost := domainfilter.NormalizeHost(host)
+		return &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				name := hello.ServerName
+				if name == "" {
+					name = connectHost
+				}
+				cert, err := w.certCache.get(strings.ToLower(name), ca)
+				if err != nil {
+					log.Printf("[MITM] 签发 %s 的证书失败: %v", name, err)
+				}
+				return cert, err
+			},
+		}, nil
+	}
+}
+
+// SetCertOptions 设置叶子证书缓存容量、有效期和密钥类型
+func (w *Wrapper) SetCertOptions(cfg config.MitmConfig) {
+	w.certCache.configure(cfg.CertCacheSize, cfg.CertCacheTTL, cfg.LeafKeyType)
+}
+
+// CertCacheStats 获取叶子证书缓存统计
+func (w *Wrapper) CertCacheStats() CertCacheStats {
+	return w.certCache.stats()
+}
+
 func (w *Wrapper) ExportCert() []byte {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
@@ -135,45 +369,42 @@ func (w *Wrapper) ExportCert() []byte {
 
 // shouldMitm 检查是否需要对该域名进行 MITM
 func (w *Wrapper) shouldMitm(host string) bool {
-	// 只对包含 qmai.cn 的域名进行 MITM
-	if strings.Contains(host, "qmai.cn") {
-		return true
-	}
-	return false
+	return w.GetMitmScope().ShouldMitm(host)
 }
 
 func (w *Wrapper) EnableMITM() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// 获取域名过滤器
-	domainFilter := domainfilter.GetFilter()
-
-	// 设置代理认证（使用 goproxy 内置的认证机制）
-	if w.authEnabled {
-		auth.ProxyBasic(w.proxy, "SunnyProxy", func(user, passwd string) bool {
-			if user == w.authUser && passwd == w.authPass {
-				return true
-			}
-			log.Printf("[Auth] 认证失败，用户名: %s", user)
-			return false
-		})
-		log.Printf("[Auth] 代理认证已启用")
-	}
-
 	// HTTPS 请求处理（CONNECT方法）
 	w.proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		actions := w.connectActionsFor()
+
+		// 代理认证，隧道内的请求沿用 CONNECT 的认证结果
+		user, resp := w.authenticate(ctx.Req, host)
+		if resp != nil {
+			ctx.Resp = resp
+			return actions.reject, host
+		}
+		ctx.UserData = &clientSession{user: user}
+
+		if resp := w.checkRateLimit(ctx.Req, user); resp != nil {
+			ctx.Resp = resp
+			return actions.reject, host
+		}
+
 		// 检查域名白名单，不在白名单直接断开
-		if !domainFilter.IsAllowed(host) {
-			return goproxy.RejectConnect, host
+		if !w.isConnectAllowed(host) {
+			w.reportViolation(ctx.Req, ipfilter.OffenceDomainDenied)
+			return actions.reject, host
 		}
 
 		if w.shouldMitm(host) {
 			// 需要处理的域名：进行 MITM 解密
-			return goproxy.MitmConnect, host
+			return actions.mitm, host
 		}
 		// 其他域名：直接透传，不解密
-		return goproxy.OkConnect, host
+		return actions.accept, host
 	})
 
 	// HTTP 请求处理
@@ -183,20 +414,55 @@ func (w *Wrapper) EnableMITM() {
 			host = req.URL.Host
 		}
 
+		// 普通 HTTP 请求每次都要认证，CONNECT 隧道内的请求已在建立隧道时认证
+		session := sessionFrom(ctx)
+		replay := replayFrom(req)
+		switch {
+		case session != nil:
+		case replay != nil:
+			// 管理接口发起的重放已通过 Web 认证
+			session = &clientSession{user: replay.user}
+			ctx.UserData = session
+		default:
+			user, resp := w.authenticate(req, host)
+			if resp != nil {
+				return req, resp
+			}
+			session = &clientSession{user: user}
+			ctx.UserData = session
+		}
+		session.recorder = nil
+		session.upstreamResp = false
+
+		// 隧道内解密后的每个请求也计入请求速率
+		if replay == nil {
+			if resp := w.checkRateLimit(req, session.user); resp != nil {
+				return req, resp
+			}
+		}
+
+		// 通过认证和限流的请求才记录，被域名过滤拒绝的也记录
+		session.recorder = w.GetCapture().Begin(req, clientIP(req), session.user)
+		if replay != nil {
+			session.recorder.SetReplayOf(replay.original)
+			replay.flowID = session.recorder.ID()
+		}
+
 		// 检查域名白名单，不在白名单直接断开（返回空响应触发连接关闭）
-		if !domainFilter.IsAllowed(host) {
+		if !w.isDomainAllowed(host) {
+			if replay == nil {
+				w.reportViolation(req, ipfilter.OffenceDomainDenied)
+			}
 			return req, goproxy.NewResponse(req, "text/plain", http.StatusForbidden, "")
 		}
 
+		// 能收到解密后的 HTTPS 请求，说明客户端接受了证书
+		if req.URL.Scheme == "https" && replay == nil {
+			w.GetMitmScope().recordHandshakeSuccess(host)
+		}
+
+		ctx.RoundTripper = goproxy.RoundTripperFunc(w.roundTrip)
+
 		return req, nil
 	})
 }
-
-// SetAuth 设置代理认证
-func (w *Wrapper) SetAuth(username, password string) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.authUser = username
-	w.authPass = password
-	w.authEnabled = true
-}
@@ -0,0 +1,41 @@
+package ratelimit
+
+import "time"
+
+// bucket 令牌桶，速率和容量在每次调用时传入，配置热更新后立即对已有客户端生效
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate, burst float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// allow 令牌足够时取走 n 个并返回 true，不足时不扣除
+func (b *bucket) allow(rate, burst, n float64, now time.Time) bool {
+	b.refill(rate, burst, now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve 预支 n 个令牌，返回需要等待的时间；令牌可以欠账，由等待来偿还
+func (b *bucket) reserve(rate, burst, n float64, now time.Time) time.Duration {
+	b.refill(rate, burst, now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
@@ -0,0 +1,359 @@
+package ratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sunnyproxy/internal/netutil"
+	"sunnyproxy/pkg/config"
+)
+
+// 拒绝原因
+const (
+	ReasonRequests    = "requests"    // 请求速率超限
+	ReasonConnections = "connections" // 并发连接数超限
+)
+
+const (
+	// 没有连接且超过该时间未活动的客户端状态会被清理
+	idleTTL = 10 * time.Minute
+	// 同一客户端的拒绝事件在该时间内只上报一次，避免刷屏
+	reportInterval = 10 * time.Second
+)
+
+// Stats 限流统计
+type Stats struct {
+	Enabled             bool   `json:"enabled"`
+	ActiveConnections   int    `json:"active_connections"`
+	TrackedIPs          int    `json:"tracked_ips"`
+	TrackedUsers        int    `json:"tracked_users"`
+	RejectedRequests    uint64 `json:"rejected_requests"`
+	RejectedConnections uint64 `json:"rejected_connections"`
+	Throttled           uint64 `json:"throttled"` // 因带宽限制而等待的次数
+}
+
+// limits 解析后的限流参数，0 表示不限制
+type limits struct {
+	rate     float64
+	burst    float64
+	maxConns int
+	bps      float64
+}
+
+func parseLimits(name string, cfg config.RateLimits) (limits, error) {
+	if cfg.RequestsPerSecond < 0 || cfg.Burst < 0 || cfg.MaxConnections < 0 || cfg.BytesPerSecond < 0 {
+		return limits{}, fmt.Errorf("%s: 限流参数不能为负数", name)
+	}
+	l := limits{
+		rate:     cfg.RequestsPerSecond,
+		burst:    float64(cfg.Burst),
+		maxConns: cfg.MaxConnections,
+		bps:      float64(cfg.BytesPerSecond),
+	}
+	if l.burst < l.rate {
+		l.burst = l.rate
+	}
+	if l.rate > 0 && l.burst < 1 {
+		l.burst = 1
+	}
+	return l, nil
+}
+
+// clientState 单个 IP 或用户的限流状态
+type clientState struct {
+	reqs       bucket
+	bytes      bucket
+	conns      int
+	lastSeen   time.Time
+	lastReport time.Time
+}
+
+// Limiter 代理端口的令牌桶限流，按客户端 IP 和认证用户分别计算
+// 连接数和带宽在监听器上统计，请求速率由代理在认证之后检查
+type Limiter struct {
+	mu       sync.Mutex
+	enabled  bool
+	perIP    limits
+	perUser  limits
+	exempt   *netutil.CIDRList
+	ips      map[string]*clientState
+	users    map[string]*clientState
+	conns    map[string]*conn // 以连接的 RemoteAddr 为 key，用于把认证用户关联到连接
+	onReject func(ip, user, reason string)
+
+	rejectedRequests    atomic.Uint64
+	rejectedConnections atomic.Uint64
+	throttled           atomic.Uint64
+}
+
+// New 根据配置创建限流器
+func New(cfg config.RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{
+		ips:   make(map[string]*clientState),
+		users: make(map[string]*clientState),
+		conns: make(map[string]*conn),
+	}
+	if err := l.Update(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Update 重新应用配置，配置无效时保持原有状态不变；已有客户端的令牌桶按新速率继续计算
+func (l *Limiter) Update(cfg config.RateLimitConfig) error {
+	commit, err := l.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// Prepare 检查配置并构建新状态，返回的函数应用新状态，不会失败
+func (l *Limiter) Prepare(cfg config.RateLimitConfig) (func(), error) {
+	perIP, err := parseLimits("per_ip", cfg.PerIP)
+	if err != nil {
+		return nil, err
+	}
+	perUser, err := parseLimits("per_user", cfg.PerUser)
+	if err != nil {
+		return nil, err
+	}
+	exempt, err := netutil.ParseCIDRList(cfg.Exempt)
+	if err != nil {
+		return nil, fmt.Errorf("exempt: %v", err)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.enabled = cfg.Enabled
+		l.perIP = perIP
+		l.perUser = perUser
+		l.exempt = exempt
+	}, nil
+}
+
+// SetOnReject 设置拒绝回调，同一客户端在 reportInterval 内只回调一次
+func (l *Limiter) SetOnReject(fn func(ip, user, reason string)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onReject = fn
+}
+
+func (l *Limiter) IsEnabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enabled
+}
+
+func (l *Limiter) ipState(ip string, now time.Time) *clientState {
+	s, ok := l.ips[ip]
+	if !ok {
+		s = &clientState{}
+		l.ips[ip] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+func (l *Limiter) userState(user string, now time.Time) *clientState {
+	if user == "" {
+		return nil
+	}
+	s, ok := l.users[user]
+	if !ok {
+		s = &clientState{}
+		l.users[user] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// active 检查该 IP 是否需要限流，调用方需持有锁
+func (l *Limiter) active(ip string) bool {
+	if !l.enabled {
+		return false
+	}
+	addr, err := netutil.ParseAddr(ip)
+	return err != nil || !l.exempt.Contains(addr)
+}
+
+// reject 记录一次拒绝，返回需要调用的上报回调（在释放锁之后调用），调用方需持有锁
+func (l *Limiter) reject(s *clientState, ip, user, reason string, now time.Time) func() {
+	if reason == ReasonConnections {
+		l.rejectedConnections.Add(1)
+	} else {
+		l.rejectedRequests.Add(1)
+	}
+	if l.onReject == nil || now.Sub(s.lastReport) < reportInterval {
+		return func() {}
+	}
+	s.lastReport = now
+	fn := l.onReject
+	return func() { fn(ip, user, reason) }
+}
+
+// AllowRequest 检查请求速率，remoteAddr 为连接地址，user 为认证用户（未认证时为空）
+// 同时把用户关联到连接上，用于按用户统计并发连接数和带宽
+func (l *Limiter) AllowRequest(remoteAddr, user string) bool {
+	now := time.Now()
+	ip := hostOf(remoteAddr)
+
+	l.mu.Lock()
+	if !l.active(ip) {
+		l.mu.Unlock()
+		return true
+	}
+
+	ipState := l.ipState(ip, now)
+	userState := l.userState(user, now)
+
+	if c, ok := l.conns[remoteAddr]; ok && user != "" && c.user != user {
+		if l.perUser.maxConns > 0 && userState.conns >= l.perUser.maxConns {
+			report := l.reject(userState, ip, user, ReasonConnections, now)
+			l.mu.Unlock()
+			report()
+			return false
+		}
+		if old := l.users[c.user]; old != nil {
+			old.conns--
+		}
+		c.user = user
+		userState.conns++
+	}
+
+	if l.perIP.rate > 0 && !ipState.reqs.allow(l.perIP.rate, l.perIP.burst, 1, now) {
+		report := l.reject(ipState, ip, user, ReasonRequests, now)
+		l.mu.Unlock()
+		report()
+		return false
+	}
+	if userState != nil && l.perUser.rate > 0 && !userState.reqs.allow(l.perUser.rate, l.perUser.burst, 1, now) {
+		report := l.reject(userState, ip, user, ReasonRequests, now)
+		l.mu.Unlock()
+		report()
+		return false
+	}
+	l.mu.Unlock()
+	return true
+}
+
+// acceptConn 新连接计入该 IP 的连接数，超过上限时返回 false
+func (l *Limiter) acceptConn(c *conn) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	s := l.ipState(c.ip, now)
+	if l.active(c.ip) && l.perIP.maxConns > 0 && s.conns >= l.perIP.maxConns {
+		report := l.reject(s, c.ip, "", ReasonConnections, now)
+		l.mu.Unlock()
+		report()
+		return false
+	}
+	s.conns++
+	l.conns[c.key] = c
+	l.mu.Unlock()
+	return true
+}
+
+// release 连接关闭时扣减连接数
+func (l *Limiter) release(c *conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s := l.ips[c.ip]; s != nil {
+		s.conns--
+	}
+	if s := l.users[c.user]; s != nil && c.user != "" {
+		s.conns--
+	}
+	if l.conns[c.key] == c {
+		delete(l.conns, c.key)
+	}
+}
+
+// throttle 按带宽限制预支 n 字节，返回需要等待的时间
+func (l *Limiter) throttle(c *conn, n int) time.Duration {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.active(c.ip) {
+		return 0
+	}
+
+	var wait time.Duration
+	if l.perIP.bps > 0 {
+		s := l.ipState(c.ip, now)
+		wait = s.bytes.reserve(l.perIP.bps, l.perIP.bps, float64(n), now)
+	}
+	if l.perUser.bps > 0 && c.user != "" {
+		s := l.userState(c.user, now)
+		if w := s.bytes.reserve(l.perUser.bps, l.perUser.bps, float64(n), now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		l.throttled.Add(1)
+	}
+	return wait
+}
+
+// Cleanup 清理长时间没有活动的客户端状态
+func (l *Limiter) Cleanup() int {
+	cutoff := time.Now().Add(-idleTTL)
+	removed := 0
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range []map[string]*clientState{l.ips, l.users} {
+		for key, s := range m {
+			if s.conns <= 0 && s.lastSeen.Before(cutoff) {
+				delete(m, key)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// GetStats 获取限流统计
+func (l *Limiter) GetStats() Stats {
+	l.mu.Lock()
+	stats := Stats{
+		Enabled:           l.enabled,
+		ActiveConnections: len(l.conns),
+		TrackedIPs:        len(l.ips),
+		TrackedUsers:      len(l.users),
+	}
+	l.mu.Unlock()
+
+	stats.RejectedRequests = l.rejectedRequests.Load()
+	stats.RejectedConnections = l.rejectedConnections.Load()
+	stats.Throttled = l.throttled.Load()
+	return stats
+}
+
+// TooManyRequests 返回 429 响应
+func TooManyRequests(req *http.Request) *http.Response {
+	body := []byte("429 Too Many Requests")
+	resp := &http.Response{
+		StatusCode:    http.StatusTooManyRequests,
+		Status:        "429 Too Many Requests",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Retry-After", "1")
+	resp.Header.Set("Content-Type", "text/plain")
+	return resp
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"sunnyproxy/internal/netutil"
+)
+
+// 连接数超限时直接写回的响应，此时还没有读取请求
+const connLimitResponse = "HTTP/1.1 429 Too Many Requests\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Length: 21\r\n" +
+	"Retry-After: 1\r\n" +
+	"Connection: close\r\n\r\n" +
+	"429 Too Many Requests"
+
+// Listener 包装监听器，统计每个 IP 的并发连接数并限制带宽
+func (l *Limiter) Listener(ln net.Listener) net.Listener {
+	return &listener{Listener: ln, l: l}
+}
+
+type listener struct {
+	net.Listener
+	l *Limiter
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	for {
+		nc, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		c := &conn{Conn: nc, l: ln.l, key: nc.RemoteAddr().String()}
+		c.ip = hostOf(c.key)
+		if ln.l.acceptConn(c) {
+			return c, nil
+		}
+
+		nc.SetWriteDeadline(time.Now().Add(time.Second))
+		nc.Write([]byte(connLimitResponse))
+		nc.Close()
+	}
+}
+
+// conn 计入连接数的客户端连接，读写时按带宽限制等待
+type conn struct {
+	net.Conn
+	l    *Limiter
+	key  string
+	ip   string
+	user string // 认证后关联的用户，受 Limiter.mu 保护
+	once sync.Once
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if wait := c.l.throttle(c, n); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if wait := c.l.throttle(c, len(b)); wait > 0 {
+		time.Sleep(wait)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { c.l.release(c) })
+	return c.Conn.Close()
+}
+
+// hostOf 从 "IP:端口" 中取出规范化的 IP
+func hostOf(remoteAddr string) string {
+	addr, err := netutil.ParseAddr(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return addr.String()
+}
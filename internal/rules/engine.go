@@ -1,6 +1,8 @@
 package rules
 
 import (
+	"fmt"
+	"log"
 	"regexp"
 	"sort"
 	"strings"
@@ -10,11 +12,21 @@ import (
 	"github.com/google/uuid"
 )
 
+// 命中计数变化后延迟保存，避免每次命中都写文件
+const hitSaveDelay = 5 * time.Second
+
+// AutoDisableFunc 在规则被自动禁用时回调（达到命中上限或超过生效截止时间）
+type AutoDisableFunc func(rule Rule, reason string)
+
 type Engine struct {
-	mu      sync.RWMutex
-	rules   []Rule
-	tokens  []TokenRecord
-	storage *Storage
+	mu            sync.RWMutex
+	rules         []Rule
+	tokens        []TokenRecord
+	storage       *Storage
+	schedules     sync.Map // 调度表达式 -> *Schedule 缓存
+	onAutoDisable AutoDisableFunc
+	hitsDirty     bool        // 命中计数尚未保存
+	hitSave       *time.Timer // 等待中的命中计数保存
 }
 
 func NewEngine(storagePath string) (*Engine, error) {
@@ -85,12 +97,66 @@ func (e *Engine) GetRules() []Rule {
 	return result
 }
 
+// Reload 从磁盘重新加载规则，文件未变化时返回 false
+// 解析或校验失败时保留当前规则不变；命中计数由服务端维护，按规则 ID 沿用，重新启用的规则清零
+func (e *Engine) Reload() (bool, error) {
+	rules, changed, err := e.storage.LoadIfChanged(func(rules []Rule) error {
+		for _, r := range rules {
+			if err := ValidateRule(r); err != nil {
+				return fmt.Errorf("规则 %s 无效: %v", r.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil || !changed {
+		return false, err
+	}
+
+	e.mu.Lock()
+	previous := make(map[string]Rule, len(e.rules))
+	for _, r := range e.rules {
+		previous[r.ID] = r
+	}
+	for i := range rules {
+		old, ok := previous[rules[i].ID]
+		if !ok {
+			continue
+		}
+		if rules[i].Enabled && !old.Enabled {
+			rules[i].HitCount = 0
+		} else {
+			rules[i].HitCount = old.HitCount
+		}
+	}
+	e.rules = rules
+	if e.hitsDirty {
+		// 文件修改期间没能保存的命中计数
+		e.scheduleHitSaveLocked()
+	}
+	e.mu.Unlock()
+	return true, nil
+}
+
+// StoragePath 返回规则持久化文件路径
+func (e *Engine) StoragePath() string {
+	return e.storage.Path()
+}
+
+// SetOnAutoDisable 设置规则自动禁用时的回调
+func (e *Engine) SetOnAutoDisable(fn AutoDisableFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onAutoDisable = fn
+}
+
+// GetEnabledRules 返回当前生效的规则（已启用、处于生效窗口内且命中调度表达式）
 func (e *Engine) GetEnabledRules() []Rule {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	now := time.Now()
 	var result []Rule
 	for _, r := range e.rules {
-		if r.Enabled {
+		if r.Enabled && e.isActive(r, now) {
 			result = append(result, r)
 		}
 	}
@@ -100,7 +166,73 @@ func (e *Engine) GetEnabledRules() []Rule {
 	return result
 }
 
+// isActive 检查规则在指定时间是否处于生效窗口和调度范围内
+func (e *Engine) isActive(r Rule, now time.Time) bool {
+	if r.EnabledFrom != nil && now.Before(*r.EnabledFrom) {
+		return false
+	}
+	if r.EnabledUntil != nil && !now.Before(*r.EnabledUntil) {
+		return false
+	}
+	if r.MaxHits > 0 && r.HitCount >= r.MaxHits {
+		return false
+	}
+	if r.Schedule == "" {
+		return true
+	}
+	sched, err := e.parseSchedule(r.Schedule)
+	if err != nil {
+		return false
+	}
+	return sched.Matches(now)
+}
+
+func (e *Engine) parseSchedule(expr string) (*Schedule, error) {
+	if cached, ok := e.schedules.Load(expr); ok {
+		return cached.(*Schedule), nil
+	}
+	sched, err := ParseSchedule(expr)
+	if err != nil {
+		return nil, err
+	}
+	e.schedules.Store(expr, sched)
+	return sched, nil
+}
+
+// ValidateRule 校验规则的调度表达式、生效窗口和命中上限
+func ValidateRule(rule Rule) error {
+	if rule.Schedule != "" {
+		if _, err := ParseSchedule(rule.Schedule); err != nil {
+			return err
+		}
+	}
+	if rule.EnabledFrom != nil && rule.EnabledUntil != nil && !rule.EnabledFrom.Before(*rule.EnabledUntil) {
+		return fmt.Errorf("enabled_from 必须早于 enabled_until")
+	}
+	if rule.MaxHits < 0 {
+		return fmt.Errorf("max_hits 不能为负数")
+	}
+	if rule.Type == RuleTypeBreakpoint {
+		if rule.Match == "" {
+			return fmt.Errorf("断点规则的 match 不能为空")
+		}
+		if rule.Target != RuleTargetRequest && rule.Target != RuleTargetResponse {
+			return fmt.Errorf("断点规则的 target 必须是 request 或 response")
+		}
+		if pattern, ok := strings.CutPrefix(rule.Match, "regex:"); ok {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("无效的正则表达式: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
 func (e *Engine) AddRule(rule Rule) error {
+	if err := ValidateRule(rule); err != nil {
+		return err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -116,6 +248,10 @@ func (e *Engine) AddRule(rule Rule) error {
 }
 
 func (e *Engine) UpdateRule(id string, rule Rule) error {
+	if err := ValidateRule(rule); err != nil {
+		return err
+	}
+
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -123,6 +259,11 @@ func (e *Engine) UpdateRule(id string, rule Rule) error {
 		if r.ID == id {
 			rule.ID = id
 			rule.CreatedAt = r.CreatedAt
+			// 命中计数由服务端维护，重新启用时清零
+			rule.HitCount = r.HitCount
+			if rule.Enabled && !r.Enabled {
+				rule.HitCount = 0
+			}
 			rule.UpdatedAt = time.Now()
 			e.rules[i] = rule
 			return e.storage.Save(e.rules)
@@ -131,6 +272,24 @@ func (e *Engine) UpdateRule(id string, rule Rule) error {
 	return nil
 }
 
+// SetRuleEnabled 启用/禁用规则，返回规则是否存在；重新启用时命中计数清零
+func (e *Engine) SetRuleEnabled(id string, enabled bool) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, r := range e.rules {
+		if r.ID == id {
+			if enabled && !r.Enabled {
+				e.rules[i].HitCount = 0
+			}
+			e.rules[i].Enabled = enabled
+			e.rules[i].UpdatedAt = time.Now()
+			return true, e.storage.Save(e.rules)
+		}
+	}
+	return false, nil
+}
+
 func (e *Engine) DeleteRule(id string) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -158,6 +317,7 @@ func (e *Engine) ApplyURLRules(url string) (string, []string) {
 		}
 	}
 
+	e.recordHits(applied)
 	return url, applied
 }
 
@@ -175,12 +335,14 @@ func (e *Engine) ApplyHeaderRules(headers map[string]string) (map[string]string,
 		}
 	}
 
+	e.recordHits(applied)
 	return headers, applied
 }
 
 func (e *Engine) ExtractTokens(url string, headers map[string]string) []TokenRecord {
 	rules := e.GetEnabledRules()
 	var tokens []TokenRecord
+	var applied []string
 
 	for _, r := range rules {
 		if r.Type != RuleTypeTokenExtract {
@@ -195,13 +357,138 @@ func (e *Engine) ExtractTokens(url string, headers map[string]string) []TokenRec
 				Timestamp: time.Now(),
 			}
 			tokens = append(tokens, token)
+			applied = append(applied, r.ID)
 			e.addToken(token)
 		}
 	}
 
+	e.recordHits(applied)
 	return tokens
 }
 
+// MatchBreakpoint 返回第一个匹配 URL 的断点规则并计入命中次数
+// match 为 URL 中包含的字符串，以 regex: 开头时按正则匹配
+func (e *Engine) MatchBreakpoint(url string, target RuleTarget) (Rule, bool) {
+	for _, r := range e.GetEnabledRules() {
+		if r.Type != RuleTypeBreakpoint || r.Target != target {
+			continue
+		}
+		if e.MatchesURL(url, r.Match) {
+			e.recordHits([]string{r.ID})
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// recordHits 累加规则命中次数，达到上限的规则会被自动禁用
+func (e *Engine) recordHits(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	var disabled []Rule
+	for _, id := range ids {
+		for i := range e.rules {
+			if e.rules[i].ID != id {
+				continue
+			}
+			e.rules[i].HitCount++
+			if e.rules[i].MaxHits > 0 && e.rules[i].HitCount >= e.rules[i].MaxHits && e.rules[i].Enabled {
+				e.rules[i].Enabled = false
+				e.rules[i].UpdatedAt = time.Now()
+				disabled = append(disabled, e.rules[i])
+			}
+			break
+		}
+	}
+	if len(disabled) > 0 {
+		if err := e.storage.Save(e.rules); err == nil {
+			e.hitsDirty = false
+		}
+	} else {
+		e.scheduleHitSaveLocked()
+	}
+	callback := e.onAutoDisable
+	e.mu.Unlock()
+
+	if callback != nil {
+		for _, r := range disabled {
+			callback(r, fmt.Sprintf("已达到命中上限 %d 次", r.MaxHits))
+		}
+	}
+}
+
+// scheduleHitSaveLocked 标记命中计数已变化，hitSaveDelay 后保存，调用方需持有 e.mu
+func (e *Engine) scheduleHitSaveLocked() {
+	e.hitsDirty = true
+	if e.hitSave == nil {
+		e.hitSave = time.AfterFunc(hitSaveDelay, e.saveHits)
+	}
+}
+
+// saveHits 保存命中计数，规则文件被外部修改且尚未重新加载时跳过，重新加载后再保存
+func (e *Engine) saveHits() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hitSave = nil
+	e.flushHitsLocked()
+}
+
+func (e *Engine) flushHitsLocked() {
+	if !e.hitsDirty {
+		return
+	}
+	saved, err := e.storage.SaveIfUnchanged(e.rules)
+	if err != nil {
+		log.Printf("[Rules] 保存命中计数失败: %v", err)
+		return
+	}
+	if saved {
+		e.hitsDirty = false
+	}
+}
+
+// Close 停止延迟保存并立即保存尚未写入的命中计数
+func (e *Engine) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.hitSave != nil {
+		e.hitSave.Stop()
+		e.hitSave = nil
+	}
+	e.flushHitsLocked()
+}
+
+// DisableExpiredRules 禁用已超过生效截止时间的规则，返回禁用数量
+func (e *Engine) DisableExpiredRules() int {
+	now := time.Now()
+
+	e.mu.Lock()
+	var disabled []Rule
+	for i := range e.rules {
+		r := &e.rules[i]
+		if r.Enabled && r.EnabledUntil != nil && !now.Before(*r.EnabledUntil) {
+			r.Enabled = false
+			r.UpdatedAt = now
+			disabled = append(disabled, *r)
+		}
+	}
+	if len(disabled) > 0 {
+		e.storage.Save(e.rules)
+	}
+	callback := e.onAutoDisable
+	e.mu.Unlock()
+
+	if callback != nil {
+		for _, r := range disabled {
+			callback(r, fmt.Sprintf("已超过生效截止时间 %s", r.EnabledUntil.Format(time.RFC3339)))
+		}
+	}
+	return len(disabled)
+}
+
 func (e *Engine) addToken(token TokenRecord) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule 是解析后的类 cron 表达式（分 时 日 月 周）
+// 规则在表达式匹配的每一分钟内生效，例如 "* 9-18 * * 1-5" 表示工作日 9:00-18:59 生效
+type Schedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+type fieldBounds struct {
+	min, max int
+}
+
+var scheduleFields = []fieldBounds{
+	{0, 59}, // 分
+	{0, 23}, // 时
+	{1, 31}, // 日
+	{1, 12}, // 月
+	{0, 7},  // 周（0 和 7 都表示周日）
+}
+
+// ParseSchedule 解析 5 段式 cron 表达式，支持 *、数字、a-b 区间、/n 步长和逗号列表
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("调度表达式需要 5 段（分 时 日 月 周），实际 %d 段", len(fields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseField(field, scheduleFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("调度表达式第 %d 段 %q 无效: %v", i+1, field, err)
+		}
+		bits[i] = b
+	}
+
+	// 周日统一用 0 表示
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+		bits[4] &^= 1 << 7
+	}
+
+	return &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseField(field string, bounds fieldBounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx != -1 {
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("步长无效")
+			}
+			step = s
+			part = part[:idx]
+		}
+
+		lo, hi := bounds.min, bounds.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			rng := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(rng[0]); err != nil {
+				return 0, fmt.Errorf("区间起点无效")
+			}
+			if hi, err = strconv.Atoi(rng[1]); err != nil {
+				return 0, fmt.Errorf("区间终点无效")
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("不是有效数字")
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = bounds.max
+			}
+		}
+
+		if lo < bounds.min || hi > bounds.max || lo > hi {
+			return 0, fmt.Errorf("取值超出范围 %d-%d", bounds.min, bounds.max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Matches 检查给定时间所在的分钟是否命中调度表达式
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	// 与标准 cron 一致：日和周都被限定时，满足其一即可
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,87 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"empty", ""},
+		{"too few fields", "* * * *"},
+		{"too many fields", "* * * * * *"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "* 24 * * *"},
+		{"day zero", "* * 0 * *"},
+		{"month out of range", "* * * 13 *"},
+		{"weekday out of range", "* * * * 8"},
+		{"reversed range", "* 18-9 * * *"},
+		{"open range", "* 9- * * *"},
+		{"negative", "-1 * * * *"},
+		{"zero step", "*/0 * * * *"},
+		{"negative step", "*/-1 * * * *"},
+		{"bad step", "*/x * * * *"},
+		{"not a number", "a * * * *"},
+		{"empty list item", "1,,2 * * * *"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSchedule(tt.expr); err == nil {
+				t.Errorf("ParseSchedule(%q) expected error", tt.expr)
+			}
+		})
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	// 2024-01-01 是周一
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 30, 0, time.Local)
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		time time.Time
+		want bool
+	}{
+		{"every minute", "* * * * *", at(1, 0, 0), true},
+		{"workday hours start", "* 9-18 * * 1-5", at(1, 9, 0), true},
+		{"workday hours end", "* 9-18 * * 1-5", at(1, 18, 59), true},
+		{"workday after hours", "* 9-18 * * 1-5", at(1, 19, 0), false},
+		{"weekend", "* 9-18 * * 1-5", at(6, 10, 0), false},
+		{"step", "*/15 * * * *", at(1, 3, 45), true},
+		{"step miss", "*/15 * * * *", at(1, 3, 46), false},
+		{"step from number", "5/20 * * * *", at(1, 3, 45), true},
+		{"step in range", "10-30/10 * * * *", at(1, 3, 30), true},
+		{"step in range miss", "10-30/10 * * * *", at(1, 3, 40), false},
+		{"list", "0,30 * * * *", at(1, 3, 30), true},
+		{"sunday as 0", "* * * * 0", at(7, 12, 0), true},
+		{"sunday as 7", "* * * * 7", at(7, 12, 0), true},
+		{"sunday 7 not monday", "* * * * 7", at(8, 12, 0), false},
+		{"month", "* * * 2 *", at(1, 12, 0), false},
+		// 日和周都被限定时满足其一即可
+		{"day or weekday by day", "* * 15 * 0", at(15, 12, 0), true},
+		{"day or weekday by weekday", "* * 15 * 0", at(14, 12, 0), true},
+		{"day or weekday neither", "* * 15 * 0", at(16, 12, 0), false},
+		// 只限定其中一个时按该字段判断
+		{"day only", "* * 15 * *", at(14, 12, 0), false},
+		{"weekday only", "* * * * 0", at(15, 12, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseSchedule(%q): %v", tt.expr, err)
+			}
+			if got := s.Matches(tt.time); got != tt.want {
+				t.Errorf("%q Matches(%s) = %v, want %v", tt.expr, tt.time.Format("Mon 2006-01-02 15:04"), got, tt.want)
+			}
+		})
+	}
+}
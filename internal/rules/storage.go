@@ -1,6 +1,8 @@
 package rules
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -8,8 +10,9 @@ import (
 )
 
 type Storage struct {
-	mu   sync.Mutex
-	path string
+	mu      sync.Mutex
+	path    string
+	lastSum [sha256.Size]byte // 最近一次读写的文件摘要，用于忽略自身写入触发的重载
 }
 
 func NewStorage(path string) (*Storage, error) {
@@ -39,9 +42,71 @@ func (s *Storage) Load() ([]Rule, error) {
 		return nil, err
 	}
 
+	s.lastSum = sha256.Sum256(data)
 	return rules, nil
 }
 
+// LoadIfChanged 仅在文件内容与最近一次读写不同时重新解析
+// validate 通过后才记录文件摘要，无效的文件在下次检查时仍会重新解析并报告错误
+func (s *Storage) LoadIfChanged(validate func([]Rule) error) ([]Rule, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	sum := sha256.Sum256(data)
+	if bytes.Equal(sum[:], s.lastSum[:]) {
+		return nil, false, nil
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, false, err
+	}
+	if err := validate(rules); err != nil {
+		return nil, false, err
+	}
+
+	s.lastSum = sum
+	return rules, true, nil
+}
+
+// SaveIfUnchanged 在文件内容与最近一次读写相同时保存，返回是否已保存
+// 文件已被外部修改（等待重新加载）时不覆盖
+func (s *Storage) SaveIfUnchanged(rules []Rule) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		sum := sha256.Sum256(current)
+		if !bytes.Equal(sum[:], s.lastSum[:]) {
+			return false, nil
+		}
+	}
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return false, err
+	}
+	s.lastSum = sha256.Sum256(data)
+	return true, nil
+}
+
+// Path 返回规则文件路径
+func (s *Storage) Path() string {
+	return s.path
+}
+
 func (s *Storage) Save(rules []Rule) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -51,5 +116,9 @@ func (s *Storage) Save(rules []Rule) error {
 		return err
 	}
 
-	return os.WriteFile(s.path, data, 0644)
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return err
+	}
+	s.lastSum = sha256.Sum256(data)
+	return nil
 }
@@ -7,10 +7,12 @@ import (
 type RuleType string
 
 const (
-	RuleTypeURLReplace    RuleType = "url_replace"
-	RuleTypeHeaderModify  RuleType = "header_modify"
-	RuleTypeTokenExtract  RuleType = "token_extract"
-	RuleTypeBodyReplace   RuleType = "body_replace"
+	RuleTypeURLReplace   RuleType = "url_replace"
+	RuleTypeHeaderModify RuleType = "header_modify"
+	RuleTypeTokenExtract RuleType = "token_extract"
+	RuleTypeBodyReplace  RuleType = "body_replace"
+	// 断点：暂停匹配 URL 的请求或响应（由 target 决定），等待在 Web 界面中处理
+	RuleTypeBreakpoint RuleType = "breakpoint"
 )
 
 type RuleTarget string
@@ -31,6 +33,15 @@ type Rule struct {
 	Enabled   bool       `json:"enabled"`
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
+
+	// 生效时间窗口，为空表示不限制
+	EnabledFrom  *time.Time `json:"enabled_from,omitempty"`
+	EnabledUntil *time.Time `json:"enabled_until,omitempty"`
+	// 类 cron 调度表达式（分 时 日 月 周），为空表示始终生效
+	Schedule string `json:"schedule,omitempty"`
+	// 命中次数上限，达到后自动禁用（0 表示不限制）
+	MaxHits  int `json:"max_hits,omitempty"`
+	HitCount int `json:"hit_count"`
 }
 
 type TokenRecord struct {
@@ -42,14 +53,17 @@ type TokenRecord struct {
 }
 
 type LogEntry struct {
-	ID          string            `json:"id"`
-	Timestamp   time.Time         `json:"timestamp"`
-	Type        string            `json:"type"`
-	Method      string            `json:"method"`
-	URL         string            `json:"url"`
-	StatusCode  int               `json:"status_code,omitempty"`
-	Headers     map[string]string `json:"headers,omitempty"`
-	Modified    bool              `json:"modified"`
-	RulesApplied []string         `json:"rules_applied,omitempty"`
-	Error       string            `json:"error,omitempty"`
+	ID           string            `json:"id"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Type         string            `json:"type"`
+	Method       string            `json:"method"`
+	URL          string            `json:"url"`
+	StatusCode   int               `json:"status_code,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Modified     bool              `json:"modified"`
+	RulesApplied []string          `json:"rules_applied,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Message      string            `json:"message,omitempty"`
+	ClientIP     string            `json:"client_ip,omitempty"`
+	Data         interface{}       `json:"data,omitempty"` // 附加内容，例如断点 ID
 }
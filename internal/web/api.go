@@ -3,15 +3,21 @@ package web
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 
+	"sunnyproxy/internal/ca"
+	"sunnyproxy/internal/ipfilter"
+	"sunnyproxy/internal/logger"
 	"sunnyproxy/internal/proxy"
 	"sunnyproxy/internal/rules"
 )
 
 type API struct {
-	engine  *rules.Engine
-	wrapper *proxy.Wrapper
+	engine    *rules.Engine
+	wrapper   *proxy.Wrapper
+	caManager *ca.Manager
+	ipFilter  *ipfilter.Filter
 }
 
 func NewAPI(engine *rules.Engine, wrapper *proxy.Wrapper) *API {
@@ -26,6 +32,27 @@ func (a *API) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/rules/", a.handleRule)
 	mux.HandleFunc("/api/tokens", a.handleTokens)
 	mux.HandleFunc("/api/status", a.handleStatus)
+	mux.HandleFunc("/api/domains", a.handleDomains)
+	mux.HandleFunc("/api/domains/test", a.handleDomainTest)
+	mux.HandleFunc("/api/domains/stats", a.handleDomainStats)
+	mux.HandleFunc("/api/mitm", a.handleMitm)
+	mux.HandleFunc("/api/mitm/pinned", a.handleMitmPinned)
+	mux.HandleFunc("/api/ca", a.handleCA)
+	mux.HandleFunc("/api/ca/rotate", a.handleCARotate)
+	mux.HandleFunc("/api/ca/import", a.handleCAImport)
+	mux.HandleFunc("/api/client-certs", a.handleClientCerts)
+	mux.HandleFunc("/api/ipfilter", a.handleIPFilter)
+	mux.HandleFunc("/api/ipfilter/whitelist", a.handleIPFilterList)
+	mux.HandleFunc("/api/ipfilter/blacklist", a.handleIPFilterList)
+	mux.HandleFunc("/api/ipfilter/lookup", a.handleIPFilterLookup)
+	mux.HandleFunc("/api/ipfilter/bans", a.handleIPFilterBans)
+	mux.HandleFunc("/api/flows", a.handleFlows)
+	mux.HandleFunc("/api/flows/", a.handleFlow)
+	mux.HandleFunc("/api/flows/export.har", a.handleFlowsExport)
+	mux.HandleFunc("/api/flows/import", a.handleFlowsImport)
+	mux.HandleFunc("/api/flows/diff", a.handleFlowsDiff)
+	mux.HandleFunc("/api/breakpoints", a.handleBreakpoints)
+	mux.HandleFunc("/api/breakpoints/", a.handleBreakpoint)
 	mux.HandleFunc("/ssl", a.handleCertDownload)
 	mux.HandleFunc("/proxy.pac", a.handlePAC)
 }
@@ -52,6 +79,10 @@ func (a *API) handleRules(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
 			return
 		}
+		if err := rules.ValidateRule(rule); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err := a.engine.AddRule(rule); err != nil {
 			http.Error(w, `{"error":"Failed to add rule"}`, http.StatusInternalServerError)
 			return
@@ -80,6 +111,10 @@ func (a *API) handleRule(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Rule ID required"}`, http.StatusBadRequest)
 		return
 	}
+	if ruleID, ok := strings.CutSuffix(id, "/toggle"); ok {
+		a.handleRuleToggle(w, r, ruleID)
+		return
+	}
 
 	switch r.Method {
 	case http.MethodPut:
@@ -88,6 +123,10 @@ func (a *API) handleRule(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
 			return
 		}
+		if err := rules.ValidateRule(rule); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err := a.engine.UpdateRule(id, rule); err != nil {
 			http.Error(w, `{"error":"Failed to update rule"}`, http.StatusInternalServerError)
 			return
@@ -106,6 +145,34 @@ func (a *API) handleRule(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleRuleToggle 启用/禁用规则: POST /api/rules/{id}/toggle {"enabled":true}
+// 与编辑规则分开，operator 角色可以调用
+func (a *API) handleRuleToggle(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+
+	found, err := a.engine.SetRuleEnabled(id, *req.Enabled)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to update rule"}`, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, `{"error":"Rule not found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "updated", "enabled": *req.Enabled})
+}
+
 func (a *API) handleTokens(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -129,20 +196,22 @@ func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
 		"uptime":     time.Now().Format(time.RFC3339),
 		"rules":      len(a.engine.GetRules()),
 		"tokens":     len(a.engine.GetTokens()),
+		"cert_cache": a.wrapper.CertCacheStats(),
 	}
-	json.NewEncoder(w).Encode(status)
-}
-
-func (a *API) handleCertDownload(w http.ResponseWriter, r *http.Request) {
-	cert := a.wrapper.ExportCert()
-	if cert == nil || len(cert) == 0 {
-		http.Error(w, "Certificate not available", http.StatusNotFound)
-		return
+	if proxyAuth := a.wrapper.GetProxyAuth(); proxyAuth != nil {
+		status["proxy_auth"] = proxyAuth.GetStats()
 	}
-
-	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
-	w.Header().Set("Content-Disposition", "attachment; filename=SunnyProxy.cer")
-	w.Write(cert)
+	if limiter := a.wrapper.GetRateLimiter(); limiter != nil {
+		status["rate_limit"] = limiter.GetStats()
+	}
+	if store := a.wrapper.GetCapture(); store != nil {
+		status["capture"] = store.GetStats()
+	}
+	if breakpoints := a.wrapper.GetBreakpoints(); breakpoints != nil {
+		status["breakpoints"] = breakpoints.Stats()
+	}
+	status["websocket"] = logger.GetBroadcaster().Stats()
+	json.NewEncoder(w).Encode(status)
 }
 
 func (a *API) handlePAC(w http.ResponseWriter, r *http.Request) {
@@ -197,3 +266,9 @@ func (a *API) handlePAC(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Write([]byte(pac))
 }
+
+// writeError 以 JSON 格式返回错误信息
+func writeError(w http.ResponseWriter, msg string, code int) {
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	http.Error(w, string(data), code)
+}
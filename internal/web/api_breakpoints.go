@@ -0,0 +1,97 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"sunnyproxy/internal/proxy"
+)
+
+// 断点处理结果的大小上限，修改后的消息体不超过 1MB，base64 编码后略大
+const maxResolutionSize = 2 << 20
+
+// handleBreakpoints 列出暂停中的断点
+//
+//	GET /api/breakpoints
+func (a *API) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	breakpoints := a.wrapper.GetBreakpoints()
+	if breakpoints == nil {
+		json.NewEncoder(w).Encode([]proxy.Breakpoint{})
+		return
+	}
+	json.NewEncoder(w).Encode(breakpoints.List())
+}
+
+// handleBreakpoint 查看或处理一个暂停中的断点
+//
+//	GET  /api/breakpoints/{id}
+//	POST /api/breakpoints/{id}  {"action":"continue","headers":{...},"body":"..."}
+//	POST /api/breakpoints/{id}  {"action":"abort"}
+//	POST /api/breakpoints/{id}  {"action":"mock","status_code":200,"body":"..."}
+func (a *API) handleBreakpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/breakpoints/")
+	if id == "" {
+		http.Error(w, `{"error":"Breakpoint ID required"}`, http.StatusBadRequest)
+		return
+	}
+	breakpoints := a.wrapper.GetBreakpoints()
+	if breakpoints == nil {
+		http.Error(w, `{"error":"Breakpoint not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		bp, ok := breakpoints.Get(id)
+		if !ok {
+			http.Error(w, `{"error":"Breakpoint not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(bp)
+
+	case http.MethodPost:
+		var res proxy.Resolution
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxResolutionSize)).Decode(&res); err != nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		if err := breakpoints.Resolve(id, res); err != nil {
+			if errors.Is(err, proxy.ErrBreakpointNotFound) {
+				http.Error(w, `{"error":"Breakpoint not found"}`, http.StatusNotFound)
+				return
+			}
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "resolved", "action": res.Action})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
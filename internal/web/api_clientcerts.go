@@ -0,0 +1,97 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"sunnyproxy/internal/proxy"
+)
+
+// handleClientCerts 管理访问上游时出示的客户端证书（mTLS）
+//
+//	GET    /api/client-certs                                            列出证书（不含私钥）
+//	POST   /api/client-certs  {"host":".partner.com","cert":"PEM","key":"PEM"}  上传证书
+//	POST   /api/client-certs  {"host":".partner.com","pkcs12":"base64","password":""}
+//	DELETE /api/client-certs?id=...                                     删除 API 上传的证书
+func (a *API) handleClientCerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	certs := a.wrapper.GetClientCerts()
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(certs.List())
+
+	case http.MethodPost:
+		var req struct {
+			Host     string `json:"host"`
+			Cert     string `json:"cert"`
+			Key      string `json:"key"`
+			PKCS12   string `json:"pkcs12"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		if req.Host == "" {
+			http.Error(w, `{"error":"host required"}`, http.StatusBadRequest)
+			return
+		}
+
+		var info proxy.ClientCert
+		var err error
+		switch {
+		case req.PKCS12 != "":
+			var data []byte
+			data, err = base64.StdEncoding.DecodeString(req.PKCS12)
+			if err != nil {
+				http.Error(w, `{"error":"Invalid base64"}`, http.StatusBadRequest)
+				return
+			}
+			info, err = certs.AddPKCS12(req.Host, data, req.Password)
+		case req.Cert != "" && req.Key != "":
+			info, err = certs.Add(req.Host, []byte(req.Cert), []byte(req.Key))
+		default:
+			http.Error(w, `{"error":"cert and key, or pkcs12 required"}`, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.wrapper.CloseIdleConnections()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, `{"error":"id required"}`, http.StatusBadRequest)
+			return
+		}
+		found, err := certs.Remove(id)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, `{"error":"Certificate not found"}`, http.StatusNotFound)
+			return
+		}
+		a.wrapper.CloseIdleConnections()
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"sunnyproxy/internal/domainfilter"
+)
+
+func (a *API) domainFilter(w http.ResponseWriter) *domainfilter.DomainFilter {
+	filter := a.wrapper.GetDomainFilter()
+	if filter == nil {
+		http.Error(w, `{"error":"Domain filter not configured"}`, http.StatusServiceUnavailable)
+	}
+	return filter
+}
+
+// handleDomains 管理域名黑白名单
+//
+//	GET    /api/domains                          获取过滤状态和黑白名单
+//	PUT    /api/domains        {"enabled":true}  启用/禁用过滤
+//	POST   /api/domains        {"list":"allow","pattern":".example.com"}  添加规则
+//	DELETE /api/domains?list=allow&pattern=...   移除规则
+func (a *API) handleDomains(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	filter := a.domainFilter(w)
+	if filter == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled": filter.IsEnabled(),
+			"mode":    filter.GetMode(),
+			"allow":   filter.GetAllowList(),
+			"deny":    filter.GetDenyList(),
+		})
+
+	case http.MethodPut:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		filter.SetEnabled(*req.Enabled)
+		json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+
+	case http.MethodPost:
+		var req struct {
+			List    string `json:"list"`
+			Pattern string `json:"pattern"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		if req.List == "" {
+			req.List = domainfilter.ListAllow
+		}
+		if err := filter.AddPattern(req.List, req.Pattern); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "created"})
+
+	case http.MethodDelete:
+		list := r.URL.Query().Get("list")
+		if list == "" {
+			list = domainfilter.ListAllow
+		}
+		found, err := filter.RemovePattern(list, r.URL.Query().Get("pattern"))
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, `{"error":"Pattern not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDomainTest 测试域名是否会被放行: GET /api/domains/test?host=example.com
+func (a *API) handleDomainTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		http.Error(w, `{"error":"host required"}`, http.StatusBadRequest)
+		return
+	}
+
+	filter := a.domainFilter(w)
+	if filter == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(filter.Test(host))
+}
+
+// handleDomainStats 获取各域名 CONNECT 放行/拒绝次数，DELETE 清空统计
+// GET /api/domains/stats?rejected=1 只返回有拒绝记录的域名
+func (a *API) handleDomainStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	filter := a.domainFilter(w)
+	if filter == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		stats := filter.GetStats()
+		if r.URL.Query().Get("rejected") != "" {
+			rejected := make([]domainfilter.DomainStats, 0, len(stats))
+			for _, s := range stats {
+				if s.Rejected > 0 {
+					rejected = append(rejected, s)
+				}
+			}
+			stats = rejected
+		}
+		json.NewEncoder(w).Encode(stats)
+
+	case http.MethodDelete:
+		filter.ResetStats()
+		json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
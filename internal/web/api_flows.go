@@ -0,0 +1,347 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"sunnyproxy/internal/capture"
+	"sunnyproxy/internal/rules"
+)
+
+// handleFlows 查询捕获的流量概要，按时间倒序，启用持久化时包括磁盘中的流量
+//
+//	GET /api/flows?from=24h&to=&host=.example.com&client=10.0.0.0/8&method=POST&status=5xx&limit=100&offset=0
+func (a *API) handleFlows(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	store := a.wrapper.GetCapture()
+	if store == nil {
+		http.Error(w, `{"error":"Capture not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	q, err := capture.ParseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(store.Query(q))
+}
+
+// handleFlow 获取单条流量的完整内容: GET /api/flows/{id}
+func (a *API) handleFlow(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	store := a.wrapper.GetCapture()
+	if store == nil {
+		http.Error(w, `{"error":"Capture not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/flows/")
+	if id == "" {
+		http.Error(w, `{"error":"Flow ID required"}`, http.StatusBadRequest)
+		return
+	}
+	if flowID, ok := strings.CutSuffix(id, "/replay"); ok {
+		a.handleFlowReplay(w, r, store, flowID)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	flow, ok := store.Get(id)
+	if !ok {
+		http.Error(w, `{"error":"Flow not found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(flow)
+}
+
+// 重放请求的请求体（JSON）大小上限
+const maxReplaySize = 16 << 20
+
+// flowEdits 重放前对原请求的修改，未填写的字段沿用原请求
+type flowEdits struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Headers      http.Header `json:"headers"` // 覆盖同名头部，值为空数组时删除该头部
+	Body         *string     `json:"body"`
+	BodyEncoding string      `json:"body_encoding"` // body 为 base64 编码时填 "base64"
+	InjectToken  bool        `json:"inject_token"`  // 把最近提取到的各个 Token 写入同名请求头
+	BypassRules  bool        `json:"bypass_rules"`  // 不经过改写规则，原样发送
+}
+
+// handleFlowReplay 重新发送捕获的请求，新流量的 replay_of 指向原流量
+//
+//	POST /api/flows/{id}/replay {"method":"POST","headers":{"X-Debug":["1"],"Cookie":[]},"body":"{}","inject_token":true}
+func (a *API) handleFlowReplay(w http.ResponseWriter, r *http.Request, store *capture.Store, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if !store.IsEnabled() {
+		http.Error(w, `{"error":"Capture disabled"}`, http.StatusServiceUnavailable)
+		return
+	}
+	orig, ok := store.Get(id)
+	if !ok {
+		http.Error(w, `{"error":"Flow not found"}`, http.StatusNotFound)
+		return
+	}
+
+	// 请求体可以为空，表示原样重放
+	var edits flowEdits
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReplaySize)).Decode(&edits); err != nil && err != io.EOF {
+		http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+	req, err := replayRequest(r.Context(), orig, &edits)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	injected := []string{}
+	if edits.InjectToken {
+		for name, value := range latestTokens(a.engine.GetTokens()) {
+			req.Header.Set(name, value)
+			injected = append(injected, name)
+		}
+		sort.Strings(injected)
+	}
+	req.RemoteAddr = r.RemoteAddr
+
+	flow, err := a.wrapper.Replay(req, orig.ID, identityFrom(r).Name, edits.BypassRules)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flow":            flow,
+		"injected_tokens": injected,
+	})
+}
+
+// replayRequest 按原流量和修改构造重放的请求
+func replayRequest(ctx context.Context, orig *capture.Flow, edits *flowEdits) (*http.Request, error) {
+	method := orig.Request.Method
+	if edits.Method != "" {
+		method = strings.ToUpper(edits.Method)
+	}
+	rawURL := orig.Request.URL
+	if edits.URL != "" {
+		rawURL = edits.URL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("无效的 URL %q，需要 http 或 https 的完整地址", rawURL)
+	}
+
+	var body []byte
+	switch {
+	case edits.Body == nil && orig.Request.Truncated:
+		return nil, fmt.Errorf("原请求体已被截断（%d 字节），需要在 body 中提供完整的请求体", orig.Request.Size)
+	case edits.Body == nil:
+		body, err = orig.Request.Bytes()
+	case edits.BodyEncoding == "base64":
+		body, err = base64.StdEncoding.DecodeString(*edits.Body)
+	case edits.BodyEncoding == "":
+		body = []byte(*edits.Body)
+	default:
+		return nil, fmt.Errorf("不支持的 body_encoding %q", edits.BodyEncoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无效的请求体: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = orig.Request.Headers.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	// 修改了 URL 时原请求的 Host 头不再适用，除非 headers 中显式指定
+	if edits.URL != "" {
+		req.Header.Del("Host")
+	}
+	for name, values := range edits.Headers {
+		if len(values) == 0 {
+			req.Header.Del(name)
+		} else {
+			req.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	// 长度按新的请求体计算
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	return req, nil
+}
+
+// latestTokens 返回每种 Token 最近一次提取到的值，键为请求头名称
+func latestTokens(tokens []rules.TokenRecord) map[string]string {
+	latest := make(map[string]rules.TokenRecord)
+	for _, t := range tokens {
+		if cur, ok := latest[t.Name]; !ok || t.Timestamp.After(cur.Timestamp) {
+			latest[t.Name] = t
+		}
+	}
+	values := make(map[string]string, len(latest))
+	for name, t := range latest {
+		values[name] = t.Value
+	}
+	return values
+}
+
+// HAR 文件的大小上限
+const maxHARSize = 64 << 20
+
+// handleFlowsExport 把查询到的流量导出为 HAR 1.2 文件，参数同 /api/flows
+//
+//	GET /api/flows/export.har?host=.example.com&from=24h&limit=1000
+func (a *API) handleFlowsExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	store := a.wrapper.GetCapture()
+	if store == nil {
+		http.Error(w, `{"error":"Capture not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	q, err := capture.ParseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var flows []*capture.Flow
+	for _, sum := range store.Query(q) {
+		// 查询之后可能已被淘汰或清理，跳过即可
+		if f, ok := store.Get(sum.ID); ok {
+			flows = append(flows, f)
+		}
+	}
+
+	filename := fmt.Sprintf("sunnyproxy-%s.har", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	json.NewEncoder(w).Encode(capture.ExportHAR(flows))
+}
+
+// handleFlowsImport 导入 HAR 文件（请求体为 HAR 的 JSON），导入的流量使用新的 ID
+//
+//	POST /api/flows/import
+func (a *API) handleFlowsImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	store := a.wrapper.GetCapture()
+	if store == nil {
+		http.Error(w, `{"error":"Capture not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	flows, err := store.ParseHAR(http.MaxBytesReader(w, r.Body, maxHARSize))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store.Import(flows)
+
+	ids := make([]string, 0, len(flows))
+	for _, f := range flows {
+		ids = append(ids, f.ID)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": len(flows),
+		"ids":      ids,
+	})
+}
+
+// handleFlowsDiff 比较两条流量，返回 URL、查询参数、头部和消息体的差异
+//
+//	GET /api/flows/diff?a={id}&b={id}&ignore=X-Nonce,sign
+//
+// Date、追踪 ID 等易变字段默认忽略，ignore 追加要忽略的头部、查询参数或 JSON 字段名
+func (a *API) handleFlowsDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	store := a.wrapper.GetCapture()
+	if store == nil {
+		http.Error(w, `{"error":"Capture not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	idA, idB := params.Get("a"), params.Get("b")
+	if idA == "" || idB == "" {
+		http.Error(w, `{"error":"a and b required"}`, http.StatusBadRequest)
+		return
+	}
+	flowA, ok := store.Get(idA)
+	if !ok {
+		writeError(w, "Flow not found: "+idA, http.StatusNotFound)
+		return
+	}
+	flowB, ok := store.Get(idB)
+	if !ok {
+		writeError(w, "Flow not found: "+idB, http.StatusNotFound)
+		return
+	}
+
+	var ignore []string
+	for _, v := range params["ignore"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				ignore = append(ignore, name)
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(capture.Diff(flowA, flowB, ignore))
+}
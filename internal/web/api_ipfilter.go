@@ -0,0 +1,274 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"sunnyproxy/internal/ipfilter"
+	"sunnyproxy/internal/logger"
+)
+
+// 状态接口中返回的拦截次数最多的 IP 数量
+const topBlockedLimit = 20
+
+type blockedIP struct {
+	IP    string `json:"ip"`
+	Count int    `json:"count"`
+}
+
+// handleIPFilter 查看代理端口 IP 过滤状态，或在运行时启用/禁用
+//
+//	GET  /api/ipfilter                      统计信息
+//	POST /api/ipfilter  {"enabled":false}   启用/禁用（配置文件重新加载后恢复为配置值）
+func (a *API) handleIPFilter(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if a.ipFilter == nil {
+		http.Error(w, `{"error":"IP filter not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(a.ipFilterStats())
+
+	case http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		a.ipFilter.SetEnabled(*req.Enabled)
+		action := "禁用"
+		if *req.Enabled {
+			action = "启用"
+		}
+		logger.GetBroadcaster().LogIPFilter("", fmt.Sprintf("%s 已%s IP 过滤", identityFrom(r).Name, action))
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "updated", "enabled": *req.Enabled})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) ipFilterStats() map[string]interface{} {
+	whitelist, blacklist, totalBlocked := a.ipFilter.GetStats()
+
+	blocked := a.ipFilter.GetBlockedIPs()
+	top := make([]blockedIP, 0, len(blocked))
+	for ip, count := range blocked {
+		top = append(top, blockedIP{IP: ip, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].IP < top[j].IP
+	})
+	if len(top) > topBlockedLimit {
+		top = top[:topBlockedLimit]
+	}
+
+	return map[string]interface{}{
+		"enabled":       a.ipFilter.IsEnabled(),
+		"geoip":         a.ipFilter.GeoIPLoaded(),
+		"whitelist":     whitelist,
+		"blacklist":     blacklist,
+		"bans":          len(a.ipFilter.Bans()),
+		"total_blocked": totalBlocked,
+		"top_blocked":   top,
+	}
+}
+
+// handleIPFilterList 管理白名单/黑名单
+//
+//	GET    /api/ipfilter/whitelist                            列出未过期的记录
+//	POST   /api/ipfilter/whitelist  {"ip":"1.2.3.4","ttl":"24h"}  手动添加，ttl 省略表示永不过期
+//	DELETE /api/ipfilter/whitelist?ip=1.2.3.4                 移除
+//
+// /api/ipfilter/blacklist 用法相同
+func (a *API) handleIPFilterList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if a.ipFilter == nil {
+		http.Error(w, `{"error":"IP filter not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	whitelist := strings.HasSuffix(r.URL.Path, "/whitelist")
+	listName := "黑名单"
+	if whitelist {
+		listName = "白名单"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if whitelist {
+			json.NewEncoder(w).Encode(a.ipFilter.WhitelistEntries())
+		} else {
+			json.NewEncoder(w).Encode(a.ipFilter.BlacklistEntries())
+		}
+
+	case http.MethodPost:
+		var req struct {
+			IP  string `json:"ip"`
+			TTL string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+		if req.IP == "" {
+			http.Error(w, `{"error":"ip required"}`, http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+				http.Error(w, `{"error":"Invalid ttl"}`, http.StatusBadRequest)
+				return
+			}
+		}
+
+		var entry ipfilter.Entry
+		var err error
+		if whitelist {
+			entry, err = a.ipFilter.AddToWhitelist(req.IP, ttl)
+		} else {
+			entry, err = a.ipFilter.AddToBlacklist(req.IP, ttl)
+		}
+		if entry.IP == "" {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			// 已生效，只是持久化失败
+			writeError(w, "保存失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		msg := fmt.Sprintf("%s 添加到%s", identityFrom(r).Name, listName)
+		if ttl > 0 {
+			msg += "，有效期 " + ttl.String()
+		}
+		logger.GetBroadcaster().LogIPFilter(entry.IP, msg)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			http.Error(w, `{"error":"ip required"}`, http.StatusBadRequest)
+			return
+		}
+		var found bool
+		var err error
+		if whitelist {
+			found, err = a.ipFilter.RemoveFromWhitelist(ip)
+		} else {
+			found, err = a.ipFilter.RemoveFromBlacklist(ip)
+		}
+		if !found {
+			http.Error(w, `{"error":"IP not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, "保存失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.GetBroadcaster().LogIPFilter(ip, fmt.Sprintf("%s 从%s移除", identityFrom(r).Name, listName))
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleIPFilterBans 查看和解除自动封禁
+//
+//	GET    /api/ipfilter/bans              当前生效的封禁及累计封禁次数
+//	DELETE /api/ipfilter/bans?ip=1.2.3.4   解除封禁并清除封禁历史
+func (a *API) handleIPFilterBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if a.ipFilter == nil {
+		http.Error(w, `{"error":"IP filter not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(a.ipFilter.Bans())
+
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			http.Error(w, `{"error":"ip required"}`, http.StatusBadRequest)
+			return
+		}
+		found, err := a.ipFilter.Unban(ip)
+		if !found {
+			http.Error(w, `{"error":"IP not banned"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, "保存失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.GetBroadcaster().LogIPFilter(ip, fmt.Sprintf("%s 解除了自动封禁", identityFrom(r).Name))
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleIPFilterLookup 查询 IP 的当前判定结果和 GeoIP 国家: GET /api/ipfilter/lookup?ip=1.2.3.4
+func (a *API) handleIPFilterLookup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if a.ipFilter == nil {
+		http.Error(w, `{"error":"IP filter not available"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	verdict, err := a.ipFilter.Lookup(r.URL.Query().Get("ip"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(verdict)
+}
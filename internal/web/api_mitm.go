@@ -0,0 +1,93 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleMitm 查看或修改 HTTPS 解密范围
+//
+//	GET /api/mitm  获取解密范围和自动透传的域名
+//	PUT /api/mitm  {"all":false,"include":[".qmai.cn"],"exclude":[],"pinning_fallback":true}
+//
+// 通过 API 的修改仅在运行期间有效，配置文件重新加载后以配置文件为准
+func (a *API) handleMitm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Token")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	scope := a.wrapper.GetMitmScope()
+
+	switch r.Method {
+	case http.MethodGet:
+		cfg := scope.Config()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"all":               cfg.All,
+			"include":           cfg.Include,
+			"exclude":           cfg.Exclude,
+			"pinning_fallback":  cfg.PinningFallback,
+			"pinning_threshold": cfg.PinningThreshold,
+			"pinning_ttl":       cfg.PinningTTL.String(),
+			"pinned":            scope.GetPinnedHosts(),
+		})
+
+	case http.MethodPut:
+		var req struct {
+			All             *bool     `json:"all"`
+			Include         *[]string `json:"include"`
+			Exclude         *[]string `json:"exclude"`
+			PinningFallback *bool     `json:"pinning_fallback"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+			return
+		}
+
+		cfg := scope.Config()
+		if req.All != nil {
+			cfg.All = *req.All
+		}
+		if req.Include != nil {
+			cfg.Include = *req.Include
+		}
+		if req.Exclude != nil {
+			cfg.Exclude = *req.Exclude
+		}
+		if req.PinningFallback != nil {
+			cfg.PinningFallback = *req.PinningFallback
+		}
+		if err := scope.Update(cfg); err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMitmPinned 清除自动透传记录，使域名重新尝试解密
+// DELETE /api/mitm/pinned?host=example.com（不带 host 时全部清除）
+func (a *API) handleMitmPinned(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(a.wrapper.GetMitmScope().GetPinnedHosts())
+
+	case http.MethodDelete:
+		removed := a.wrapper.GetMitmScope().ClearPinned(r.URL.Query().Get("host"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted", "removed": removed})
+
+	default:
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
@@ -1,72 +1,483 @@
 package web
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"sunnyproxy/internal/netutil"
 	"sunnyproxy/pkg/config"
 )
 
+// 角色，权限依次递增
+const (
+	RoleViewer   = "viewer"   // 查看实时日志（不含 Token 值）和状态
+	RoleOperator = "operator" // 额外可以查看配置、启停规则、查看 Token 和流量、清除统计
+	RoleAdmin    = "admin"    // 全部权限：编辑规则、CA、域名和证书配置
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+const (
+	sessionCookie     = "sunnyproxy_session"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+// Identity 通过认证的调用方
+type Identity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Via  string `json:"via"` // key / session / disabled
+}
+
+type identityKey struct{}
+
+// identityFrom 获取请求的调用方，认证未启用时为匿名管理员
+func identityFrom(r *http.Request) Identity {
+	if id, ok := r.Context().Value(identityKey{}).(Identity); ok {
+		return id
+	}
+	return Identity{Name: "anonymous", Role: RoleAdmin, Via: "disabled"}
+}
+
+type apiKey struct {
+	name string
+	hash [32]byte
+	role string
+}
+
+type session struct {
+	keyName string
+	expires time.Time
+}
+
 type AuthMiddleware struct {
-	config *config.Config
+	mu       sync.RWMutex
+	security config.SecurityConfig
+	keys     []apiKey
+	sessions map[string]*session
+	allowed  *netutil.CIDRList
+	denied   *netutil.CIDRList
+	trusted  *netutil.CIDRList
+	throttle *loginThrottle
 }
 
 func NewAuthMiddleware(cfg *config.Config) *AuthMiddleware {
-	return &AuthMiddleware{config: cfg}
+	a := &AuthMiddleware{sessions: make(map[string]*session), throttle: newLoginThrottle()}
+	if err := a.SetSecurity(cfg.Security); err != nil {
+		// 配置无效时拒绝所有请求，而不是放行
+		log.Printf("[Web] 认证配置无效，拒绝所有访问: %v", err)
+		a.security = cfg.Security
+		a.denied, _ = netutil.ParseCIDRList([]string{"*"})
+	}
+	return a
+}
+
+// SetSecurity 更新认证配置（配置热加载时调用），配置无效时保持原有状态不变
+// 已登录的会话按密钥名称关联，密钥被删除或角色变化后立即生效
+func (a *AuthMiddleware) SetSecurity(security config.SecurityConfig) error {
+	commit, err := a.PrepareSecurity(security)
+	if err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// PrepareSecurity 检查认证配置，返回的函数应用配置，不会失败
+func (a *AuthMiddleware) PrepareSecurity(security config.SecurityConfig) (func(), error) {
+	keys, err := buildKeys(security)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := netutil.ParseCIDRList(security.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("allowed_ips: %v", err)
+	}
+	denied, err := netutil.ParseCIDRList(security.DeniedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("denied_ips: %v", err)
+	}
+	trusted, err := netutil.ParseCIDRList(security.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %v", err)
+	}
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.security = security
+		a.keys = keys
+		a.allowed = allowed
+		a.denied = denied
+		a.trusted = trusted
+	}, nil
+}
+
+func buildKeys(security config.SecurityConfig) ([]apiKey, error) {
+	var keys []apiKey
+	seen := make(map[string]bool)
+	add := func(name, key, role string) error {
+		if name == "" {
+			return fmt.Errorf("api_keys: 名称不能为空")
+		}
+		if key == "" {
+			return fmt.Errorf("api_keys: %s 的密钥为空", name)
+		}
+		if _, ok := roleLevels[role]; !ok {
+			return fmt.Errorf("api_keys: %s 的角色 %q 无效（viewer/operator/admin）", name, role)
+		}
+		if seen[name] {
+			return fmt.Errorf("api_keys: 名称 %s 重复", name)
+		}
+		seen[name] = true
+		keys = append(keys, apiKey{name: name, hash: sha256.Sum256([]byte(key)), role: role})
+		return nil
+	}
+
+	if security.APIToken != "" {
+		if err := add("default", security.APIToken, RoleAdmin); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range security.APIKeys {
+		if err := add(k.Name, k.Key, k.Role); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (a *AuthMiddleware) getSecurity() config.SecurityConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.security
+}
+
+// lookupKey 查找密钥，比较哈希值并遍历所有密钥，耗时与密钥内容无关
+func (a *AuthMiddleware) lookupKey(key string) (apiKey, bool) {
+	hash := sha256.Sum256([]byte(key))
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var found apiKey
+	ok := false
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+func (a *AuthMiddleware) keyByName(name string) (apiKey, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, k := range a.keys {
+		if k.name == name {
+			return k, true
+		}
+	}
+	return apiKey{}, false
+}
+
+// requestKey 返回请求头中的密钥，没有时为空
+// 不再接受 URL 参数中的 token，避免密钥出现在访问日志和浏览器历史中
+func requestKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Token")
+	if key == "" {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = bearer
+		}
+	}
+	return key
+}
+
+// authenticate 通过请求头中的密钥或会话 Cookie 识别调用方
+func (a *AuthMiddleware) authenticate(r *http.Request) (Identity, bool) {
+	if key := requestKey(r); key != "" {
+		k, ok := a.lookupKey(key)
+		if !ok {
+			return Identity{}, false
+		}
+		return Identity{Name: k.name, Role: k.role, Via: "key"}, true
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Identity{}, false
+	}
+	a.mu.RLock()
+	s, ok := a.sessions[cookie.Value]
+	a.mu.RUnlock()
+	if !ok || time.Now().After(s.expires) {
+		return Identity{}, false
+	}
+	k, ok := a.keyByName(s.keyName)
+	if !ok {
+		return Identity{}, false
+	}
+	return Identity{Name: k.name, Role: k.role, Via: "session"}, true
+}
+
+// isPublic 不需要认证的路径：管理页面、静态资源、证书下载、PAC 和登录
+func isPublic(path string) bool {
+	switch path {
+	case "/", "/ssl", "/proxy.pac", "/api/login", "/api/logout":
+		return true
+	}
+	return strings.HasPrefix(path, "/static/")
+}
+
+// viewerPaths viewer 可以访问的接口，其余只读接口需要 operator
+var viewerPaths = map[string]bool{
+	"/api/status":  true,
+	"/api/logs/ws": true,
+	"/api/whoami":  true,
+}
+
+func isReadOnly(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+}
+
+// requiredRole 返回访问该接口所需的最低角色
+func requiredRole(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case viewerPaths[path] && isReadOnly(r):
+		return RoleViewer
+	case path == "/api/tokens", path == "/api/flows" || strings.HasPrefix(path, "/api/flows/"):
+		// Token 是从流量中提取的用户凭据，捕获的流量中也包含这些凭据
+		return RoleOperator
+	case path == "/api/breakpoints" || strings.HasPrefix(path, "/api/breakpoints/"):
+		// 断点中可以看到并修改请求内容
+		return RoleOperator
+	case strings.HasPrefix(path, "/api/rules/") && strings.HasSuffix(path, "/toggle"):
+		return RoleOperator
+	case path == "/api/mitm/pinned" && r.Method == http.MethodDelete,
+		path == "/api/domains/stats" && r.Method == http.MethodDelete:
+		return RoleOperator
+	case isReadOnly(r):
+		// 配置中包含 CA、证书、名单等信息，不对 viewer 开放
+		return RoleOperator
+	}
+	return RoleAdmin
+}
+
+func roleAllows(role, required string) bool {
+	return roleLevels[role] >= roleLevels[required]
 }
 
 func (a *AuthMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !a.config.Security.Enabled {
+		security := a.getSecurity()
+		if !security.Enabled {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		if r.URL.Path == "/ssl" || r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, "/static/") {
+		// IP 检查在认证之前，覆盖包括公开页面在内的所有路径
+		if !a.isIPAllowed(r) {
+			http.Error(w, `{"error":"IP not allowed"}`, http.StatusForbidden)
+			return
+		}
+
+		if isPublic(r.URL.Path) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		token := r.Header.Get("X-API-Token")
-		if token == "" {
-			token = r.URL.Query().Get("token")
+		// 带密钥的请求与登录一样计入失败次数，会话 Cookie 不受限制
+		addr, hasKey := a.clientAddr(r), requestKey(r) != ""
+		if hasKey && a.rejectThrottled(w, addr) {
+			return
 		}
 
-		if token != a.config.Security.APIToken {
+		id, ok := a.authenticate(r)
+		if hasKey {
+			if ok {
+				a.throttle.reset(addr)
+			} else {
+				a.throttle.fail(addr, time.Now())
+			}
+		}
+		if !ok {
+			if r.URL.Query().Get("token") != "" {
+				http.Error(w, `{"error":"Token in query string is not accepted, use X-API-Token header or /api/login"}`, http.StatusUnauthorized)
+				return
+			}
 			http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
 			return
 		}
 
-		if !a.isIPAllowed(r) {
-			http.Error(w, `{"error":"IP not allowed"}`, http.StatusForbidden)
+		if required := requiredRole(r); !roleAllows(id.Role, required) {
+			writeError(w, fmt.Sprintf("Forbidden: requires %s role", required), http.StatusForbidden)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
 	})
 }
 
-func (a *AuthMiddleware) isIPAllowed(r *http.Request) bool {
-	if len(a.config.Security.AllowedIPs) == 0 {
-		return true
+// login 校验密钥并创建会话，返回会话 ID 和过期时间
+func (a *AuthMiddleware) login(key string) (string, Identity, time.Time, error) {
+	k, ok := a.lookupKey(key)
+	if !ok {
+		return "", Identity{}, time.Time{}, fmt.Errorf("invalid key")
 	}
 
-	for _, allowed := range a.config.Security.AllowedIPs {
-		if allowed == "0.0.0.0/0" || allowed == "*" {
-			return true
-		}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", Identity{}, time.Time{}, err
 	}
+	sid := hex.EncodeToString(buf)
 
-	clientIP := r.RemoteAddr
-	if idx := strings.LastIndex(clientIP, ":"); idx != -1 {
-		clientIP = clientIP[:idx]
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ttl := a.security.SessionTTL
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
 	}
+	expires := time.Now().Add(ttl)
 
-	for _, allowed := range a.config.Security.AllowedIPs {
-		if allowed == clientIP {
-			return true
+	// 顺便清理过期会话
+	now := time.Now()
+	for id, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, id)
 		}
 	}
+	a.sessions[sid] = &session{keyName: k.name, expires: expires}
+	return sid, Identity{Name: k.name, Role: k.role, Via: "session"}, expires, nil
+}
+
+func (a *AuthMiddleware) logout(sid string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, sid)
+}
+
+// handleLogin 用密钥登录，成功后写入 HttpOnly 会话 Cookie
+//
+//	POST /api/login {"key":"..."}
+func (a *AuthMiddleware) handleLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr := a.clientAddr(r)
+	if a.rejectThrottled(w, addr) {
+		return
+	}
+
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+
+	sid, id, expires, err := a.login(req.Key)
+	if err != nil {
+		a.throttle.fail(addr, time.Now())
+		http.Error(w, `{"error":"Invalid key"}`, http.StatusUnauthorized)
+		return
+	}
+	a.throttle.reset(addr)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sid,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":       id.Name,
+		"role":       id.Role,
+		"expires_at": expires,
+	})
+}
+
+// rejectThrottled 该地址密钥校验失败次数过多时返回 429
+func (a *AuthMiddleware) rejectThrottled(w http.ResponseWriter, addr netip.Addr) bool {
+	wait := a.throttle.blocked(addr, time.Now())
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	http.Error(w, `{"error":"Too many failed attempts, try again later"}`, http.StatusTooManyRequests)
+	return true
+}
+
+// handleLogout 注销当前会话
+func (a *AuthMiddleware) handleLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.logout(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out"})
+}
+
+// handleWhoami 返回当前调用方的名称和角色
+func (a *AuthMiddleware) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identityFrom(r))
+}
 
-	return false
+// clientAddr 返回请求的真实客户端 IP，经过受信任的反向代理时取 X-Forwarded-For 中的地址
+func (a *AuthMiddleware) clientAddr(r *http.Request) netip.Addr {
+	a.mu.RLock()
+	trusted := a.trusted
+	a.mu.RUnlock()
+	return netutil.ClientAddr(r, trusted)
+}
+
+// isIPAllowed 黑名单优先；白名单为空时允许所有未被拉黑的地址
+func (a *AuthMiddleware) isIPAllowed(r *http.Request) bool {
+	addr := a.clientAddr(r)
+
+	a.mu.RLock()
+	allowed, denied := a.allowed, a.denied
+	a.mu.RUnlock()
+
+	if !addr.IsValid() {
+		return false
+	}
+	if denied.Contains(addr) {
+		return false
+	}
+	return allowed.Empty() || allowed.Contains(addr)
 }
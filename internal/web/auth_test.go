@@ -0,0 +1,112 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"sunnyproxy/pkg/config"
+)
+
+func testAuth(t *testing.T) *AuthMiddleware {
+	t.Helper()
+	cfg := &config.Config{Security: config.SecurityConfig{
+		Enabled: true,
+		APIKeys: []config.APIKey{{Name: "admin", Key: "secret", Role: RoleAdmin}},
+	}}
+	return NewAuthMiddleware(cfg)
+}
+
+func TestLoginThrottle(t *testing.T) {
+	a := testAuth(t)
+	login := func(remote, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"key":"`+key+`"}`))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		a.handleLogin(rec, req)
+		return rec
+	}
+	apiCall := func(remote, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-API-Token", key)
+		rec := httptest.NewRecorder()
+		a.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+		return rec
+	}
+
+	steps := []struct {
+		name   string
+		call   func(remote, key string) *httptest.ResponseRecorder
+		remote string
+		key    string
+		want   int
+	}{
+		{"success", login, "192.0.2.1:1000", "secret", http.StatusOK},
+		{"failure 1", login, "192.0.2.1:1000", "guess1", http.StatusUnauthorized},
+		{"failure 2", login, "192.0.2.1:1001", "guess2", http.StatusUnauthorized},
+		{"failure 3 via header", apiCall, "192.0.2.1:1002", "guess3", http.StatusUnauthorized},
+		{"failure 4", login, "192.0.2.1:1003", "guess4", http.StatusUnauthorized},
+		{"failure 5", login, "192.0.2.1:1004", "guess5", http.StatusUnauthorized},
+		{"locked out even with the right key", login, "192.0.2.1:1005", "secret", http.StatusTooManyRequests},
+		{"header key locked out too", apiCall, "192.0.2.1:1006", "secret", http.StatusTooManyRequests},
+		{"other address unaffected", login, "192.0.2.2:1000", "secret", http.StatusOK},
+		{"ipv6 failure 1", login, "[2001:db8::1]:1000", "guess", http.StatusUnauthorized},
+		{"ipv6 failure 2", login, "[2001:db8::2]:1000", "guess", http.StatusUnauthorized},
+		{"ipv6 failure 3", login, "[2001:db8::3]:1000", "guess", http.StatusUnauthorized},
+		{"ipv6 failure 4", login, "[2001:db8::4]:1000", "guess", http.StatusUnauthorized},
+		{"ipv6 failure 5", login, "[2001:db8::5]:1000", "guess", http.StatusUnauthorized},
+		{"same ipv6 /64 locked out", login, "[2001:db8::6]:1000", "secret", http.StatusTooManyRequests},
+		{"other ipv6 /64 unaffected", login, "[2001:db8:1::1]:1000", "secret", http.StatusOK},
+	}
+
+	for _, step := range steps {
+		rec := step.call(step.remote, step.key)
+		if rec.Code != step.want {
+			t.Fatalf("%s: status %d, want %d", step.name, rec.Code, step.want)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: missing Retry-After", step.name)
+		}
+	}
+}
+
+func TestLoginThrottleWindow(t *testing.T) {
+	th := newLoginThrottle()
+	addr := netip.MustParseAddr("192.0.2.1")
+	start := time.Now()
+
+	tests := []struct {
+		name     string
+		failures int
+		after    time.Duration
+		blocked  bool
+	}{
+		{"below limit", maxLoginFailures - 1, 0, false},
+		{"at limit", 1, 0, true},
+		{"still in window", 0, loginFailureWindow - time.Second, true},
+		{"window over", 0, loginFailureWindow, false},
+		{"counting restarts", maxLoginFailures - 1, loginFailureWindow, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start.Add(tt.after)
+			for i := 0; i < tt.failures; i++ {
+				th.fail(addr, now)
+			}
+			if got := th.blocked(addr, now) > 0; got != tt.blocked {
+				t.Errorf("blocked = %v, want %v", got, tt.blocked)
+			}
+		})
+	}
+
+	th.fail(addr, start.Add(loginFailureWindow))
+	th.reset(addr)
+	if th.blocked(addr, start.Add(loginFailureWindow)) > 0 {
+		t.Error("reset did not clear failures")
+	}
+}
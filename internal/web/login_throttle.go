@@ -0,0 +1,100 @@
+package web
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// 密钥校验失败的限制：同一地址在 loginFailureWindow 内失败 maxLoginFailures 次后，
+// 在窗口结束前拒绝该地址的登录和密钥认证，防止通过 /api/login 或 X-API-Token 猜测密钥
+const (
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+	// 记录的地址数上限，超过时先清理过期记录，仍然超过时清空
+	maxLoginThrottled = 10000
+)
+
+type loginFailures struct {
+	count int
+	first time.Time
+}
+
+// loginThrottle 按客户端地址统计密钥校验失败次数，IPv6 按 /64 统计
+type loginThrottle struct {
+	mu       sync.Mutex
+	failures map[netip.Addr]*loginFailures
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{failures: make(map[netip.Addr]*loginFailures)}
+}
+
+func throttleKey(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		if p, err := addr.Prefix(64); err == nil {
+			return p.Addr()
+		}
+	}
+	return addr
+}
+
+// blocked 返回该地址还需要等待多久才能再次尝试，未被限制时返回 0
+func (t *loginThrottle) blocked(addr netip.Addr, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := throttleKey(addr)
+	f, ok := t.failures[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(f.first) >= loginFailureWindow {
+		delete(t.failures, key)
+		return 0
+	}
+	if f.count < maxLoginFailures {
+		return 0
+	}
+	return f.first.Add(loginFailureWindow).Sub(now)
+}
+
+// fail 记录一次失败
+func (t *loginThrottle) fail(addr netip.Addr, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := throttleKey(addr)
+	f, ok := t.failures[key]
+	if !ok || now.Sub(f.first) >= loginFailureWindow {
+		if !ok && len(t.failures) >= maxLoginThrottled {
+			t.purgeLocked(now)
+		}
+		f = &loginFailures{first: now}
+		t.failures[key] = f
+	}
+	f.count++
+	if f.count == maxLoginFailures {
+		log.Printf("[Web] %s 密钥校验连续失败 %d 次，%s 内拒绝其登录", addr, f.count, f.first.Add(loginFailureWindow).Sub(now).Round(time.Second))
+	}
+}
+
+// reset 校验成功后清除失败记录
+func (t *loginThrottle) reset(addr netip.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, throttleKey(addr))
+}
+
+func (t *loginThrottle) purgeLocked(now time.Time) {
+	for key, f := range t.failures {
+		if now.Sub(f.first) >= loginFailureWindow {
+			delete(t.failures, key)
+		}
+	}
+	if len(t.failures) >= maxLoginThrottled {
+		t.failures = make(map[netip.Addr]*loginFailures)
+	}
+}
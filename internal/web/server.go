@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 
+	"sunnyproxy/internal/ca"
+	"sunnyproxy/internal/ipfilter"
+	"sunnyproxy/internal/netutil"
 	"sunnyproxy/internal/proxy"
 	"sunnyproxy/internal/rules"
 	"sunnyproxy/pkg/config"
@@ -16,12 +20,13 @@ import (
 var staticFiles embed.FS
 
 type Server struct {
-	config  *config.Config
-	api     *API
-	ws      *WSHandler
-	auth    *AuthMiddleware
-	engine  *rules.Engine
-	wrapper *proxy.Wrapper
+	config     *config.Config
+	api        *API
+	ws         *WSHandler
+	auth       *AuthMiddleware
+	engine     *rules.Engine
+	wrapper    *proxy.Wrapper
+	proxyProto *netutil.ProxyProtocol
 }
 
 func NewServer(cfg *config.Config, engine *rules.Engine, wrapper *proxy.Wrapper) *Server {
@@ -35,12 +40,36 @@ func NewServer(cfg *config.Config, engine *rules.Engine, wrapper *proxy.Wrapper)
 	}
 }
 
+// SetCAManager 设置 CA 管理器，用于证书下载和 CA 管理接口
+func (s *Server) SetCAManager(m *ca.Manager) {
+	s.api.caManager = m
+}
+
+// SetIPFilter 设置代理端口的 IP 过滤器，用于 /api/ipfilter 管理接口
+func (s *Server) SetIPFilter(f *ipfilter.Filter) {
+	s.api.ipFilter = f
+}
+
+// SetProxyProtocol 设置 Web 端口的 PROXY protocol 解析器，nil 表示不启用
+func (s *Server) SetProxyProtocol(p *netutil.ProxyProtocol) {
+	s.proxyProto = p
+}
+
+// PrepareConfig 检查热加载后的配置，返回的函数应用配置，不会失败
+// 端口等监听参数需要重启才能生效
+func (s *Server) PrepareConfig(cfg *config.Config) (func(), error) {
+	return s.auth.PrepareSecurity(cfg.Security)
+}
+
 func (s *Server) GetHandler() http.Handler {
 	mux := http.NewServeMux()
 
 	s.api.RegisterRoutes(mux)
 
 	mux.HandleFunc("/api/logs/ws", s.ws.HandleWebSocket)
+	mux.HandleFunc("/api/login", s.auth.handleLogin)
+	mux.HandleFunc("/api/logout", s.auth.handleLogout)
+	mux.HandleFunc("/api/whoami", s.auth.handleWhoami)
 
 	staticFS, err := fs.Sub(staticFiles, "static")
 	if err == nil {
@@ -57,7 +86,11 @@ func (s *Server) Start() error {
 
 	addr := fmt.Sprintf("%s:%d", s.config.Server.BindIP, s.config.Server.WebPort)
 	log.Printf("Web management interface starting on http://%s\n", addr)
-	return http.ListenAndServe(addr, handler)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(s.proxyProto.Listener(listener), handler)
 }
 
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -93,6 +126,11 @@ const indexHTML = `<!DOCTYPE html>
         .log-entry.response { color: #00d9ff; }
         .log-entry.error { color: #ff6b6b; }
         .log-entry.token { color: #ffd93d; }
+        .log-entry.rule_disabled { color: #ff9f43; }
+        .log-entry.auth_failed { color: #ff6b6b; }
+        .log-entry.ipfilter { color: #ff9f43; }
+        .log-entry.rate_limited { color: #ff9f43; }
+        .log-entry.breakpoint { color: #c56cf0; }
         .log-time { color: #888; margin-right: 10px; }
         .log-modified { background: #ff6b6b; color: #fff; padding: 2px 6px; border-radius: 3px; font-size: 10px; margin-left: 5px; }
         .btn { background: #00d9ff; color: #000; border: none; padding: 8px 16px; border-radius: 5px; cursor: pointer; font-size: 14px; }
@@ -105,6 +143,14 @@ const indexHTML = `<!DOCTYPE html>
         .info { background: #0f0f23; padding: 15px; border-radius: 5px; margin-top: 15px; }
         .info p { margin: 5px 0; color: #888; }
         .info code { background: #333; padding: 2px 6px; border-radius: 3px; color: #00d9ff; }
+        .login { display: none; position: fixed; inset: 0; background: rgba(0,0,0,0.7); align-items: center; justify-content: center; }
+        .login form { background: #16213e; padding: 30px; border-radius: 10px; width: 320px; }
+        .login input { width: 100%; padding: 8px; margin: 15px 0; background: #0f0f23; border: 1px solid #333; color: #eee; border-radius: 5px; }
+        .login .error { color: #ff6b6b; font-size: 12px; min-height: 16px; }
+        .bp-item { background: #0f0f23; padding: 10px; border-radius: 5px; margin-bottom: 10px; font-size: 13px; }
+        .bp-item input, .bp-item textarea { width: 100%; margin: 4px 0; padding: 6px; background: #16213e; border: 1px solid #333; color: #eee; border-radius: 3px; font-family: monospace; font-size: 12px; }
+        .bp-item textarea { height: 80px; }
+        .bp-item .btn { padding: 4px 12px; font-size: 12px; margin-right: 5px; }
     </style>
 </head>
 <body>
@@ -131,9 +177,50 @@ const indexHTML = `<!DOCTYPE html>
                 </div>
             </div>
         </div>
+
+        <div class="card" style="margin-top: 20px;">
+            <h2>断点</h2>
+            <div id="breakpoints"><p class="bp-empty" style="color: #888;">没有暂停的请求</p></div>
+        </div>
+    </div>
+
+    <div class="login" id="login">
+        <form onsubmit="login(event)">
+            <h2 style="color: #00d9ff;">登录</h2>
+            <input type="password" id="login-key" placeholder="API 密钥" autocomplete="current-password">
+            <div class="error" id="login-error"></div>
+            <button class="btn" type="submit">登录</button>
+        </form>
     </div>
 
     <script>
+        function showLogin() {
+            document.getElementById('login').style.display = 'flex';
+        }
+
+        async function login(e) {
+            e.preventDefault();
+            const res = await fetch('/api/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ key: document.getElementById('login-key').value })
+            });
+            if (res.ok) {
+                location.reload();
+            } else {
+                document.getElementById('login-error').textContent = '密钥无效';
+            }
+        }
+
+        async function api(path) {
+            const res = await fetch(path);
+            if (res.status === 401) {
+                showLogin();
+                throw new Error('unauthorized');
+            }
+            return res;
+        }
+
         let ws;
         function connectWS() {
             const wsUrl = (location.protocol === 'https:' ? 'wss:' : 'ws:') + '//' + location.host + '/api/logs/ws';
@@ -150,40 +237,75 @@ const indexHTML = `<!DOCTYPE html>
             ws.onmessage = (e) => {
                 const log = JSON.parse(e.data);
                 addLog(log);
+                if (log.type === 'breakpoint') loadBreakpoints();
             };
         }
 
+        // 日志内容可能来自代理的客户端（URL、用户名等），只能以文本方式写入页面
         function addLog(log) {
             const container = document.getElementById('logs');
             const div = document.createElement('div');
             div.className = 'log-entry ' + log.type;
-            const time = new Date(log.timestamp).toLocaleTimeString();
-            let content = '<span class="log-time">' + time + '</span>';
+            const time = document.createElement('span');
+            time.className = 'log-time';
+            time.textContent = new Date(log.timestamp).toLocaleTimeString();
+            div.appendChild(time);
+            let text = '';
             if (log.type === 'request') {
-                content += '[' + log.method + '] ' + log.url;
-                if (log.modified) content += '<span class="log-modified">MODIFIED</span>';
+                text = '[' + log.method + '] ' + log.url;
             } else if (log.type === 'response') {
-                content += '[' + log.status_code + '] ' + log.url;
+                text = '[' + (log.status_code || 'ERR') + '] ' + log.method + ' ' + log.url;
+                if (log.error) text += ' ' + log.error;
             } else if (log.type === 'token') {
-                content += '[TOKEN] ' + log.url;
+                text = '[TOKEN] ' + log.url;
             } else if (log.type === 'error') {
-                content += '[ERROR] ' + log.error;
+                text = '[ERROR] ' + log.error;
+            } else if (log.type === 'rule_disabled') {
+                text = '[RULE] ' + log.url + ' 已自动禁用: ' + log.message;
+            } else if (log.type === 'auth_failed') {
+                text = '[AUTH] ' + log.client_ip + ' -> ' + log.url + ' ' + log.message;
+            } else if (log.type === 'rate_limited') {
+                text = '[LIMIT] ' + log.client_ip + ' ' + log.message;
+            } else if (log.type === 'breakpoint') {
+                text = '[BREAK] ' + log.message + ' ' + log.method + ' ' + log.url;
+            } else if (log.type === 'ipfilter') {
+                text = '[IP] ' + (log.client_ip ? log.client_ip + ' ' : '') + log.message;
+            }
+            div.appendChild(document.createTextNode(text));
+            if (log.type === 'request' && log.modified) {
+                const modified = document.createElement('span');
+                modified.className = 'log-modified';
+                modified.textContent = 'MODIFIED';
+                div.appendChild(modified);
             }
-            div.innerHTML = content;
             container.insertBefore(div, container.firstChild);
             if (container.children.length > 200) container.removeChild(container.lastChild);
         }
 
         async function loadTokens() {
             try {
-                const res = await fetch('/api/tokens');
-                const tokens = await res.json();
+                const res = await api('/api/tokens');
                 const container = document.getElementById('tokens');
+                if (res.status === 403) {
+                    container.innerHTML = '<p style="color: #888;">需要 operator 权限</p>';
+                    return;
+                }
+                const tokens = await res.json();
                 container.innerHTML = '';
                 tokens.slice(-5).reverse().forEach(t => {
                     const div = document.createElement('div');
                     div.className = 'token-item';
-                    div.innerHTML = '<strong>' + t.name + '</strong><div class="token-value">' + t.value + '</div><button class="copy-btn" onclick="navigator.clipboard.writeText(\'' + t.value + '\')">复制</button>';
+                    // Token 取自被代理的流量，同样只以文本方式写入
+                    const name = document.createElement('strong');
+                    name.textContent = t.name;
+                    const value = document.createElement('div');
+                    value.className = 'token-value';
+                    value.textContent = t.value;
+                    const copy = document.createElement('button');
+                    copy.className = 'copy-btn';
+                    copy.textContent = '复制';
+                    copy.onclick = () => navigator.clipboard.writeText(t.value);
+                    div.append(name, value, copy);
                     container.appendChild(div);
                 });
             } catch (e) { console.error(e); }
@@ -191,15 +313,122 @@ const indexHTML = `<!DOCTYPE html>
 
         async function loadStatus() {
             try {
-                const res = await fetch('/api/status');
+                const res = await api('/api/status');
                 const status = await res.json();
                 document.getElementById('proxy-host').textContent = location.hostname;
                 document.getElementById('proxy-port').textContent = status.proxy_port;
             } catch (e) { console.error(e); }
         }
 
+        let pausedBreakpoints = {};
+        async function loadBreakpoints() {
+            try {
+                const res = await api('/api/breakpoints');
+                const container = document.getElementById('breakpoints');
+                if (res.status === 403) {
+                    container.innerHTML = '<p style="color: #888;">需要 operator 权限</p>';
+                    return;
+                }
+                const list = await res.json();
+                const ids = {};
+                list.forEach(bp => { ids[bp.id] = true; });
+                // 正在编辑的断点保留输入内容，只增删变化的部分
+                Object.keys(pausedBreakpoints).forEach(id => {
+                    if (!ids[id]) {
+                        const el = document.getElementById('bp-' + id);
+                        if (el) el.remove();
+                        delete pausedBreakpoints[id];
+                    }
+                });
+                list.forEach(bp => {
+                    if (!pausedBreakpoints[bp.id]) {
+                        pausedBreakpoints[bp.id] = bp;
+                        container.appendChild(renderBreakpoint(bp));
+                    }
+                });
+                const empty = container.querySelector('.bp-empty');
+                if (list.length === 0 && !empty) {
+                    container.innerHTML = '<p class="bp-empty" style="color: #888;">没有暂停的请求</p>';
+                } else if (list.length > 0 && empty) {
+                    empty.remove();
+                }
+            } catch (e) { console.error(e); }
+        }
+
+        function renderBreakpoint(bp) {
+            const div = document.createElement('div');
+            div.className = 'bp-item';
+            div.id = 'bp-' + bp.id;
+            const title = document.createElement('div');
+            title.textContent = (bp.stage === 'request' ? '[请求] ' : '[响应 ' + bp.status_code + '] ') + bp.method + ' ' + bp.url +
+                '（规则 ' + (bp.rule_name || bp.rule_id) + '，' + new Date(bp.deadline).toLocaleTimeString() + ' 自动放行）';
+            div.appendChild(title);
+            const field = (name, value, tag) => {
+                const el = document.createElement(tag || 'input');
+                el.name = name;
+                el.value = value;
+                el.placeholder = name;
+                div.appendChild(el);
+                return el;
+            };
+            if (bp.stage === 'request') {
+                field('method', bp.method);
+                field('url', bp.url);
+            }
+            field('status_code', bp.stage === 'response' ? bp.status_code : '').placeholder = 'status_code（模拟响应时使用，默认 200）';
+            field('headers', JSON.stringify(bp.headers || {}, null, 2), 'textarea');
+            const body = field('body', bp.body || '', 'textarea');
+            if (bp.body_too_large) {
+                body.disabled = true;
+                body.value = '消息体超过 1MB，原样放行';
+            }
+            [['continue', '放行'], ['abort', '中止'], ['mock', '模拟响应']].forEach(([action, label]) => {
+                const btn = document.createElement('button');
+                btn.className = 'btn';
+                btn.textContent = label;
+                btn.onclick = () => resolveBreakpoint(bp, action);
+                div.appendChild(btn);
+            });
+            return div;
+        }
+
+        async function resolveBreakpoint(bp, action) {
+            const div = document.getElementById('bp-' + bp.id);
+            const value = name => { const el = div.querySelector('[name=' + name + ']'); return el ? el.value : ''; };
+            const payload = { action: action };
+            if (action !== 'abort') {
+                try {
+                    payload.headers = JSON.parse(value('headers'));
+                } catch (e) {
+                    alert('headers 不是有效的 JSON');
+                    return;
+                }
+                if (!bp.body_too_large) {
+                    payload.body = value('body');
+                    if (bp.encoding) payload.encoding = bp.encoding;
+                }
+                const status = parseInt(value('status_code'), 10);
+                if (status && (action === 'mock' || bp.stage === 'response')) payload.status_code = status;
+            }
+            if (action === 'continue' && bp.stage === 'request') {
+                payload.method = value('method');
+                payload.url = value('url');
+            }
+            const res = await fetch('/api/breakpoints/' + bp.id, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify(payload)
+            });
+            if (!res.ok) {
+                const err = await res.json().catch(() => ({}));
+                alert('处理失败: ' + (err.error || res.status));
+            }
+            loadBreakpoints();
+        }
+
         connectWS();
         loadTokens();
+        loadBreakpoints();
         loadStatus();
         setInterval(loadTokens, 5000);
     </script>
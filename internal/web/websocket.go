@@ -1,10 +1,14 @@
 package web
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"sunnyproxy/internal/logger"
+	"sunnyproxy/internal/rules"
 )
 
 var upgrader = websocket.Upgrader{
@@ -13,6 +17,9 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// 客户端消息的大小上限
+const maxWSMessageSize = 64 << 10
+
 type WSHandler struct {
 	broadcaster *logger.Broadcaster
 }
@@ -23,21 +30,66 @@ func NewWSHandler() *WSHandler {
 	}
 }
 
+// wsMessage 客户端发来的消息
+//
+//	{"action":"subscribe","filter":{"host":".example.com","status":"4xx","types":["response"]}}
+//	{"action":"unsubscribe"}  清除过滤条件，接收全部日志
+type wsMessage struct {
+	Action string              `json:"action"`
+	Filter logger.Subscription `json:"filter"`
+}
+
 func (h *WSHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 
-	h.broadcaster.AddClient(conn)
+	// viewer 看不到 Token 等凭据
+	h.broadcaster.AddClient(conn, !roleAllows(identityFrom(r).Role, RoleOperator))
+	conn.SetReadLimit(maxWSMessageSize)
 
 	go func() {
 		defer h.broadcaster.RemoveClient(conn)
 		for {
-			_, _, err := conn.ReadMessage()
+			_, data, err := conn.ReadMessage()
 			if err != nil {
 				break
 			}
+			h.handleMessage(conn, data)
 		}
 	}()
 }
+
+// handleMessage 处理客户端的订阅消息，结果以 type 为 subscription 的日志回复
+func (h *WSHandler) handleMessage(conn *websocket.Conn, data []byte) {
+	reply := rules.LogEntry{
+		ID:        fmt.Sprintf("%d", time.Now().UnixNano()),
+		Timestamp: time.Now(),
+		Type:      "subscription",
+	}
+
+	var msg wsMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		reply.Error = "Invalid JSON"
+		h.broadcaster.Send(conn, reply)
+		return
+	}
+	switch msg.Action {
+	case "subscribe":
+	case "unsubscribe":
+		msg.Filter = logger.Subscription{}
+	default:
+		reply.Error = fmt.Sprintf("未知的 action: %q", msg.Action)
+		h.broadcaster.Send(conn, reply)
+		return
+	}
+
+	if err := h.broadcaster.Subscribe(conn, msg.Filter); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Message = msg.Action + "d"
+		reply.Data = msg.Filter
+	}
+	h.broadcaster.Send(conn, reply)
+}
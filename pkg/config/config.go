@@ -3,42 +3,266 @@ package config
 import (
 	"os"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Security SecurityConfig `yaml:"security"`
-	Logging  LoggingConfig  `yaml:"logging"`
-	Rules    RulesConfig    `yaml:"rules"`
+	Server       ServerConfig       `yaml:"server"`
+	Security     SecurityConfig     `yaml:"security"`
+	Logging      LoggingConfig      `yaml:"logging"`
+	Rules        RulesConfig        `yaml:"rules"`
+	IPFilter     IPFilterConfig     `yaml:"ip_filter"`
+	RateLimit    RateLimitConfig    `yaml:"rate_limit"`
+	DomainFilter DomainFilterConfig `yaml:"domain_filter"`
+	Mitm         MitmConfig         `yaml:"mitm"`
+	CA           CAConfig           `yaml:"ca"`
+	UpstreamTLS  UpstreamTLSConfig  `yaml:"upstream_tls"`
+	Capture      CaptureConfig      `yaml:"capture"`
+	Breakpoints  BreakpointConfig   `yaml:"breakpoints"`
 }
 
 type ServerConfig struct {
-	ProxyPort int    `yaml:"proxy_port"`
-	WebPort   int    `yaml:"web_port"`
-	BindIP    string `yaml:"bind_ip"`
+	ProxyPort     int                 `yaml:"proxy_port"`
+	WebPort       int                 `yaml:"web_port"`
+	BindIP        string              `yaml:"bind_ip"`
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+}
+
+// ProxyProtocolConfig 在负载均衡器后面部署时，通过 PROXY protocol v1/v2 获取真实客户端地址
+// 同时作用于代理端口和 Web 端口
+type ProxyProtocolConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	TrustedCIDRs  []string      `yaml:"trusted_cidrs"`  // 只解析来自这些地址的 PROXY 头，其他连接按原地址处理
+	HeaderTimeout time.Duration `yaml:"header_timeout"` // 读取 PROXY 头的超时时间
 }
 
 type SecurityConfig struct {
-	Enabled    bool     `yaml:"enabled"`
-	APIToken   string   `yaml:"api_token"`
-	AllowedIPs []string `yaml:"allowed_ips"`
+	Enabled        bool            `yaml:"enabled"`
+	APIToken       string          `yaml:"api_token"` // 兼容旧配置，等同于一个名为 default 的 admin 密钥
+	APIKeys        []APIKey        `yaml:"api_keys"`
+	SessionTTL     time.Duration   `yaml:"session_ttl"`     // 登录后 Cookie 会话的有效期
+	AllowedIPs     []string        `yaml:"allowed_ips"`     // Web 管理端 IP 白名单，支持 IPv4/IPv6 和 CIDR，空则允许所有
+	DeniedIPs      []string        `yaml:"denied_ips"`      // Web 管理端 IP 黑名单，优先于白名单
+	TrustedProxies []string        `yaml:"trusted_proxies"` // 受信任的反向代理，只有来自这些地址的 X-Forwarded-For 才会被采信
+	ProxyAuth      ProxyAuthConfig `yaml:"proxy_auth"`
+}
+
+// APIKey Web 管理接口的密钥
+type APIKey struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	Role string `yaml:"role"` // viewer: 查看日志和状态; operator: 启停规则; admin: 全部权限
+}
+
+// ProxyAuthConfig 代理端口的 Basic 认证
+type ProxyAuthConfig struct {
+	Enabled bool        `yaml:"enabled"`
+	Realm   string      `yaml:"realm"`
+	Users   []ProxyUser `yaml:"users"`
+}
+
+// ProxyUser 代理用户，密码使用 bcrypt 哈希保存（sunnyproxy -hash-password 生成）
+type ProxyUser struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
 }
 
 type LoggingConfig struct {
-	Level   string `yaml:"level"`
-	Console bool   `yaml:"console"`
-	File    string `yaml:"file"`
+	Level     string          `yaml:"level"`
+	Console   bool            `yaml:"console"`
+	File      string          `yaml:"file"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+}
+
+// WebSocketConfig 实时日志推送，每个连接有独立的发送队列，慢客户端不会阻塞代理
+type WebSocketConfig struct {
+	QueueSize    int           `yaml:"queue_size"`    // 每个连接排队等待发送的消息上限
+	Policy       string        `yaml:"policy"`        // 队列满时: drop_oldest 丢弃最旧的消息 / disconnect 断开连接
+	WriteTimeout time.Duration `yaml:"write_timeout"` // 单条消息的写入超时，超时断开
+	PingInterval time.Duration `yaml:"ping_interval"` // 心跳间隔，客户端两个间隔内没有回复 pong 时断开
 }
 
 type RulesConfig struct {
 	File string `yaml:"file"`
 }
 
+// IPFilterConfig 代理端口的 IP 过滤，判断顺序：deny_cidrs > allow_cidrs > 内网 > 缓存的判定结果 > GeoIP 国家
+type IPFilterConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	AllowedCountries []string      `yaml:"allowed_countries"` // 允许的国家代码（ISO 3166），为空则允许所有未被拒绝的国家
+	DeniedCountries  []string      `yaml:"denied_countries"`  // 拒绝的国家代码，优先于 allowed_countries
+	FailOpen         bool          `yaml:"fail_open"`         // GeoIP 查询失败或无法确定国家时是否放行
+	AllowCIDRs       []string      `yaml:"allow_cidrs"`       // 始终放行的 IP/网段，优先于 GeoIP
+	DenyCIDRs        []string      `yaml:"deny_cidrs"`        // 始终拒绝的 IP/网段，优先于所有规则
+	AllowPrivate     bool          `yaml:"allow_private"`     // 放行内网和回环地址
+	WhitelistTTL     time.Duration `yaml:"whitelist_ttl"`     // GeoIP 放行结果的缓存时间，到期后重新查询
+	BlacklistTTL     time.Duration `yaml:"blacklist_ttl"`     // GeoIP 拒绝结果的缓存时间
+	GeoIPDB          string        `yaml:"geoip_db"`          // GeoLite2-Country.mmdb 路径，为空则按默认路径搜索
+	StateFile        string        `yaml:"state_file"`        // 黑白名单持久化文件
+	AutoBan          AutoBanConfig `yaml:"auto_ban"`
+}
+
+// AutoBanConfig 自动封禁：统计窗口内违规次数达到阈值的 IP 加入黑名单，重复违规时封禁时间递增
+type AutoBanConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Window        time.Duration `yaml:"window"`         // 违规次数的统计窗口
+	AuthFailures  int           `yaml:"auth_failures"`  // 代理认证失败次数阈值，0 表示不统计
+	DeniedDomains int           `yaml:"denied_domains"` // 访问被域名过滤拒绝的次数阈值
+	RateLimited   int           `yaml:"rate_limited"`   // 被限流的次数阈值（同一客户端 10 秒内只计一次）
+	BanTime       time.Duration `yaml:"ban_time"`       // 首次封禁时长
+	Escalation    float64       `yaml:"escalation"`     // 每次再犯时封禁时长的倍数
+	MaxBanTime    time.Duration `yaml:"max_ban_time"`   // 封禁时长上限
+	ForgetAfter   time.Duration `yaml:"forget_after"`   // 最后一次封禁超过该时间后不再计为再犯
+}
+
+// RateLimitConfig 代理端口的限流，按客户端 IP 和认证用户分别计算，任一超限即拒绝
+type RateLimitConfig struct {
+	Enabled bool       `yaml:"enabled"`
+	PerIP   RateLimits `yaml:"per_ip"`
+	PerUser RateLimits `yaml:"per_user"` // 仅在启用代理认证时生效
+	Exempt  []string   `yaml:"exempt"`   // 不限流的 IP/网段
+}
+
+// RateLimits 一组限流参数，0 表示不限制
+type RateLimits struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"` // 每秒请求数（CONNECT 和隧道内解密的请求都计入）
+	Burst             int     `yaml:"burst"`               // 令牌桶容量，为 0 时等于 requests_per_second
+	MaxConnections    int     `yaml:"max_connections"`     // 同时打开的连接数
+	BytesPerSecond    int64   `yaml:"bytes_per_second"`    // 上下行合计带宽，超出时限速而不是断开
+}
+
+// DomainFilterConfig 域名过滤配置
+// 规则格式: example.com 精确匹配；.example.com 匹配域名及子域名；
+// *.example.com 通配符匹配；regex:... 正则匹配
+type DomainFilterConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Mode    string   `yaml:"mode"` // allowlist: 仅允许白名单；allow_all: 允许除黑名单外的所有域名
+	Allow   []string `yaml:"allow"`
+	Deny    []string `yaml:"deny"`
+	File    string   `yaml:"file"` // 通过 API 修改后的黑白名单持久化文件，存在时优先于 allow/deny
+}
+
+// MitmConfig HTTPS 解密范围配置，域名规则格式与 domain_filter 相同
+type MitmConfig struct {
+	All              bool          `yaml:"all"`               // 解密所有 HTTPS 流量
+	Include          []string      `yaml:"include"`           // 需要解密的域名
+	Exclude          []string      `yaml:"exclude"`           // 不解密的域名，优先于 include/all
+	PinningFallback  bool          `yaml:"pinning_fallback"`  // 客户端拒绝证书时自动改为透传
+	PinningThreshold int           `yaml:"pinning_threshold"` // 连续握手失败多少次后改为透传
+	PinningTTL       time.Duration `yaml:"pinning_ttl"`       // 透传持续时间，到期后重新尝试解密（0 表示一直透传）
+	CertCacheSize    int           `yaml:"cert_cache_size"`   // 叶子证书缓存数量
+	CertCacheTTL     time.Duration `yaml:"cert_cache_ttl"`    // 叶子证书缓存时间
+	LeafKeyType      string        `yaml:"leaf_key_type"`     // 叶子证书密钥类型: ecdsa (P-256) / rsa
+}
+
+// CAConfig MITM 根证书配置
+type CAConfig struct {
+	CertFile     string        `yaml:"cert_file"`
+	KeyFile      string        `yaml:"key_file"`
+	KeyType      string        `yaml:"key_type"`      // 新生成 CA 的密钥类型: rsa / ecdsa
+	ValidityDays int           `yaml:"validity_days"` // 新生成 CA 的有效期（天）
+	GracePeriod  time.Duration `yaml:"grace_period"`  // 轮换 CA 时新证书的生效等待期
+}
+
+// UpstreamTLSConfig 代理到上游服务器的 TLS 证书校验配置
+type UpstreamTLSConfig struct {
+	Verify        bool     `yaml:"verify"`         // 校验上游证书
+	InsecureHosts []string `yaml:"insecure_hosts"` // 不校验证书的域名，规则格式同 domain_filter
+	RootCAs       []string `yaml:"root_cas"`       // 额外信任的根证书文件（PEM），与系统根证书一起使用
+
+	ClientCerts    []ClientCertConfig `yaml:"client_certs"`     // 按域名出示的客户端证书（mTLS）
+	ClientCertFile string             `yaml:"client_cert_file"` // 通过 API 上传的客户端证书保存位置
+}
+
+// CaptureConfig 流量捕获，保存经过代理的请求和响应
+type CaptureConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	MaxFlows    int               `yaml:"max_flows"`     // 内存中保留的最近流量条数
+	MaxBodySize int64             `yaml:"max_body_size"` // 请求体和响应体各自保存的最大字节数，超出部分截断
+	Storage     FlowStorageConfig `yaml:"storage"`
+}
+
+// FlowStorageConfig 流量持久化，按段追加写入磁盘，重启后仍可查询
+type FlowStorageConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Dir         string        `yaml:"dir"`
+	MaxAge      time.Duration `yaml:"max_age"`      // 超过该时间的流量被删除（0 表示不按时间清理）
+	MaxSize     int64         `yaml:"max_size"`     // 所有段文件的总大小上限，超出时删除最旧的段（0 表示不限制）
+	SegmentSize int64         `yaml:"segment_size"` // 单个段文件写满后切换到新段
+}
+
+// BreakpointConfig 断点，命中 breakpoint 规则的请求或响应暂停，在 Web 界面中修改后放行
+type BreakpointConfig struct {
+	Timeout   time.Duration `yaml:"timeout"`    // 无人处理时自动放行的时间
+	MaxPaused int           `yaml:"max_paused"` // 同时暂停的上限，超出时不再暂停，直接放行
+}
+
+// ClientCertConfig 上游客户端证书，域名规则格式同 domain_filter
+type ClientCertConfig struct {
+	Host     string `yaml:"host"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// DefaultAllowDomains 默认域名白名单（小程序及其依赖的服务）
+var DefaultAllowDomains = []string{
+	// IP地址
+	"114.66.51.98",
+	"110.42.67.153",
+
+	// suraimu
+	".suraimu.com",
+
+	// qmai相关
+	".qmai.cn",
+	".qmai.com",
+
+	// 微信相关
+	".qq.com",
+	".wechat.com",
+	".weixinbridge.com",
+	".servicewechat.com",
+	".wechatpay.cn",  // 微信支付
+	".qlogo.cn",      // 微信头像
+	".qpic.cn",       // 微信图片
+	".wxpay.cn",      // 微信支付
+	".weixinmp.com",  // 微信公众平台
+	".wechatapp.com", // 微信小程序
+	".tenpay.com",    // 微信支付
+
+	// 苹果推送（iOS需要）
+	".apple.com",
+	".icloud.com",
+	".mzstatic.com",
+
+	// 闲鱼相关
+	".idlefish.com",
+	".xianyu.com",
+
+	// 阿里相关
+	".alibaba.com",
+	".alibabacloud.com",
+	".aliyun.com",
+	".aliyuncs.com",
+	".alicdn.com",
+	".taobao.com",
+	".tmall.com",
+	".alipay.com",
+	".alipayobjects.com",
+	".mmstat.com",
+	".tbcdn.cn",
+	".aliapp.org",
+	".amap.com",
+	".uc.cn",
+	".ucweb.com",
+}
+
 var (
 	cfg  *Config
 	once sync.Once
+	mu   sync.RWMutex
 )
 
 func Load(path string) (*Config, error) {
@@ -52,19 +276,99 @@ func Load(path string) (*Config, error) {
 			ProxyPort: 2021,
 			WebPort:   2022,
 			BindIP:    "0.0.0.0",
+			ProxyProtocol: ProxyProtocolConfig{
+				HeaderTimeout: 5 * time.Second,
+			},
 		},
 		Security: SecurityConfig{
 			Enabled:    true,
 			APIToken:   "changeme",
-			AllowedIPs: []string{"0.0.0.0/0"},
+			SessionTTL: 12 * time.Hour,
+			AllowedIPs: []string{"0.0.0.0/0", "::/0"},
+			ProxyAuth: ProxyAuthConfig{
+				Realm: "SunnyProxy",
+			},
 		},
 		Logging: LoggingConfig{
 			Level:   "info",
 			Console: true,
+			WebSocket: WebSocketConfig{
+				QueueSize:    256,
+				Policy:       "drop_oldest",
+				WriteTimeout: 10 * time.Second,
+				PingInterval: 30 * time.Second,
+			},
 		},
 		Rules: RulesConfig{
 			File: "rules.json",
 		},
+		IPFilter: IPFilterConfig{
+			Enabled:          true,
+			AllowedCountries: []string{"CN"},
+			FailOpen:         true,
+			AllowPrivate:     true,
+			WhitelistTTL:     7 * 24 * time.Hour,
+			BlacklistTTL:     24 * time.Hour,
+			StateFile:        "ipfilter.json",
+			AutoBan: AutoBanConfig{
+				Window:        10 * time.Minute,
+				AuthFailures:  5,
+				DeniedDomains: 30,
+				RateLimited:   5,
+				BanTime:       time.Hour,
+				Escalation:    2,
+				MaxBanTime:    7 * 24 * time.Hour,
+				ForgetAfter:   30 * 24 * time.Hour,
+			},
+		},
+		RateLimit: RateLimitConfig{
+			PerIP: RateLimits{
+				RequestsPerSecond: 50,
+				Burst:             100,
+				MaxConnections:    100,
+			},
+		},
+		DomainFilter: DomainFilterConfig{
+			Enabled: true,
+			Mode:    "allowlist",
+			Allow:   append([]string(nil), DefaultAllowDomains...),
+			File:    "domains.json",
+		},
+		Mitm: MitmConfig{
+			Include:          []string{".qmai.cn"},
+			PinningFallback:  true,
+			PinningThreshold: 2,
+			PinningTTL:       24 * time.Hour,
+			CertCacheSize:    1000,
+			CertCacheTTL:     24 * time.Hour,
+			LeafKeyType:      "ecdsa",
+		},
+		CA: CAConfig{
+			CertFile:     "ca.crt",
+			KeyFile:      "ca.key",
+			KeyType:      "rsa",
+			ValidityDays: 3650,
+			GracePeriod:  72 * time.Hour,
+		},
+		UpstreamTLS: UpstreamTLSConfig{
+			Verify:         true,
+			ClientCertFile: "client_certs.json",
+		},
+		Capture: CaptureConfig{
+			Enabled:     true,
+			MaxFlows:    1000,
+			MaxBodySize: 128 * 1024,
+			Storage: FlowStorageConfig{
+				Dir:         "flows",
+				MaxAge:      7 * 24 * time.Hour,
+				MaxSize:     1 << 30,
+				SegmentSize: 16 << 20,
+			},
+		},
+		Breakpoints: BreakpointConfig{
+			Timeout:   time.Minute,
+			MaxPaused: 20,
+		},
 	}
 
 	if err := yaml.Unmarshal(data, config); err != nil {
@@ -72,34 +376,123 @@ func Load(path string) (*Config, error) {
 	}
 
 	once.Do(func() {
-		cfg = config
+		Set(config)
 	})
 
 	return config, nil
 }
 
 func Get() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
 	return cfg
 }
 
+// Set 替换全局配置（热加载后调用）
+func Set(c *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = c
+}
+
 func Default() *Config {
 	return &Config{
 		Server: ServerConfig{
 			ProxyPort: 2021,
 			WebPort:   2022,
 			BindIP:    "0.0.0.0",
+			ProxyProtocol: ProxyProtocolConfig{
+				HeaderTimeout: 5 * time.Second,
+			},
 		},
 		Security: SecurityConfig{
 			Enabled:    false,
 			APIToken:   "",
+			SessionTTL: 12 * time.Hour,
 			AllowedIPs: []string{},
+			ProxyAuth: ProxyAuthConfig{
+				Realm: "SunnyProxy",
+			},
 		},
 		Logging: LoggingConfig{
 			Level:   "info",
 			Console: true,
+			WebSocket: WebSocketConfig{
+				QueueSize:    256,
+				Policy:       "drop_oldest",
+				WriteTimeout: 10 * time.Second,
+				PingInterval: 30 * time.Second,
+			},
 		},
 		Rules: RulesConfig{
 			File: "rules.json",
 		},
+		IPFilter: IPFilterConfig{
+			Enabled:          true,
+			AllowedCountries: []string{"CN"},
+			FailOpen:         true,
+			AllowPrivate:     true,
+			WhitelistTTL:     7 * 24 * time.Hour,
+			BlacklistTTL:     24 * time.Hour,
+			StateFile:        "ipfilter.json",
+			AutoBan: AutoBanConfig{
+				Window:        10 * time.Minute,
+				AuthFailures:  5,
+				DeniedDomains: 30,
+				RateLimited:   5,
+				BanTime:       time.Hour,
+				Escalation:    2,
+				MaxBanTime:    7 * 24 * time.Hour,
+				ForgetAfter:   30 * 24 * time.Hour,
+			},
+		},
+		RateLimit: RateLimitConfig{
+			PerIP: RateLimits{
+				RequestsPerSecond: 50,
+				Burst:             100,
+				MaxConnections:    100,
+			},
+		},
+		DomainFilter: DomainFilterConfig{
+			Enabled: true,
+			Mode:    "allowlist",
+			Allow:   append([]string(nil), DefaultAllowDomains...),
+			File:    "domains.json",
+		},
+		Mitm: MitmConfig{
+			Include:          []string{".qmai.cn"},
+			PinningFallback:  true,
+			PinningThreshold: 2,
+			PinningTTL:       24 * time.Hour,
+			CertCacheSize:    1000,
+			CertCacheTTL:     24 * time.Hour,
+			LeafKeyType:      "ecdsa",
+		},
+		CA: CAConfig{
+			CertFile:     "ca.crt",
+			KeyFile:      "ca.key",
+			KeyType:      "rsa",
+			ValidityDays: 3650,
+			GracePeriod:  72 * time.Hour,
+		},
+		UpstreamTLS: UpstreamTLSConfig{
+			Verify:         true,
+			ClientCertFile: "client_certs.json",
+		},
+		Capture: CaptureConfig{
+			Enabled:     true,
+			MaxFlows:    1000,
+			MaxBodySize: 128 * 1024,
+			Storage: FlowStorageConfig{
+				Dir:         "flows",
+				MaxAge:      7 * 24 * time.Hour,
+				MaxSize:     1 << 30,
+				SegmentSize: 16 << 20,
+			},
+		},
+		Breakpoints: BreakpointConfig{
+			Timeout:   time.Minute,
+			MaxPaused: 20,
+		},
 	}
 }
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// WatchFile 轮询文件的修改时间和大小，发生变化时调用 onChange
+// 返回的函数用于停止监听
+func WatchFile(path string, interval time.Duration, onChange func()) func() {
+	stop := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastMod, lastSize := fileState(path)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				mod, size := fileState(path)
+				if mod.Equal(lastMod) && size == lastSize {
+					continue
+				}
+				lastMod, lastSize = mod, size
+				// 文件被删除时不触发，等待重新写入
+				if !mod.IsZero() {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+func fileState(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}